@@ -9,7 +9,7 @@ import (
 )
 
 func (ga *GAuth) accountHandler(w http.ResponseWriter, r *http.Request) {
-	fc := ga.formConfig()
+	fc := ga.formConfig(w, r)
 	tabs, fields := ga.accountFields()
 	tab := r.URL.Query().Get("tab")
 	if tab == "" && len(tabs) > 0 {
@@ -28,9 +28,13 @@ func (ga *GAuth) accountHandler(w http.ResponseWriter, r *http.Request) {
 			ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: http.StatusText(http.StatusUnauthorized)})
 			return
 		}
+		if auth.IsClient() {
+			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+			return
+		}
 
 		ctx := r.Context()
-		identity, err := ga.IdentityProvider.IdentityLoad(ctx, auth.UID)
+		identity, err := ga.identityLoad(ctx, auth.UID)
 		if err != nil {
 			ga.internalError(w, err)
 			return
@@ -62,6 +66,11 @@ func (ga *GAuth) accountHandler(w http.ResponseWriter, r *http.Request) {
 			ga.writeJSON(http.StatusOK, w, data)
 			return
 		case http.MethodPost:
+			// impersonated and api key access can view but not change the account
+			if !auth.canManageAccount() {
+				ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+				return
+			}
 			req := make(map[string]interface{})
 			if err := ga.bind(r, &req); err != nil {
 				ga.badError(w, err)
@@ -110,6 +119,7 @@ func (ga *GAuth) accountHandler(w http.ResponseWriter, r *http.Request) {
 				}
 				data[FieldRecoveryCodesID] = strings.Join(codes, "|")
 			}
+			had2FA := toString(data[FieldTOTPSecretID]) != ""
 			secret, ok := req[FieldTOTPSecretID].(string)
 			if ok && secret == "" {
 				data[FieldTOTPSecretID] = ""
@@ -147,6 +157,17 @@ func (ga *GAuth) accountHandler(w http.ResponseWriter, r *http.Request) {
 				ga.internalError(w, err)
 				return
 			}
+			// data still has the current email for notifications, it's told about a requested
+			// change once the update link is sent in case the new email is compromised
+			if status == http.StatusCreated && nEmail != "" {
+				ga.notify(ctx, actionEmailChange, auth.UID, data, map[string]interface{}{"new_email": nEmail})
+			}
+			if pw != "" {
+				ga.notify(ctx, actionPasswordChanged, auth.UID, data, nil)
+			}
+			if had2FA && toString(data[FieldTOTPSecretID]) == "" {
+				ga.notify(ctx, actionTwoFactorDisabled, auth.UID, data, nil)
+			}
 			cleanResp()
 			ga.writeJSON(status, w, data)
 			return
@@ -157,7 +178,10 @@ func (ga *GAuth) accountHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == http.MethodGet {
-		if err := form.Render(w, fc); err != nil {
+		if ga.staleLinkRedirect(w, r) {
+			return
+		}
+		if err := ga.renderForm(w, fc); err != nil {
 			ga.internalError(w, err)
 		}
 		return
@@ -3,9 +3,7 @@ package gauth
 import (
 	"image/png"
 	"net/http"
-	"strings"
 
-	"github.com/altlimit/gauth/cache"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 )
@@ -49,6 +47,21 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			ga.writeJSON(http.StatusOK, w, recovery)
 			return
 		}
+	case "impersonate":
+		ga.impersonateHandler(w, r, ImpersonationStart, req["uid"])
+		return
+	case "stopimpersonate":
+		ga.impersonateHandler(w, r, ImpersonationStop, "")
+		return
+	case "apiKeys", "newApiKey", "revokeApiKey":
+		ga.apiKeyHandler(w, r, req)
+		return
+	case "orgs", "newOrg", "orgSwitch", "orgMembers", "orgLeave", "orgInvite", "orgRole", "orgRemove", actionOrgInvite:
+		ga.organizationHandler(w, r, req)
+		return
+	case actionLock:
+		ga.lockHandler(w, r, req["token"])
+		return
 	case "newTotpKey":
 		if !ga.disable2FA {
 			auth, err := ga.Authorized(r)
@@ -57,9 +70,13 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 				ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: http.StatusText(http.StatusUnauthorized)})
 				return
 			}
+			if !auth.canManageAccount() {
+				ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+				return
+			}
 
 			ctx := r.Context()
-			accoount, err := ga.IdentityProvider.IdentityLoad(ctx, auth.UID)
+			accoount, err := ga.identityLoad(ctx, auth.UID)
 			if err != nil {
 				ga.internalError(w, err)
 				return
@@ -85,15 +102,14 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	case actionVerify:
 		// when you click the verify link from your email, this saves the active to true
-		claims, err := ga.tokenStringClaims(req["token"], "")
-		if err != nil || claims["act"] != actionVerify {
-			ga.log("verify token error", err)
-			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+		claims, err := ga.emailTokenClaims(ctx, req["token"], "", actionVerify)
+		if err != nil {
+			ga.emailTokenError(w, err)
 			return
 		}
 		uid := claims["uid"]
 		if claims["act"] == actionVerify && len(uid) > 0 {
-			identity, err := ga.IdentityProvider.IdentityLoad(ctx, uid)
+			identity, err := ga.identityLoad(ctx, uid)
 			if err == ErrIdentityNotFound {
 				ga.writeJSON(http.StatusNotFound, w, errorResponse{Error: "identity not found"})
 				return
@@ -119,12 +135,10 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			ga.validationError(w, ga.IdentityFieldID, "required")
 			return
 		}
-		if err := ga.rateLimiter.RateLimit(ctx, "resetlink:"+strings.ToLower(identity), ga.RateLimit.ResetLink.Rate, ga.RateLimit.ResetLink.Duration); err != nil {
-			if _, ok := err.(cache.RateLimitError); ok {
-				ga.validationError(w, ga.IdentityFieldID, "try again later")
-				return
-			}
-			ga.internalError(w, err)
+		if !ga.validCaptcha(w, r, FlowResetLink, req[FieldCaptchaID]) {
+			return
+		}
+		if !ga.rateLimitFlow(ctx, w, r, FlowResetLink, identity) {
 			return
 		}
 		uid, err := ga.IdentityProvider.IdentityUID(ctx, identity)
@@ -133,7 +147,7 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if uid != "" {
-			identity, err := ga.IdentityProvider.IdentityLoad(ctx, uid)
+			identity, err := ga.identityLoad(ctx, uid)
 			if err != nil {
 				ga.internalError(w, err)
 				return
@@ -163,24 +177,22 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		uid := uclaim["uid"].(string)
-		if err := ga.rateLimiter.RateLimit(ctx, "resetlink:"+uid, ga.RateLimit.ResetLink.Rate, ga.RateLimit.ResetLink.Duration); err != nil {
-			if _, ok := err.(cache.RateLimitError); ok {
-				ga.validationError(w, ga.IdentityFieldID, "try again later")
-				return
-			}
-			ga.internalError(w, err)
+		if !ga.rateLimitFlow(ctx, w, r, FlowResetLink, uid) {
 			return
 		}
-		identity, err := ga.IdentityProvider.IdentityLoad(ctx, uid)
+		identity, err := ga.identityLoad(ctx, uid)
 		if err == ErrIdentityNotFound {
 			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
 			return
 		}
 		acct := ga.loadIdentity(identity)
 		pw := toString(acct[ga.PasswordFieldID])
-		claims, err := ga.tokenStringClaims(req["token"], pw)
-		if err != nil || uid != claims["uid"] {
-			ga.log("verify token error", err)
+		claims, err := ga.emailTokenClaims(ctx, req["token"], pw, actionReset)
+		if err != nil {
+			ga.emailTokenError(w, err)
+			return
+		}
+		if uid != claims["uid"] {
 			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
 			return
 		}
@@ -196,6 +208,7 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 				ga.internalError(w, err)
 				return
 			}
+			ga.notify(ctx, actionPasswordChanged, uid, acct, nil)
 			ga.writeJSON(http.StatusOK, w, nil)
 			return
 		}
@@ -208,12 +221,10 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			ga.validationError(w, ga.IdentityFieldID, "required")
 			return
 		}
-		if err := ga.rateLimiter.RateLimit(ctx, "confirmemail:"+strings.ToLower(identity), ga.RateLimit.ConfirmEmail.Rate, ga.RateLimit.ConfirmEmail.Duration); err != nil {
-			if _, ok := err.(cache.RateLimitError); ok {
-				ga.validationError(w, ga.IdentityFieldID, "try again later")
-				return
-			}
-			ga.internalError(w, err)
+		if !ga.validCaptcha(w, r, FlowConfirmEmail, req[FieldCaptchaID]) {
+			return
+		}
+		if !ga.rateLimitFlow(ctx, w, r, FlowConfirmEmail, identity) {
 			return
 		}
 		uid, err := ga.IdentityProvider.IdentityUID(ctx, identity)
@@ -222,7 +233,7 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if uid != "" {
-			identity, err := ga.IdentityProvider.IdentityLoad(ctx, uid)
+			identity, err := ga.identityLoad(ctx, uid)
 			if err != nil {
 				ga.internalError(w, err)
 				return
@@ -244,15 +255,25 @@ func (ga *GAuth) actionHandler(w http.ResponseWriter, r *http.Request) {
 			ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: http.StatusText(http.StatusUnauthorized)})
 			return
 		}
-		uclaim, err := unverifiedClaims(req["token"])
-		if err != nil || uclaim["act"] != actionEmailUpdate {
-			ga.log("unverified token error", err)
+		if !auth.canManageAccount() {
 			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
 			return
 		}
-		email, ok := uclaim["email"].(string)
-		if ok && email != "" {
-			identity, err := ga.IdentityProvider.IdentityLoad(ctx, auth.UID)
+		claims, err := ga.verifyEmailToken(ctx, req["token"], "", actionEmailUpdate)
+		if err != nil {
+			ga.emailTokenError(w, err)
+			return
+		}
+		if claims["uid"] != auth.UID {
+			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+			return
+		}
+		if err := ga.useEmailToken(ctx, claims); err != nil {
+			ga.emailTokenError(w, err)
+			return
+		}
+		if email := claims["email"]; email != "" {
+			identity, err := ga.identityLoad(ctx, auth.UID)
 			if err != nil {
 				ga.internalError(w, err)
 				return
@@ -0,0 +1,190 @@
+package gauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyPrefix is prepended to every generated key so Authorized can tell it apart from a jwt
+	APIKeyPrefix = "gak_"
+)
+
+type (
+	// APIKey is a personal key created from the account page, only the Hash of the key is stored.
+	APIKey struct {
+		ID  string `json:"id"`
+		UID string `json:"-"`
+		// TenantID is the tenant the key was created in, it's only accepted there
+		TenantID  string    `json:"-"`
+		Name      string    `json:"name"`
+		Hash      string    `json:"-"`
+		Scopes    []string  `json:"scopes,omitempty"`
+		CreatedAt time.Time `json:"created_at"`
+		// zero means no expiration
+		ExpiresAt time.Time `json:"expires_at"`
+		LastUsed  time.Time `json:"last_used"`
+	}
+)
+
+var (
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+// Expired returns true if this key has an expiration that has passed
+func (k *APIKey) Expired() bool {
+	return !k.ExpiresAt.IsZero() && k.ExpiresAt.Before(time.Now())
+}
+
+// hashAPIKey keys are random 32 bytes so a fast hash is enough here unlike passwords
+func hashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+func newAPIKey() (id string, key string, err error) {
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", fmt.Errorf("newAPIKey: rand error %v", err)
+	}
+	id = hex.EncodeToString(b[:8])
+	key = APIKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(b[8:])
+	return id, key, nil
+}
+
+// CreateAPIKey generates and stores a new key for uid, the returned key is only available here.
+func (ga *GAuth) CreateAPIKey(ctx context.Context, uid, name string, scopes []string, expiry time.Time) (string, *APIKey, error) {
+	if ga.apiKeyProvider == nil {
+		return "", nil, errors.New("CreateAPIKey: APIKeyProvider not implemented")
+	}
+	id, key, err := newAPIKey()
+	if err != nil {
+		return "", nil, err
+	}
+	tid := ga.tenantID()
+	if t := TenantFromContext(ctx); t != nil {
+		tid = t.ID
+	}
+	ak := &APIKey{
+		ID:        id,
+		UID:       uid,
+		TenantID:  tid,
+		Name:      name,
+		Hash:      hashAPIKey(key),
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiry,
+	}
+	if err := ga.apiKeyProvider.APIKeyCreate(ctx, ak); err != nil {
+		return "", nil, err
+	}
+	return key, ak, nil
+}
+
+func (ga *GAuth) apiKeyAuth(r *http.Request, key string) (*Auth, error) {
+	if ga.apiKeyProvider == nil {
+		return nil, ErrInvalidAccessToken
+	}
+	ctx := r.Context()
+	ak, err := ga.apiKeyProvider.APIKeyLoad(ctx, hashAPIKey(key))
+	if err != nil {
+		if err == ErrAPIKeyNotFound {
+			return nil, ErrInvalidAccessToken
+		}
+		return nil, fmt.Errorf("apiKeyAuth: %v", err)
+	}
+	if ak.Expired() || ak.TenantID != ga.tenantID() {
+		return nil, ErrInvalidAccessToken
+	}
+	if err := ga.apiKeyProvider.APIKeyUsed(ctx, ak.UID, ak.ID, time.Now()); err != nil {
+		ga.log("APIKeyUsed error", err)
+	}
+	return &Auth{UID: ak.UID, APIKeyID: ak.ID, Scopes: ak.Scopes}, nil
+}
+
+func (ga *GAuth) apiKeyHandler(w http.ResponseWriter, r *http.Request, req map[string]string) {
+	if ga.apiKeyProvider == nil {
+		ga.writeJSON(http.StatusNotFound, w, nil)
+		return
+	}
+	auth, err := ga.Authorized(r)
+	if err != nil {
+		ga.log("AuthorizedError: ", err)
+		ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+	if !auth.canManageAccount() {
+		ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+		return
+	}
+	ctx := r.Context()
+	switch req["action"] {
+	case "newApiKey":
+		name := strings.TrimSpace(req["name"])
+		if name == "" {
+			ga.validationError(w, "apikey_name", "required")
+			return
+		}
+		if len(name) > 100 {
+			ga.validationError(w, "apikey_name", "too long")
+			return
+		}
+		var expiry time.Time
+		if days := req["expires"]; days != "" {
+			d, err := strconv.Atoi(days)
+			if err != nil || d < 1 {
+				ga.validationError(w, "apikey_expires", "invalid")
+				return
+			}
+			expiry = time.Now().Add(time.Hour * 24 * time.Duration(d))
+		}
+		var scopes []string
+		for _, s := range strings.Split(req["scopes"], ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				scopes = append(scopes, s)
+			}
+		}
+		key, ak, err := ga.CreateAPIKey(ctx, auth.UID, name, scopes, expiry)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusCreated, w, map[string]interface{}{
+			"key":    key,
+			"apikey": ak,
+		})
+	case "revokeApiKey":
+		if req["id"] == "" {
+			ga.validationError(w, "id", "required")
+			return
+		}
+		if err := ga.apiKeyProvider.APIKeyDelete(ctx, auth.UID, req["id"]); err != nil {
+			if err == ErrAPIKeyNotFound {
+				ga.writeJSON(http.StatusNotFound, w, errorResponse{Error: err.Error()})
+				return
+			}
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusOK, w, nil)
+	default:
+		keys, err := ga.apiKeyProvider.APIKeyList(ctx, auth.UID)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		if keys == nil {
+			keys = []*APIKey{}
+		}
+		ga.writeJSON(http.StatusOK, w, keys)
+	}
+}
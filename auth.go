@@ -16,6 +16,19 @@ type (
 	Auth struct {
 		UID    string          `json:"sub"`
 		Grants json.RawMessage `json:"grants"`
+		// Actor is set when this token was issued through impersonation (RFC 8693 "act" claim)
+		Actor *Actor `json:"act,omitempty"`
+		// APIKeyID and Scopes are set when authorized with a personal API key
+		APIKeyID string   `json:"-"`
+		Scopes   []string `json:"-"`
+		// ClientID is set when the principal is a client from the client_credentials grant,
+		// UID is empty in this case.
+		ClientID string `json:"client_id,omitempty"`
+	}
+
+	// Actor is the principal acting on behalf of Auth.UID
+	Actor struct {
+		UID string `json:"sub"`
 	}
 )
 
@@ -24,9 +37,14 @@ const (
 	AuthKey ctxKey = "authKey"
 	// RequestKey for accessing request inside context
 	RequestKey ctxKey = "requestKey"
+	// LocaleKey stores the negotiated language of the request, see LocaleFromContext
+	LocaleKey ctxKey = "localeKey"
 
 	// used for default refresh token cid to invalidate by password update
 	pwHashKey ctxKey = "pwhash"
+
+	// clientSubjectPrefix namespaces the subject of client access tokens from user UIDs
+	clientSubjectPrefix = "client:"
 )
 
 var (
@@ -42,13 +60,29 @@ func (a *Auth) Load(dst interface{}) error {
 	return json.Unmarshal(a.Grants, dst)
 }
 
+// Impersonated returns true if this token was issued to an actor logged in as another user,
+// use this to show a banner in your app.
+func (a *Auth) Impersonated() bool {
+	return a.Actor != nil
+}
+
+// IsClient returns true if the principal is a machine client instead of a user
+func (a *Auth) IsClient() bool {
+	return a.ClientID != ""
+}
+
+// canManageAccount is false for impersonated, api key or client access so they can't change sensitive settings
+func (a *Auth) canManageAccount() bool {
+	return !a.Impersonated() && a.APIKeyID == "" && !a.IsClient()
+}
+
 func (ga *GAuth) headerToken(r *http.Request) string {
 	auth := strings.Split(r.Header.Get("Authorization"), " ")
 	if len(auth) == 2 && strings.ToLower(auth[0]) == "bearer" {
 		return auth[1]
 	}
 	if ga.AccessTokenCookieName != "" {
-		c, err := r.Cookie(ga.AccessTokenCookieName)
+		c, err := ga.cookie(r, ga.AccessTokenCookieName)
 		if err == nil && c != nil {
 			return c.Value
 		}
@@ -57,10 +91,17 @@ func (ga *GAuth) headerToken(r *http.Request) string {
 }
 
 func (ga *GAuth) Authorized(r *http.Request) (*Auth, error) {
+	ga, _, r, err := ga.tenantRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("tokenAuth: %v", err)
+	}
 	t := ga.headerToken(r)
 	if t == "" {
 		return nil, ErrNoToken
 	}
+	if strings.HasPrefix(t, APIKeyPrefix) {
+		return ga.apiKeyAuth(r, t)
+	}
 	claims, err := ga.tokenClaims(t, "")
 	if err != nil {
 		return nil, fmt.Errorf("tokenAuth: %v", err)
@@ -68,6 +109,21 @@ func (ga *GAuth) Authorized(r *http.Request) (*Auth, error) {
 	auth := &Auth{
 		UID: claims["sub"].(string),
 	}
+	if clientID, ok := claims["client_id"].(string); ok && clientID != "" {
+		if auth.UID != clientSubjectPrefix+clientID {
+			return nil, ErrInvalidAccessToken
+		}
+		auth.UID = ""
+		auth.ClientID = clientID
+		if scope, ok := claims["scope"].(string); ok {
+			auth.Scopes = strings.Fields(scope)
+		}
+	}
+	if act, ok := claims["act"].(map[string]interface{}); ok {
+		if sub, ok := act["sub"].(string); ok && sub != "" {
+			auth.Actor = &Actor{UID: sub}
+		}
+	}
 	if grants, ok := claims["grants"]; ok {
 		if g, ok := grants.(string); ok && g == "access" {
 			return auth, nil
@@ -82,7 +138,7 @@ func (ga *GAuth) Authorized(r *http.Request) (*Auth, error) {
 }
 
 func (ga *GAuth) AuthMiddleware(next http.Handler) http.Handler {
-	errorUnauthorized := func(w http.ResponseWriter, r *http.Request) {
+	errorUnauthorized := func(ga *GAuth, w http.ResponseWriter, r *http.Request) {
 		msg := http.StatusText(http.StatusUnauthorized)
 		if ga.isJson(r) {
 			ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: msg})
@@ -93,10 +149,19 @@ func (ga *GAuth) AuthMiddleware(next http.Handler) http.Handler {
 		}
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth, err := ga.Authorized(r)
+		tga, _, r, err := ga.tenantRequest(r)
+		if err != nil {
+			ga.tenantError(w, r, err)
+			return
+		}
+		auth, err := tga.Authorized(r)
 		if err != nil {
 			ga.log("AuthError: ", err)
-			errorUnauthorized(w, r)
+			errorUnauthorized(tga, w, r)
+			return
+		}
+		if err := tga.checkCSRF(r); err != nil {
+			tga.csrfError(w, err)
 			return
 		}
 		ctx := context.WithValue(r.Context(), AuthKey, auth)
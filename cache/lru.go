@@ -1,133 +1,417 @@
 package cache
 
 import (
+	"errors"
+	"fmt"
+	"hash/maphash"
 	"sync"
 	"time"
 )
 
-type node struct {
-	key        interface{}
-	val        *lruItem
-	prev, next *node
+const (
+	// EvictCapacity is the reason when the least recently used item is removed for a new one
+	EvictCapacity EvictReason = iota
+	// EvictExpired is the reason when an item is removed after its ttl
+	EvictExpired
+)
+
+const (
+	// caches with at least shardMinCapacity uses defaultShards, smaller caches uses a single
+	// shard so the least recently used order is exact.
+	shardMinCapacity = 1024
+	defaultShards    = 16
+)
+
+// ErrLoadPanic is returned to the callers of GetOrLoad that waited for a load that panicked
+var ErrLoadPanic = errors.New("cache: load panicked")
+
+type node[K comparable, V any] struct {
+	key        K
+	val        *lruItem[V]
+	prev, next *node[K, V]
 }
 
 type (
-	LRUCache struct {
-		size       int
-		capacity   int
-		cache      sync.Map
-		head, tail *node
+	EvictReason int
+
+	// LRU is safe for concurrent use, keys are distributed to shards that each have
+	// their own lock, list and a share of the capacity.
+	LRU[K comparable, V any] struct {
+		capacity int
+		shards   []*lruShard[K, V]
+		seed     maphash.Seed
+		onEvict  func(key K, val V, reason EvictReason)
+		stop     chan struct{}
+		stopOnce sync.Once
+	}
+
+	// LRUCache is an untyped LRU
+	LRUCache = LRU[interface{}, interface{}]
+
+	LRUOptions[K comparable, V any] struct {
+		Capacity int
+		// Shards defaults to 16 when Capacity is at least 1024 otherwise 1
+		Shards int
+		// SweepInterval starts a goroutine that removes expired items, call Close to stop it.
+		// Without it expired items are swept every time a shard receives capacity puts.
+		SweepInterval time.Duration
+		// OnEvict is called outside of the lock when an item is removed by capacity or expiry
+		OnEvict func(key K, val V, reason EvictReason)
+	}
+
+	// LRUStats are counters since the cache was created
+	LRUStats struct {
+		Hits        int64
+		Misses      int64
+		Evictions   int64
+		Expirations int64
+		Len         int
+	}
+
+	lruShard[K comparable, V any] struct {
 		lock       sync.Mutex
+		items      map[K]*node[K, V]
+		loading    map[K]*loadCall[V]
+		head, tail *node[K, V]
+		capacity   int
+		puts       int
+		stats      LRUStats
 	}
 
-	lruItem struct {
+	lruItem[V any] struct {
 		Expire time.Time
-		Value  interface{}
+		Value  V
+	}
+
+	// loadCall is an in flight GetOrLoad that other callers of the same key wait for,
+	// stale is set when the key is put or deleted during the load.
+	loadCall[V any] struct {
+		wg    sync.WaitGroup
+		val   V
+		err   error
+		stale bool
+	}
+
+	evicted[K comparable, V any] struct {
+		key    K
+		val    V
+		reason EvictReason
 	}
 )
 
-func initNode(key interface{}, val *lruItem) *node {
-	return &node{
+func initNode[K comparable, V any](key K, val *lruItem[V]) *node[K, V] {
+	return &node[K, V]{
 		key: key,
 		val: val,
 	}
 }
 
 func NewLRUCache(capacity int) *LRUCache {
-	c := &LRUCache{
-		capacity: capacity,
-		head:     initNode(nil, nil),
-		tail:     initNode(nil, nil),
-	}
-	c.head.next = c.tail
-	c.tail.prev = c.head
-	return c
+	return NewLRU(LRUOptions[interface{}, interface{}]{Capacity: capacity})
 }
 
-func (c *LRUCache) Get(key interface{}) (interface{}, bool) {
-	if v, ok := c.cache.Load(key); ok {
-		n, _ := v.(*node)
-		item := n.val
-		if !item.Expire.IsZero() && item.Expire.Before(time.Now()) {
-			c.removeNode(n)
-			c.cache.Delete(n.key)
-			c.size--
-		} else {
-			c.moveToHead(n)
-			return item.Value, true
+func NewLRU[K comparable, V any](opts LRUOptions[K, V]) *LRU[K, V] {
+	if opts.Capacity < 1 {
+		opts.Capacity = 1
+	}
+	if opts.Shards < 1 {
+		opts.Shards = 1
+		if opts.Capacity >= shardMinCapacity {
+			opts.Shards = defaultShards
+		}
+	}
+	if opts.Shards > opts.Capacity {
+		opts.Shards = opts.Capacity
+	}
+	c := &LRU[K, V]{
+		capacity: opts.Capacity,
+		shards:   make([]*lruShard[K, V], opts.Shards),
+		seed:     maphash.MakeSeed(),
+		onEvict:  opts.OnEvict,
+	}
+	for i := range c.shards {
+		capacity := opts.Capacity / opts.Shards
+		if i < opts.Capacity%opts.Shards {
+			capacity++
+		}
+		var zero K
+		s := &lruShard[K, V]{
+			items:    make(map[K]*node[K, V]),
+			loading:  make(map[K]*loadCall[V]),
+			head:     initNode[K, V](zero, nil),
+			tail:     initNode[K, V](zero, nil),
+			capacity: capacity,
 		}
+		s.head.next = s.tail
+		s.tail.prev = s.head
+		c.shards[i] = s
+	}
+	if opts.SweepInterval > 0 {
+		c.stop = make(chan struct{})
+		go c.sweeper(opts.SweepInterval)
 	}
-	return nil, false
+	return c
+}
+
+func (c *LRU[K, V]) Get(key K) (V, bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	val, ok, removed := s.get(key, time.Now())
+	s.lock.Unlock()
+	c.evicted(removed...)
+	return val, ok
 }
 
-func (c *LRUCache) Put(key, val interface{}, expire time.Duration) {
-	if v, ok := c.cache.Load(key); ok {
-		n, _ := v.(*node)
-		n.val.Value = val
-		c.moveToHead(n)
-	} else {
-		item := &lruItem{Value: val}
-		if expire > 0 {
-			item.Expire = time.Now().Add(expire)
+// GetOrLoad returns the cached value of key or calls load once for concurrent callers of the
+// same key, a successful load is stored with expire unless key was put or deleted while loading.
+// If load panics the callers waiting for it get an ErrLoadPanic error and the panic continues
+// in the caller that ran it.
+func (c *LRU[K, V]) GetOrLoad(key K, expire time.Duration, load func(key K) (V, error)) (V, error) {
+	s := c.shard(key)
+	s.lock.Lock()
+	val, ok, removed := s.get(key, time.Now())
+	if ok {
+		s.lock.Unlock()
+		c.evicted(removed...)
+		return val, nil
+	}
+	if call, ok := s.loading[key]; ok {
+		s.lock.Unlock()
+		c.evicted(removed...)
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := &loadCall[V]{}
+	call.wg.Add(1)
+	s.loading[key] = call
+	s.lock.Unlock()
+	c.evicted(removed...)
+
+	loaded := false
+	defer func() {
+		var rec interface{}
+		if !loaded {
+			// waiters get an error, the loading caller gets the original panic
+			rec = recover()
+			call.err = fmt.Errorf("%w: %v", ErrLoadPanic, rec)
+		}
+		var removed []evicted[K, V]
+		s.lock.Lock()
+		delete(s.loading, key)
+		if loaded && call.err == nil && !call.stale {
+			removed = s.put(key, call.val, expire, time.Now())
 		}
-		n := initNode(key, item)
-		c.cache.Store(n.key, n)
-		c.addToHead(n)
-		c.size++
-		if c.size > c.capacity {
-			n = c.removeTail()
-			c.cache.Delete(n.key)
-			c.size--
+		s.lock.Unlock()
+		call.wg.Done()
+		c.evicted(removed...)
+		if rec != nil {
+			panic(rec)
 		}
+	}()
+	call.val, call.err = load(key)
+	loaded = true
+	return call.val, call.err
+}
+
+// Put adds or replaces the value of key, expire also replaces the ttl of an existing key
+// and zero means it never expires.
+func (c *LRU[K, V]) Put(key K, val V, expire time.Duration) {
+	s := c.shard(key)
+	s.lock.Lock()
+	removed := s.put(key, val, expire, time.Now())
+	if call, ok := s.loading[key]; ok {
+		call.stale = true
 	}
+	s.lock.Unlock()
+	c.evicted(removed...)
 }
 
-func (c *LRUCache) Delete(key interface{}) bool {
-	if v, ok := c.cache.Load(key); ok {
-		n, _ := v.(*node)
-		c.removeNode(n)
-		c.cache.Delete(n.key)
-		c.size--
+// Delete removes key, a GetOrLoad of key in flight won't store what it loaded
+func (c *LRU[K, V]) Delete(key K) bool {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if call, ok := s.loading[key]; ok {
+		call.stale = true
+	}
+	if n, ok := s.items[key]; ok {
+		s.removeNode(n)
 		return true
 	}
 	return false
 }
 
-func (c *LRUCache) Len() int {
-	return c.size
+// Len includes expired items that are not yet swept
+func (c *LRU[K, V]) Len() int {
+	size := 0
+	for _, s := range c.shards {
+		s.lock.Lock()
+		size += len(s.items)
+		s.lock.Unlock()
+	}
+	return size
 }
 
-func (c *LRUCache) Cap() int {
+func (c *LRU[K, V]) Cap() int {
 	return c.capacity
 }
 
-func (c *LRUCache) LoadFactor() float64 {
-	return float64(c.size) / float64(c.capacity)
+func (c *LRU[K, V]) LoadFactor() float64 {
+	return float64(c.Len()) / float64(c.capacity)
+}
+
+func (c *LRU[K, V]) Stats() LRUStats {
+	var stats LRUStats
+	for _, s := range c.shards {
+		s.lock.Lock()
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		stats.Evictions += s.stats.Evictions
+		stats.Expirations += s.stats.Expirations
+		stats.Len += len(s.items)
+		s.lock.Unlock()
+	}
+	return stats
 }
 
-func (c *LRUCache) addToHead(n *node) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	n.prev = c.head
-	n.next = c.head.next
-	c.head.next.prev = n
-	c.head.next = n
+// Sweep removes all expired items now
+func (c *LRU[K, V]) Sweep() {
+	now := time.Now()
+	for _, s := range c.shards {
+		s.lock.Lock()
+		removed := s.sweep(now)
+		s.lock.Unlock()
+		c.evicted(removed...)
+	}
 }
 
-func (c *LRUCache) removeNode(n *node) {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-	n.prev.next = n.next
-	n.next.prev = n.prev
+// Close stops the background sweeper started with SweepInterval
+func (c *LRU[K, V]) Close() {
+	if c.stop != nil {
+		c.stopOnce.Do(func() { close(c.stop) })
+	}
+}
+
+func (c *LRU[K, V]) sweeper(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			c.Sweep()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *LRU[K, V]) evicted(items ...evicted[K, V]) {
+	if c.onEvict == nil {
+		return
+	}
+	for _, e := range items {
+		c.onEvict(e.key, e.val, e.reason)
+	}
+}
+
+func (c *LRU[K, V]) shard(key K) *lruShard[K, V] {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	k, ok := interface{}(key).(string)
+	if !ok {
+		k = fmt.Sprint(key)
+	}
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(k)
+	return c.shards[h.Sum64()%uint64(len(c.shards))]
+}
+
+func (item *lruItem[V]) expired(now time.Time) bool {
+	return !item.Expire.IsZero() && !item.Expire.After(now)
 }
 
-func (c *LRUCache) moveToHead(n *node) {
-	c.removeNode(n)
-	c.addToHead(n)
+// get must be called with the lock held, an expired item is removed
+func (s *lruShard[K, V]) get(key K, now time.Time) (V, bool, []evicted[K, V]) {
+	var zero V
+	n, ok := s.items[key]
+	if !ok {
+		s.stats.Misses++
+		return zero, false, nil
+	}
+	if n.val.expired(now) {
+		s.removeNode(n)
+		s.stats.Expirations++
+		s.stats.Misses++
+		return zero, false, []evicted[K, V]{{key: n.key, val: n.val.Value, reason: EvictExpired}}
+	}
+	s.moveToHead(n)
+	s.stats.Hits++
+	return n.val.Value, true, nil
+}
+
+// put must be called with the lock held, it returns the items removed to make room
+func (s *lruShard[K, V]) put(key K, val V, expire time.Duration, now time.Time) []evicted[K, V] {
+	item := &lruItem[V]{Value: val}
+	if expire > 0 {
+		item.Expire = now.Add(expire)
+	}
+	if n, ok := s.items[key]; ok {
+		n.val = item
+		s.moveToHead(n)
+		return nil
+	}
+	var removed []evicted[K, V]
+	n := initNode(key, item)
+	s.items[key] = n
+	s.addToHead(n)
+	s.puts++
+	if s.puts >= s.capacity {
+		s.puts = 0
+		removed = s.sweep(now)
+	}
+	if len(s.items) > s.capacity {
+		n = s.tail.prev
+		s.removeNode(n)
+		s.stats.Evictions++
+		removed = append(removed, evicted[K, V]{key: n.key, val: n.val.Value, reason: EvictCapacity})
+	}
+	return removed
+}
+
+// sweep must be called with the lock held
+func (s *lruShard[K, V]) sweep(now time.Time) []evicted[K, V] {
+	var removed []evicted[K, V]
+	for _, n := range s.items {
+		if n.val.expired(now) {
+			s.removeNode(n)
+			s.stats.Expirations++
+			removed = append(removed, evicted[K, V]{key: n.key, val: n.val.Value, reason: EvictExpired})
+		}
+	}
+	return removed
+}
+
+func (s *lruShard[K, V]) addToHead(n *node[K, V]) {
+	n.prev = s.head
+	n.next = s.head.next
+	s.head.next.prev = n
+	s.head.next = n
+}
+
+// removeNode unlinks n and removes it from items
+func (s *lruShard[K, V]) removeNode(n *node[K, V]) {
+	s.unlink(n)
+	delete(s.items, n.key)
+}
+
+func (s *lruShard[K, V]) unlink(n *node[K, V]) {
+	n.prev.next = n.next
+	n.next.prev = n.prev
 }
 
-func (c *LRUCache) removeTail() *node {
-	n := c.tail.prev
-	c.removeNode(n)
-	return n
+func (s *lruShard[K, V]) moveToHead(n *node[K, V]) {
+	s.unlink(n)
+	s.addToHead(n)
 }
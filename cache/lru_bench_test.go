@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// legacyLRUCache is the previous implementation kept to compare benchmarks, it's not
+// safe for concurrent use so it's only benchmarked serially.
+type legacyNode struct {
+	key        interface{}
+	val        *legacyItem
+	prev, next *legacyNode
+}
+
+type (
+	legacyLRUCache struct {
+		size       int
+		capacity   int
+		cache      sync.Map
+		head, tail *legacyNode
+		lock       sync.Mutex
+	}
+
+	legacyItem struct {
+		Expire time.Time
+		Value  interface{}
+	}
+)
+
+func legacyInitNode(key interface{}, val *legacyItem) *legacyNode {
+	return &legacyNode{
+		key: key,
+		val: val,
+	}
+}
+
+func newLegacyLRUCache(capacity int) *legacyLRUCache {
+	c := &legacyLRUCache{
+		capacity: capacity,
+		head:     legacyInitNode(nil, nil),
+		tail:     legacyInitNode(nil, nil),
+	}
+	c.head.next = c.tail
+	c.tail.prev = c.head
+	return c
+}
+
+func (c *legacyLRUCache) Get(key interface{}) (interface{}, bool) {
+	if v, ok := c.cache.Load(key); ok {
+		n, _ := v.(*legacyNode)
+		item := n.val
+		if !item.Expire.IsZero() && item.Expire.Before(time.Now()) {
+			c.removeNode(n)
+			c.cache.Delete(n.key)
+			c.size--
+		} else {
+			c.moveToHead(n)
+			return item.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (c *legacyLRUCache) Put(key, val interface{}, expire time.Duration) {
+	if v, ok := c.cache.Load(key); ok {
+		n, _ := v.(*legacyNode)
+		n.val.Value = val
+		c.moveToHead(n)
+	} else {
+		item := &legacyItem{Value: val}
+		if expire > 0 {
+			item.Expire = time.Now().Add(expire)
+		}
+		n := legacyInitNode(key, item)
+		c.cache.Store(n.key, n)
+		c.addToHead(n)
+		c.size++
+		if c.size > c.capacity {
+			n = c.removeTail()
+			c.cache.Delete(n.key)
+			c.size--
+		}
+	}
+}
+
+func (c *legacyLRUCache) Delete(key interface{}) bool {
+	if v, ok := c.cache.Load(key); ok {
+		n, _ := v.(*legacyNode)
+		c.removeNode(n)
+		c.cache.Delete(n.key)
+		c.size--
+		return true
+	}
+	return false
+}
+
+func (c *legacyLRUCache) Len() int {
+	return c.size
+}
+
+func (c *legacyLRUCache) Cap() int {
+	return c.capacity
+}
+
+func (c *legacyLRUCache) LoadFactor() float64 {
+	return float64(c.size) / float64(c.capacity)
+}
+
+func (c *legacyLRUCache) addToHead(n *legacyNode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n.prev = c.head
+	n.next = c.head.next
+	c.head.next.prev = n
+	c.head.next = n
+}
+
+func (c *legacyLRUCache) removeNode(n *legacyNode) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n.prev.next = n.next
+	n.next.prev = n.prev
+}
+
+func (c *legacyLRUCache) moveToHead(n *legacyNode) {
+	c.removeNode(n)
+	c.addToHead(n)
+}
+
+func (c *legacyLRUCache) removeTail() *legacyNode {
+	n := c.tail.prev
+	c.removeNode(n)
+	return n
+}
+
+func benchKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	return keys
+}
+
+func BenchmarkLegacyLRUCache(b *testing.B) {
+	c := newLegacyLRUCache(1000)
+	keys := benchKeys(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := keys[i%len(keys)]
+		if _, ok := c.Get(k); !ok {
+			c.Put(k, i, time.Minute)
+		}
+	}
+}
+
+func BenchmarkLRUCache(b *testing.B) {
+	c := NewLRUCache(1000)
+	keys := benchKeys(2000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		k := keys[i%len(keys)]
+		if _, ok := c.Get(k); !ok {
+			c.Put(k, i, time.Minute)
+		}
+	}
+}
+
+func BenchmarkLRUCacheParallel(b *testing.B) {
+	c := NewLRU(LRUOptions[string, int]{Capacity: 1000, Shards: 16})
+	keys := benchKeys(2000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if _, ok := c.Get(k); !ok {
+				c.Put(k, i, time.Minute)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkLRUCacheSingleShardParallel(b *testing.B) {
+	c := NewLRU(LRUOptions[string, int]{Capacity: 1000, Shards: 1})
+	keys := benchKeys(2000)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			k := keys[i%len(keys)]
+			if _, ok := c.Get(k); !ok {
+				c.Put(k, i, time.Minute)
+			}
+			i++
+		}
+	})
+}
@@ -1,6 +1,10 @@
 package cache_test
 
 import (
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -66,3 +70,187 @@ func TestNewLRUCache2(t *testing.T) {
 		t.Errorf("wanted deleted key got val %v", v)
 	}
 }
+
+func TestLRUCachePutRefreshesTTL(t *testing.T) {
+	c := cache.NewLRUCache(2)
+	c.Put(1, 1, time.Millisecond*5)
+	c.Put(1, 2, 0)
+	time.Sleep(time.Millisecond * 10)
+	v, ok := c.Get(1)
+	if !ok || v != 2 {
+		t.Errorf("wanted 2 got %v %v", v, ok)
+	}
+}
+
+func TestLRUCacheEvictionAndStats(t *testing.T) {
+	var lock sync.Mutex
+	reasons := make(map[int]cache.EvictReason)
+	c := cache.NewLRU(cache.LRUOptions[int, int]{
+		Capacity:      2,
+		SweepInterval: time.Millisecond,
+		OnEvict: func(key, val int, reason cache.EvictReason) {
+			lock.Lock()
+			defer lock.Unlock()
+			reasons[key] = reason
+		},
+	})
+	defer c.Close()
+	c.Put(1, 1, 0)
+	c.Put(2, 2, time.Millisecond*2)
+	c.Get(1)
+	c.Get(3)
+	time.Sleep(time.Millisecond * 20)
+	c.Put(3, 3, 0)
+	c.Put(4, 4, 0)
+
+	lock.Lock()
+	if r, ok := reasons[2]; !ok || r != cache.EvictExpired {
+		t.Errorf("wanted 2 expired got %v %v", r, ok)
+	}
+	if r, ok := reasons[1]; !ok || r != cache.EvictCapacity {
+		t.Errorf("wanted 1 evicted got %v %v", r, ok)
+	}
+	lock.Unlock()
+	stats := c.Stats()
+	want := cache.LRUStats{Hits: 1, Misses: 1, Evictions: 1, Expirations: 1, Len: 2}
+	if stats != want {
+		t.Errorf("wanted %+v got %+v", want, stats)
+	}
+}
+
+func TestLRUCacheConcurrent(t *testing.T) {
+	c := cache.NewLRUCache(2048)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 5000; i++ {
+				k := strconv.Itoa((g * i) % 4096)
+				if _, ok := c.Get(k); !ok {
+					c.Put(k, i, time.Millisecond)
+				}
+				if i%7 == 0 {
+					c.Delete(k)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if c.Len() > c.Cap() {
+		t.Errorf("wanted len <= %d got %d", c.Cap(), c.Len())
+	}
+}
+
+func TestLRUGetOrLoad(t *testing.T) {
+	c := cache.NewLRU(cache.LRUOptions[string, int]{Capacity: 10})
+	var loads int32
+	release := make(chan struct{})
+	load := func(key string) (int, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return len(key), nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrLoad("abc", time.Minute, load)
+			if err != nil || v != 3 {
+				t.Errorf("wanted 3 got %v %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("wanted 1 load got %d", n)
+	}
+	if v, ok := c.Get("abc"); !ok || v != 3 {
+		t.Errorf("wanted cached 3 got %v %v", v, ok)
+	}
+
+	errLoad := errors.New("load failed")
+	if _, err := c.GetOrLoad("x", time.Minute, func(string) (int, error) { return 0, errLoad }); err != errLoad {
+		t.Errorf("wanted load error got %v", err)
+	}
+	if _, ok := c.Get("x"); ok {
+		t.Error("wanted failed load to not be cached")
+	}
+}
+
+func TestLRUGetOrLoadDeleteWhileLoading(t *testing.T) {
+	c := cache.NewLRU(cache.LRUOptions[string, int]{Capacity: 10})
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan int)
+	go func() {
+		v, _ := c.GetOrLoad("k", time.Minute, func(string) (int, error) {
+			close(loading)
+			<-release
+			return 1, nil
+		})
+		done <- v
+	}()
+	<-loading
+	c.Delete("k")
+	close(release)
+	if v := <-done; v != 1 {
+		t.Errorf("wanted loaded value returned got %d", v)
+	}
+	if _, ok := c.Get("k"); ok {
+		t.Error("wanted load that raced a delete to not be cached")
+	}
+
+	loading = make(chan struct{})
+	release = make(chan struct{})
+	go func() {
+		v, _ := c.GetOrLoad("k", time.Minute, func(string) (int, error) {
+			close(loading)
+			<-release
+			return 1, nil
+		})
+		done <- v
+	}()
+	<-loading
+	c.Put("k", 2, time.Minute)
+	close(release)
+	<-done
+	if v, ok := c.Get("k"); !ok || v != 2 {
+		t.Errorf("wanted put during load to win got %v %v", v, ok)
+	}
+}
+
+func TestLRUGetOrLoadPanic(t *testing.T) {
+	c := cache.NewLRU(cache.LRUOptions[string, int]{Capacity: 10})
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	panicked := make(chan interface{}, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.GetOrLoad("k", time.Minute, func(string) (int, error) {
+			close(loading)
+			<-release
+			panic("boom")
+		})
+	}()
+	<-loading
+	waited := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad("k", time.Minute, func(string) (int, error) { return 2, nil })
+		waited <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	close(release)
+	if err := <-waited; !errors.Is(err, cache.ErrLoadPanic) {
+		t.Errorf("wanted ErrLoadPanic got %v", err)
+	}
+	if p := <-panicked; p != "boom" {
+		t.Errorf("wanted the original panic value got %v", p)
+	}
+	if v, err := c.GetOrLoad("k", time.Minute, func(string) (int, error) { return 3, nil }); err != nil || v != 3 {
+		t.Errorf("wanted a new load after the panic got %v %v", v, err)
+	}
+}
@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 )
 
@@ -21,10 +22,19 @@ type (
 	// RateLimitError info
 	RateLimitError struct {
 		Rate Rate
+		// RetryAfter is how long until the next request would be allowed
+		RetryAfter time.Duration
 	}
 
+	// MemoryRateLimit is a fixed window counter that starts on the first hit of a key
 	MemoryRateLimit struct {
-		cache *LRUCache
+		cache *LRU[string, *fixedWindow]
+		lock  sync.Mutex
+	}
+
+	fixedWindow struct {
+		hits  int
+		reset time.Time
 	}
 )
 
@@ -32,23 +42,37 @@ func (rle RateLimitError) Error() string {
 	return fmt.Sprintf("Rate limit exceeded: %d requests in %s", rle.Rate.Rate, rle.Rate.Duration.String())
 }
 
+// RetryAfterSeconds rounds up RetryAfter for use in a Retry-After header
+func (rle RateLimitError) RetryAfterSeconds() int {
+	secs := int(rle.RetryAfter / time.Second)
+	if rle.RetryAfter%time.Second > 0 {
+		secs++
+	}
+	if secs < 1 {
+		secs = 1
+	}
+	return secs
+}
+
 func NewMemoryRateLimit() *MemoryRateLimit {
 	return &MemoryRateLimit{
-		cache: NewLRUCache(1000),
+		cache: NewLRU(LRUOptions[string, *fixedWindow]{Capacity: 1000}),
 	}
 }
 
 func (mrl *MemoryRateLimit) RateLimit(ctx context.Context, key string, rate int, t time.Duration) error {
 	key = "rate:" + key
-	var hits int
-	cache, ok := mrl.cache.Get(key)
-	if ok {
-		hits, _ = cache.(int)
+	now := time.Now()
+	mrl.lock.Lock()
+	defer mrl.lock.Unlock()
+	w, ok := mrl.cache.Get(key)
+	if !ok || !w.reset.After(now) {
+		w = &fixedWindow{reset: now.Add(t)}
+		mrl.cache.Put(key, w, t)
 	}
-	hits++
-	if hits > rate {
-		return RateLimitError{Rate: Rate{Rate: rate, Duration: t}}
+	if w.hits >= rate {
+		return RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: w.reset.Sub(now)}
 	}
-	mrl.cache.Put(key, hits, t)
+	w.hits++
 	return nil
 }
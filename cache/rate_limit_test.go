@@ -0,0 +1,119 @@
+package cache_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/altlimit/gauth/cache"
+)
+
+func TestRateLimiters(t *testing.T) {
+	ctx := context.Background()
+	window := time.Millisecond * 100
+	limiters := map[string]cache.RateLimiter{
+		"memory":  cache.NewMemoryRateLimit(),
+		"log":     cache.NewSlidingWindowLog(100),
+		"counter": cache.NewSlidingWindowCounter(100),
+		"bucket":  cache.NewTokenBucket(100),
+	}
+	for name, rl := range limiters {
+		for i := 0; i < 3; i++ {
+			if err := rl.RateLimit(ctx, "a", 3, window); err != nil {
+				t.Fatalf("%s wanted nil got %v", name, err)
+			}
+		}
+		err := rl.RateLimit(ctx, "a", 3, window)
+		rle, ok := err.(cache.RateLimitError)
+		if !ok {
+			t.Fatalf("%s wanted RateLimitError got %v", name, err)
+		}
+		if rle.RetryAfter <= 0 || rle.RetryAfter > window*2 {
+			t.Errorf("%s wanted retry after within window got %v", name, rle.RetryAfter)
+		}
+		if rle.RetryAfterSeconds() != 1 {
+			t.Errorf("%s wanted 1 second got %d", name, rle.RetryAfterSeconds())
+		}
+		if err := rl.RateLimit(ctx, "b", 3, window); err != nil {
+			t.Errorf("%s wanted other key allowed got %v", name, err)
+		}
+		time.Sleep(rle.RetryAfter + time.Millisecond*5)
+		if err := rl.RateLimit(ctx, "a", 3, window); err != nil {
+			t.Errorf("%s wanted allowed after retry got %v", name, err)
+		}
+		if err := rl.RateLimit(ctx, "zero", 0, window); err == nil {
+			t.Errorf("%s wanted zero rate to be limited", name)
+		}
+	}
+}
+
+func TestSlidingWindowLogSlides(t *testing.T) {
+	ctx := context.Background()
+	rl := cache.NewSlidingWindowLog(10)
+	window := time.Millisecond * 100
+	rl.RateLimit(ctx, "a", 2, window)
+	time.Sleep(window / 2)
+	rl.RateLimit(ctx, "a", 2, window)
+	time.Sleep(window/2 + time.Millisecond*5)
+	// the first hit is out of the window but the second is not
+	if err := rl.RateLimit(ctx, "a", 2, window); err != nil {
+		t.Fatalf("wanted nil got %v", err)
+	}
+	if err := rl.RateLimit(ctx, "a", 2, window); err == nil {
+		t.Fatalf("wanted rate limited got nil")
+	}
+}
+
+func TestRateLimitersConcurrent(t *testing.T) {
+	ctx := context.Background()
+	for _, rl := range []cache.RateLimiter{cache.NewMemoryRateLimit(), cache.NewSlidingWindowLog(10), cache.NewSlidingWindowCounter(10), cache.NewTokenBucket(10)} {
+		var (
+			wg      sync.WaitGroup
+			lock    sync.Mutex
+			allowed int
+		)
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if rl.RateLimit(ctx, "a", 10, time.Minute) == nil {
+					lock.Lock()
+					allowed++
+					lock.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if allowed != 10 {
+			t.Errorf("%T wanted 10 allowed got %d", rl, allowed)
+		}
+	}
+}
+
+func TestRateLimitersFull(t *testing.T) {
+	ctx := context.Background()
+	limiters := map[string]cache.RateLimiter{
+		"log":     cache.NewSlidingWindowLog(10),
+		"counter": cache.NewSlidingWindowCounter(10),
+		"bucket":  cache.NewTokenBucket(10),
+	}
+	for name, rl := range limiters {
+		rl.RateLimit(ctx, "target", 1, time.Minute)
+		// new keys evict the oldest activity, the limited key stays while it's hit
+		for i := 0; i < 50; i++ {
+			rl.RateLimit(ctx, strconv.Itoa(i), 1, time.Minute)
+			if err := rl.RateLimit(ctx, "target", 1, time.Minute); err == nil {
+				t.Fatalf("%s wanted target limited after %d new keys", name, i)
+			}
+		}
+		// an idle key is the first to go
+		for i := 50; i < 60; i++ {
+			rl.RateLimit(ctx, strconv.Itoa(i), 1, time.Minute)
+		}
+		if err := rl.RateLimit(ctx, "target", 1, time.Minute); err != nil {
+			t.Errorf("%s wanted target evicted got %v", name, err)
+		}
+	}
+}
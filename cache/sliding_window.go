@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+type (
+	// SlidingWindowLog keeps the timestamp of every hit within the window, it's exact
+	// but uses memory proportional to the rate.
+	SlidingWindowLog struct {
+		store *limiterStore
+	}
+
+	// SlidingWindowCounter approximates a sliding window by weighting the previous
+	// fixed window count, it only keeps two counters per key.
+	SlidingWindowCounter struct {
+		store *limiterStore
+	}
+
+	windowLog struct {
+		hits []time.Time
+	}
+
+	windowCounter struct {
+		start time.Time
+		prev  int
+		curr  int
+	}
+
+	// limiterStore holds limiter state per key and sweeps idle keys every sweepEvery calls, when
+	// it's full the key with the oldest activity is evicted so keys being limited are kept.
+	limiterStore struct {
+		lock     sync.Mutex
+		items    map[string]*list.Element
+		order    *list.List
+		calls    int
+		capacity int
+	}
+
+	limiterItem struct {
+		key    string
+		state  interface{}
+		expire time.Time
+	}
+)
+
+const sweepEvery = 1000
+
+func newLimiterStore(capacity int) *limiterStore {
+	return &limiterStore{
+		items:    make(map[string]*list.Element),
+		order:    list.New(),
+		capacity: capacity,
+	}
+}
+
+// update calls fn with the state of key under lock, fn returns until when the state must be kept
+func (ls *limiterStore) update(key string, now time.Time, fn func(state interface{}) (interface{}, time.Time, error)) error {
+	ls.lock.Lock()
+	defer ls.lock.Unlock()
+	ls.calls++
+	if ls.calls%sweepEvery == 0 {
+		ls.sweep(now)
+	}
+	var state interface{}
+	el, ok := ls.items[key]
+	if ok && el.Value.(*limiterItem).expire.After(now) {
+		state = el.Value.(*limiterItem).state
+	}
+	state, expire, err := fn(state)
+	if state == nil {
+		return err
+	}
+	if ok {
+		item := el.Value.(*limiterItem)
+		item.state, item.expire = state, expire
+		ls.order.MoveToFront(el)
+		return err
+	}
+	for ls.order.Len() >= ls.capacity && ls.order.Len() > 0 {
+		oldest := ls.order.Back()
+		ls.order.Remove(oldest)
+		delete(ls.items, oldest.Value.(*limiterItem).key)
+	}
+	ls.items[key] = ls.order.PushFront(&limiterItem{key: key, state: state, expire: expire})
+	return err
+}
+
+func (ls *limiterStore) sweep(now time.Time) {
+	for el := ls.order.Back(); el != nil; {
+		prev := el.Prev()
+		if item := el.Value.(*limiterItem); !item.expire.After(now) {
+			ls.order.Remove(el)
+			delete(ls.items, item.key)
+		}
+		el = prev
+	}
+}
+
+// NewSlidingWindowLog keeps up to capacity keys, idle keys are removed once their window passed
+// or the key with the oldest activity once capacity is reached
+func NewSlidingWindowLog(capacity int) *SlidingWindowLog {
+	return &SlidingWindowLog{store: newLimiterStore(capacity)}
+}
+
+func (swl *SlidingWindowLog) RateLimit(ctx context.Context, key string, rate int, t time.Duration) error {
+	if rate < 1 {
+		return RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: t}
+	}
+	now := time.Now()
+	return swl.store.update(key, now, func(state interface{}) (interface{}, time.Time, error) {
+		wl, _ := state.(*windowLog)
+		if wl == nil {
+			wl = &windowLog{}
+		}
+		since := now.Add(-t)
+		i := 0
+		for i < len(wl.hits) && !wl.hits[i].After(since) {
+			i++
+		}
+		wl.hits = wl.hits[i:]
+		if len(wl.hits) >= rate {
+			retry := wl.hits[len(wl.hits)-rate].Add(t).Sub(now)
+			return wl, wl.hits[len(wl.hits)-1].Add(t), RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: retry}
+		}
+		wl.hits = append(wl.hits, now)
+		return wl, now.Add(t), nil
+	})
+}
+
+// NewSlidingWindowCounter keeps up to capacity keys, idle keys are removed after two windows
+// or the key with the oldest activity once capacity is reached
+func NewSlidingWindowCounter(capacity int) *SlidingWindowCounter {
+	return &SlidingWindowCounter{store: newLimiterStore(capacity)}
+}
+
+func (swc *SlidingWindowCounter) RateLimit(ctx context.Context, key string, rate int, t time.Duration) error {
+	if rate < 1 {
+		return RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: t}
+	}
+	now := time.Now()
+	return swc.store.update(key, now, func(state interface{}) (interface{}, time.Time, error) {
+		wc, _ := state.(*windowCounter)
+		if wc == nil {
+			wc = &windowCounter{start: now.Truncate(t)}
+		}
+		// move the windows forward
+		if elapsed := now.Sub(wc.start); elapsed >= t {
+			windows := int(elapsed / t)
+			if windows == 1 {
+				wc.prev = wc.curr
+			} else {
+				wc.prev = 0
+			}
+			wc.curr = 0
+			wc.start = wc.start.Add(time.Duration(windows) * t)
+		}
+		elapsed := now.Sub(wc.start)
+		weight := 1 - float64(elapsed)/float64(t)
+		expire := wc.start.Add(t * 2)
+		if float64(wc.prev)*weight+float64(wc.curr)+1 > float64(rate) {
+			return wc, expire, RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: wc.retryAfter(rate, t, elapsed)}
+		}
+		wc.curr++
+		return wc, expire, nil
+	})
+}
+
+// retryAfter is the time until the weighted count allows one more hit
+func (wc *windowCounter) retryAfter(rate int, t, elapsed time.Duration) time.Duration {
+	if wc.curr+1 <= rate && wc.prev > 0 {
+		// wait for the previous window to slide out enough in this window
+		need := 1 - float64(rate-1-wc.curr)/float64(wc.prev)
+		return time.Duration(need*float64(t)) - elapsed
+	}
+	// wait for the next window where the current count becomes the previous
+	retry := t - elapsed
+	if wc.curr > 0 && rate > 1 {
+		need := 1 - float64(rate-1)/float64(wc.curr)
+		if need > 0 {
+			retry += time.Duration(need * float64(t))
+		}
+	} else if rate <= 1 {
+		retry += t
+	}
+	return retry
+}
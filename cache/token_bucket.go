@@ -0,0 +1,49 @@
+package cache
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+type (
+	// TokenBucket allows bursts up to rate then refills rate tokens evenly over the duration
+	TokenBucket struct {
+		store *limiterStore
+	}
+
+	bucket struct {
+		tokens float64
+		last   time.Time
+	}
+)
+
+// NewTokenBucket keeps up to capacity keys, idle keys are removed once their bucket is full
+// or the key with the oldest activity once capacity is reached
+func NewTokenBucket(capacity int) *TokenBucket {
+	return &TokenBucket{store: newLimiterStore(capacity)}
+}
+
+func (tb *TokenBucket) RateLimit(ctx context.Context, key string, rate int, t time.Duration) error {
+	if rate < 1 {
+		return RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: t}
+	}
+	now := time.Now()
+	perToken := t / time.Duration(rate)
+	return tb.store.update(key, now, func(state interface{}) (interface{}, time.Time, error) {
+		b, _ := state.(*bucket)
+		if b == nil {
+			b = &bucket{tokens: float64(rate), last: now}
+		}
+		b.tokens = math.Min(float64(rate), b.tokens+float64(now.Sub(b.last))/float64(perToken))
+		b.last = now
+		if b.tokens < 1 {
+			retry := time.Duration((1 - b.tokens) * float64(perToken))
+			return b, now.Add(t), RateLimitError{Rate: Rate{Rate: rate, Duration: t}, RetryAfter: retry}
+		}
+		b.tokens--
+		// bucket is full again after this so it can be forgotten
+		full := now.Add(time.Duration((float64(rate) - b.tokens) * float64(perToken)))
+		return b, full, nil
+	})
+}
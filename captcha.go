@@ -0,0 +1,103 @@
+package gauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/altlimit/gauth/cache"
+	"github.com/altlimit/gauth/captcha"
+)
+
+type (
+	// AdaptiveCaptcha requires Captcha on password logins only after suspicious activity,
+	// it's not used when FlowLogin is in CaptchaFlows.
+	AdaptiveCaptcha struct {
+		// Identity requires it after Rate failed logins of an identity within Duration
+		Identity cache.Rate
+		// IP requires it after Rate failed logins from an IP within Duration
+		IP cache.Rate
+		// NewDevice requires it when the browser has no device cookie of the identity
+		NewDevice bool
+	}
+)
+
+// captchaFlow returns true if Captcha is required on flow
+func (ga *GAuth) captchaFlow(flow string) bool {
+	if ga.Captcha == nil {
+		return false
+	}
+	for _, f := range ga.CaptchaFlows {
+		if f == flow {
+			return true
+		}
+	}
+	return false
+}
+
+// captchaWidget returns the widget for a form that submits any of flows
+func (ga *GAuth) captchaWidget(flows ...string) *captcha.Widget {
+	for _, flow := range flows {
+		if ga.captchaFlow(flow) {
+			return ga.Captcha.Widget()
+		}
+	}
+	return nil
+}
+
+// validCaptcha verifies the captcha response of flow and returns false after writing a validation error
+func (ga *GAuth) validCaptcha(w http.ResponseWriter, r *http.Request, flow string, response string) bool {
+	if !ga.captchaFlow(flow) {
+		return true
+	}
+	return ga.verifyCaptcha(w, r, response)
+}
+
+func (ga *GAuth) verifyCaptcha(w http.ResponseWriter, r *http.Request, response string) bool {
+	if response == "" {
+		ga.validationError(w, FieldCaptchaID, "required")
+		return false
+	}
+	if err := ga.Captcha.Verify(r.Context(), response, ga.clientIP(r)); err != nil {
+		if !errors.Is(err, captcha.ErrFailed) {
+			ga.log("captcha", err)
+		}
+		ga.validationError(w, FieldCaptchaID, "verification failed")
+		return false
+	}
+	return true
+}
+
+// adaptiveCaptcha returns true if password logins require Captcha only when risky
+func (ga *GAuth) adaptiveCaptcha() bool {
+	ac := ga.AdaptiveCaptcha
+	return ga.Captcha != nil && ga.PasswordFieldID != "" && !ga.captchaFlow(FlowLogin) &&
+		(ac.Identity.Rate > 0 || ac.IP.Rate > 0 || ac.NewDevice)
+}
+
+// loginRisk counts a login attempt of identity and returns true once it's over the rate of
+// AdaptiveCaptcha. It's called for correct passwords too so a risky login gets the same
+// response whether the password was right or not.
+func (ga *GAuth) loginRisk(ctx context.Context, r *http.Request, identity string) (bool, error) {
+	ac := ga.AdaptiveCaptcha
+	risky := false
+	for _, rule := range []struct {
+		key  string
+		rate cache.Rate
+	}{
+		{"captcha:" + strings.ToLower(identity), ac.Identity},
+		{"captcha:ip:" + ga.ipSubnet(ga.clientIP(r)), ac.IP},
+	} {
+		if rule.rate.Rate <= 0 {
+			continue
+		}
+		err := ga.rateLimiter.RateLimit(ctx, ga.tenantKey(rule.key), rule.rate.Rate, rule.rate.Duration)
+		if _, ok := err.(cache.RateLimitError); ok {
+			risky = true
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return risky, nil
+}
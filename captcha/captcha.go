@@ -0,0 +1,43 @@
+// Package captcha verifies that forms are submitted by people with hosted challenges like
+// reCAPTCHA, hCaptcha and Cloudflare Turnstile or a self-hosted proof-of-work.
+package captcha
+
+import (
+	"context"
+	"errors"
+)
+
+const (
+	ProviderRecaptcha   = "recaptcha"
+	ProviderRecaptchaV3 = "recaptchav3"
+	ProviderHCaptcha    = "hcaptcha"
+	ProviderTurnstile   = "turnstile"
+	ProviderPoW         = "pow"
+)
+
+// ErrFailed is returned by Verify when the response is missing, invalid or already used
+var ErrFailed = errors.New("captcha verification failed")
+
+type (
+	// Captcha renders a challenge in forms and verifies the response the client submits with them
+	Captcha interface {
+		// Widget is called for every form render
+		Widget() *Widget
+		// Verify returns ErrFailed when the response doesn't pass, other errors are for failed requests
+		Verify(ctx context.Context, response string, remoteIP string) error
+	}
+
+	// Widget is what the client needs to render the challenge
+	Widget struct {
+		Provider  string
+		SiteKey   string
+		ScriptURL string
+		// Action is passed to reCAPTCHA v3 and Turnstile
+		Action string
+		// Challenge is the proof-of-work to solve
+		Challenge string
+		// Origins are where the widget loads frames, styles and requests from, pages allow them
+		// in their Content-Security-Policy
+		Origins []string
+	}
+)
@@ -0,0 +1,160 @@
+package captcha_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/altlimit/gauth/captcha"
+)
+
+func TestSiteVerify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("secret") != "secret" || r.PostForm.Get("remoteip") != "1.2.3.4" {
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-secret"]}`))
+			return
+		}
+		switch r.PostForm.Get("response") {
+		case "ok":
+			w.Write([]byte(`{"success": true, "hostname": "example.com"}`))
+		case "human":
+			w.Write([]byte(`{"success": true, "score": 0.9, "action": "submit"}`))
+		case "bot":
+			w.Write([]byte(`{"success": true, "score": 0.1, "action": "submit"}`))
+		case "other":
+			w.Write([]byte(`{"success": true, "score": 0.9, "action": "other"}`))
+		case "down":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`{"success": false}`))
+		}
+	}))
+	defer srv.Close()
+
+	v2 := captcha.NewRecaptcha("key", "secret")
+	v3 := captcha.NewRecaptchaV3("key", "secret", 0.5)
+	hc := captcha.NewHCaptcha("key", "secret")
+	hc.Hostname = "example.com"
+	ts := captcha.NewTurnstile("key", "wrong")
+	for _, sv := range []*captcha.SiteVerify{v2, v3, hc, ts} {
+		sv.VerifyURL = srv.URL
+	}
+	table := []struct {
+		c        *captcha.SiteVerify
+		response string
+		err      error
+	}{
+		{v2, "ok", nil},
+		{v2, "invalid", captcha.ErrFailed},
+		{v2, "", captcha.ErrFailed},
+		{v3, "human", nil},
+		{v3, "bot", captcha.ErrFailed},
+		{v3, "other", captcha.ErrFailed},
+		{v3, "ok", captcha.ErrFailed},
+		{hc, "ok", nil},
+		{hc, "human", captcha.ErrFailed},
+		{ts, "ok", captcha.ErrFailed},
+	}
+	for _, v := range table {
+		err := v.c.Verify(context.Background(), v.response, "1.2.3.4")
+		if !errors.Is(err, v.err) || (v.err == nil) != (err == nil) {
+			t.Errorf("%s %s wanted %v got %v", v.c.Provider, v.response, v.err, err)
+		}
+	}
+	if err := v2.Verify(context.Background(), "down", "1.2.3.4"); err == nil || errors.Is(err, captcha.ErrFailed) {
+		t.Errorf("wanted request error got %v", err)
+	}
+	if w := v3.Widget(); w.Provider != "recaptchav3" || w.SiteKey != "key" || !strings.Contains(w.ScriptURL, "render=key") {
+		t.Errorf("unexpected widget %+v", w)
+	}
+}
+
+func solve(challenge string, difficulty int) string {
+	for i := 0; ; i++ {
+		resp := challenge + ":" + strconv.Itoa(i)
+		if captcha.LeadingZeroBits(sha256.Sum256([]byte(resp))) >= difficulty {
+			return resp
+		}
+	}
+}
+
+func TestProofOfWork(t *testing.T) {
+	p := captcha.NewProofOfWork([]byte("secret"))
+	p.Difficulty = 8
+	ctx := context.Background()
+
+	w := p.Widget()
+	if w.Provider != "pow" || w.Challenge == "" || w.Challenge == p.Widget().Challenge {
+		t.Fatalf("wanted unique challenges got %+v", w)
+	}
+	resp := solve(w.Challenge, 8)
+	if err := p.Verify(ctx, resp, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(ctx, resp, ""); !errors.Is(err, captcha.ErrFailed) {
+		t.Errorf("wanted replay to fail got %v", err)
+	}
+	// another solution of the same challenge is new work
+	challenge, counter, _ := strings.Cut(resp, ":")
+	n, _ := strconv.Atoi(counter)
+	next := ""
+	for i := n + 1; next == ""; i++ {
+		r := challenge + ":" + strconv.Itoa(i)
+		if captcha.LeadingZeroBits(sha256.Sum256([]byte(r))) >= 8 {
+			next = r
+		}
+	}
+	if err := p.Verify(ctx, next, ""); err != nil {
+		t.Errorf("wanted next solution got %v", err)
+	}
+
+	other := captcha.NewProofOfWork([]byte("other"))
+	other.Difficulty = 8
+	p.Expiration = -time.Minute
+	expired := solve(p.Challenge(), 8)
+	p.Expiration = time.Hour
+	harder := captcha.NewProofOfWork([]byte("secret"))
+	harder.Difficulty = 12
+	for _, v := range []string{
+		solve(other.Challenge(), 8),
+		expired,
+		challenge + ":",
+		"garbage:1",
+		strings.Replace(solve(p.Challenge(), 8), ".8.", ".4.", 1),
+	} {
+		if err := p.Verify(ctx, v, ""); !errors.Is(err, captcha.ErrFailed) {
+			t.Errorf("%s wanted failed got %v", v, err)
+		}
+	}
+	// challenges of a lower difficulty are rejected after raising it
+	if err := harder.Verify(ctx, solve(p.Challenge(), 8), ""); !errors.Is(err, captcha.ErrFailed) {
+		t.Errorf("wanted low difficulty to fail got %v", err)
+	}
+}
+
+func TestProofOfWorkLiteral(t *testing.T) {
+	p := &captcha.ProofOfWork{Secret: []byte("secret")}
+	ctx := context.Background()
+	challenge := p.Challenge()
+	if strings.Split(challenge, ".")[1] != "16" {
+		t.Fatalf("wanted default difficulty got %s", challenge)
+	}
+	resp := solve(challenge, 16)
+	if err := p.Verify(ctx, resp, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Verify(ctx, resp, ""); !errors.Is(err, captcha.ErrFailed) {
+		t.Errorf("wanted replay to fail got %v", err)
+	}
+	easy := &captcha.ProofOfWork{Secret: []byte("secret"), Difficulty: 4}
+	if err := p.Verify(ctx, solve(easy.Challenge(), 4), ""); !errors.Is(err, captcha.ErrFailed) {
+		t.Errorf("wanted easier challenge to fail got %v", err)
+	}
+}
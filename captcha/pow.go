@@ -0,0 +1,129 @@
+package captcha
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/altlimit/gauth/cache"
+)
+
+type (
+	// ProofOfWork is a self-hosted captcha that makes the browser find a counter so the
+	// sha256 of "{challenge}:{counter}" starts with Difficulty zero bits. It needs no third
+	// party but only slows down bots, each extra bit doubles the work.
+	//
+	// Challenges are signed so they need no storage, used responses are remembered in memory
+	// until the challenge expires so run it with a shared Secret on a single instance or
+	// accept that a response can be replayed once per instance.
+	ProofOfWork struct {
+		Secret []byte
+		// Difficulty defaults to 16 bits, under a second in most browsers
+		Difficulty int
+		// Expiration of challenges defaults to 1 hour
+		Expiration time.Duration
+
+		init sync.Once
+		used *cache.LRU[string, bool]
+	}
+)
+
+// NewProofOfWork returns a proof-of-work captcha, a random secret is used when it's empty
+func NewProofOfWork(secret []byte) *ProofOfWork {
+	p := &ProofOfWork{Secret: secret}
+	p.setup()
+	return p
+}
+
+// setup applies the defaults once so a ProofOfWork can also be created as a struct literal
+func (p *ProofOfWork) setup() {
+	p.init.Do(func() {
+		if len(p.Secret) == 0 {
+			p.Secret = make([]byte, 32)
+			if _, err := rand.Read(p.Secret); err != nil {
+				panic(err)
+			}
+		}
+		if p.Difficulty <= 0 {
+			p.Difficulty = 16
+		}
+		if p.Expiration <= 0 {
+			p.Expiration = time.Hour
+		}
+		p.used = cache.NewLRU(cache.LRUOptions[string, bool]{Capacity: 100000})
+	})
+}
+
+func (p *ProofOfWork) Widget() *Widget {
+	return &Widget{Provider: ProviderPoW, Challenge: p.Challenge()}
+}
+
+// Challenge returns a new signed "{expires}.{difficulty}.{nonce}.{signature}"
+func (p *ProofOfWork) Challenge() string {
+	p.setup()
+	nonce := make([]byte, 12)
+	rand.Read(nonce)
+	c := strconv.FormatInt(time.Now().Add(p.Expiration).Unix(), 10) + "." +
+		strconv.Itoa(p.Difficulty) + "." + base64.RawURLEncoding.EncodeToString(nonce)
+	return c + "." + p.sign(c)
+}
+
+func (p *ProofOfWork) sign(c string) string {
+	mac := hmac.New(sha256.New, p.Secret)
+	mac.Write([]byte(c))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a "{challenge}:{counter}" response
+func (p *ProofOfWork) Verify(ctx context.Context, response string, remoteIP string) error {
+	p.setup()
+	challenge, counter, ok := strings.Cut(response, ":")
+	if !ok || counter == "" || len(counter) > 20 {
+		return ErrFailed
+	}
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 || !hmac.Equal([]byte(parts[3]), []byte(p.sign(strings.Join(parts[:3], ".")))) {
+		return ErrFailed
+	}
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrFailed
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil || difficulty < p.Difficulty {
+		return ErrFailed
+	}
+	if LeadingZeroBits(sha256.Sum256([]byte(response))) < difficulty {
+		return ErrFailed
+	}
+	// the loader only runs for the first caller of a response
+	first := false
+	p.used.GetOrLoad(response, time.Until(time.Unix(expires, 0)), func(string) (bool, error) {
+		first = true
+		return true, nil
+	})
+	if !first {
+		return fmt.Errorf("%w: response already used", ErrFailed)
+	}
+	return nil
+}
+
+// LeadingZeroBits counts the zero bits at the start of a sha256 sum
+func LeadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
@@ -0,0 +1,144 @@
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type (
+	// SiteVerify verifies responses with the siteverify API that reCAPTCHA, hCaptcha and Turnstile share
+	SiteVerify struct {
+		Provider  string
+		SiteKey   string
+		Secret    string
+		VerifyURL string
+		ScriptURL string
+		// Origins of the widget for the Content-Security-Policy of pages
+		Origins []string
+		// MinScore rejects reCAPTCHA v3 responses with a lower score
+		MinScore float64
+		// Action must match the action of the response when set
+		Action string
+		// Hostname must match the hostname of the response when set
+		Hostname string
+		// Client defaults to http.DefaultClient
+		Client *http.Client
+	}
+
+	siteVerifyResponse struct {
+		Success    bool     `json:"success"`
+		Score      *float64 `json:"score"`
+		Action     string   `json:"action"`
+		Hostname   string   `json:"hostname"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+)
+
+// NewRecaptcha returns the reCAPTCHA v2 checkbox
+func NewRecaptcha(siteKey, secret string) *SiteVerify {
+	return &SiteVerify{
+		Provider:  ProviderRecaptcha,
+		SiteKey:   siteKey,
+		Secret:    secret,
+		VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		ScriptURL: "https://www.google.com/recaptcha/api.js?onload=captchaCallback&render=explicit",
+		Origins:   []string{"https://www.google.com", "https://www.gstatic.com", "https://recaptcha.google.com"},
+	}
+}
+
+// NewRecaptchaV3 returns the invisible reCAPTCHA v3 that rejects scores lower than minScore
+func NewRecaptchaV3(siteKey, secret string, minScore float64) *SiteVerify {
+	return &SiteVerify{
+		Provider:  ProviderRecaptchaV3,
+		SiteKey:   siteKey,
+		Secret:    secret,
+		VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+		ScriptURL: "https://www.google.com/recaptcha/api.js?render=" + url.QueryEscape(siteKey),
+		Origins:   []string{"https://www.google.com", "https://www.gstatic.com", "https://recaptcha.google.com"},
+		MinScore:  minScore,
+		Action:    "submit",
+	}
+}
+
+// NewHCaptcha returns the hCaptcha checkbox
+func NewHCaptcha(siteKey, secret string) *SiteVerify {
+	return &SiteVerify{
+		Provider:  ProviderHCaptcha,
+		SiteKey:   siteKey,
+		Secret:    secret,
+		VerifyURL: "https://api.hcaptcha.com/siteverify",
+		ScriptURL: "https://js.hcaptcha.com/1/api.js?onload=captchaCallback&render=explicit",
+		Origins:   []string{"https://hcaptcha.com", "https://*.hcaptcha.com"},
+	}
+}
+
+// NewTurnstile returns the Cloudflare Turnstile widget
+func NewTurnstile(siteKey, secret string) *SiteVerify {
+	return &SiteVerify{
+		Provider:  ProviderTurnstile,
+		SiteKey:   siteKey,
+		Secret:    secret,
+		VerifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+		ScriptURL: "https://challenges.cloudflare.com/turnstile/v0/api.js?onload=captchaCallback&render=explicit",
+		Origins:   []string{"https://challenges.cloudflare.com"},
+	}
+}
+
+func (sv *SiteVerify) Widget() *Widget {
+	return &Widget{
+		Provider:  sv.Provider,
+		SiteKey:   sv.SiteKey,
+		ScriptURL: sv.ScriptURL,
+		Action:    sv.Action,
+		Origins:   sv.Origins,
+	}
+}
+
+func (sv *SiteVerify) Verify(ctx context.Context, response string, remoteIP string) error {
+	if response == "" {
+		return ErrFailed
+	}
+	form := url.Values{
+		"secret":   {sv.Secret},
+		"response": {response},
+	}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	if sv.Provider == ProviderHCaptcha {
+		form.Set("sitekey", sv.SiteKey)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sv.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("SiteVerify: NewRequest error %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	hc := sv.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return fmt.Errorf("SiteVerify: %s error %v", sv.Provider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("SiteVerify: %s status %d", sv.Provider, resp.StatusCode)
+	}
+	var v siteVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return fmt.Errorf("SiteVerify: %s decode error %v", sv.Provider, err)
+	}
+	switch {
+	case !v.Success,
+		sv.MinScore > 0 && (v.Score == nil || *v.Score < sv.MinScore),
+		sv.Action != "" && v.Action != sv.Action,
+		sv.Hostname != "" && v.Hostname != sv.Hostname:
+		return ErrFailed
+	}
+	return nil
+}
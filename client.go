@@ -0,0 +1,100 @@
+package gauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	GrantClientCredentials = "client_credentials"
+)
+
+type (
+	// Client is a machine to machine principal used with the client_credentials grant
+	Client struct {
+		ID string
+		// SecretHash is created with HashClientSecret, never store the plain secret
+		SecretHash string
+		// Scopes allowed for this client, requested scopes must be a subset
+		Scopes []string
+	}
+)
+
+var (
+	ErrClientNotFound = errors.New("client not found")
+)
+
+// HashClientSecret returns a bcrypt hash of secret for storing in Client.SecretHash
+func HashClientSecret(secret string) (string, error) {
+	return hashPassword(secret, bcrypt.DefaultCost)
+}
+
+// CreateClientAccessToken returns an access token for a client with a client_id claim and scopes as grants,
+// its subject is clientSubjectPrefix+clientID so it's never the UID of a user.
+func (ga *GAuth) CreateClientAccessToken(ctx context.Context, clientID string, scopes []string, expiry time.Time) (string, error) {
+	if scopes == nil {
+		scopes = []string{}
+	}
+	return ga.signAccessToken(clientSubjectPrefix+clientID, scopes, expiry, jwt.MapClaims{
+		"client_id": clientID,
+		"scope":     strings.Join(scopes, " "),
+	})
+}
+
+// clientCredentials implements https://www.rfc-editor.org/rfc/rfc6749#section-4.4 on the refresh endpoint,
+// it returns a 0 status when the rate limit already wrote the response.
+func (ga *GAuth) clientCredentials(w http.ResponseWriter, r *http.Request, grantType, clientID, secret, scope string) (int, interface{}) {
+	if grantType != GrantClientCredentials || ga.clientProvider == nil {
+		return http.StatusBadRequest, errorResponse{Error: "unsupported_grant_type"}
+	}
+	if clientID == "" || secret == "" {
+		return http.StatusUnauthorized, errorResponse{Error: "invalid_client"}
+	}
+	ctx := context.WithValue(r.Context(), RequestKey, r)
+	if !ga.rateLimitFlow(ctx, w, r, FlowClient, clientID) {
+		// the response is already written
+		return 0, nil
+	}
+	client, err := ga.clientProvider.ClientLoad(ctx, clientID)
+	if err != nil {
+		if err == ErrClientNotFound {
+			return http.StatusUnauthorized, errorResponse{Error: "invalid_client"}
+		}
+		return http.StatusInternalServerError, err
+	}
+	if !validPassword(client.SecretHash, secret) {
+		return http.StatusUnauthorized, errorResponse{Error: "invalid_client"}
+	}
+
+	allowed := make(map[string]bool)
+	for _, s := range client.Scopes {
+		allowed[s] = true
+	}
+	scopes := client.Scopes
+	if scope != "" {
+		scopes = strings.Fields(scope)
+		for _, s := range scopes {
+			if !allowed[s] {
+				return http.StatusBadRequest, errorResponse{Error: "invalid_scope"}
+			}
+		}
+	}
+
+	expire := ga.Timeout.AccessToken
+	tok, err := ga.CreateClientAccessToken(ctx, client.ID, scopes, time.Now().Add(expire))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, map[string]interface{}{
+		"access_token": tok,
+		"token_type":   "Bearer",
+		"expires_in":   expire.Seconds(),
+		"scope":        strings.Join(scopes, " "),
+	}
+}
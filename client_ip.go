@@ -0,0 +1,141 @@
+package gauth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type (
+	// IPExtractor returns the client ip of a request used for rate limits, the default
+	// refresh token cid, recaptcha and audit events.
+	IPExtractor func(r *http.Request) string
+)
+
+// IPFromRemoteAddr uses the connection address, use this when your app is not behind a proxy
+func IPFromRemoteAddr(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// IPFromHeader uses a single header your platform sets and strips from clients such as
+// X-Appengine-User-Ip or CF-Connecting-IP, falls back to the remote address if missing.
+func IPFromHeader(name string) IPExtractor {
+	return func(r *http.Request) string {
+		if ip := parseIP(r.Header.Get(name)); ip != nil {
+			return ip.String()
+		}
+		return IPFromRemoteAddr(r)
+	}
+}
+
+// IPFromTrustedProxies returns an extractor that only reads the forwarding header your proxies set when the
+// remote address is one of the trusted proxies. header is the RFC 7239 Forwarded header or a comma separated
+// list like X-Forwarded-For, no other header is ever read so clients can't pick one your proxies don't
+// overwrite. The hops are walked right to left and the first one that is not a trusted proxy is the client ip.
+// Proxies are CIDRs (10.0.0.0/8) or single ips.
+func IPFromTrustedProxies(header string, proxies ...string) (IPExtractor, error) {
+	if header == "" {
+		return nil, fmt.Errorf("IPFromTrustedProxies: header is required")
+	}
+	hopsOf := func(h http.Header) []string {
+		return headerValues(h, header)
+	}
+	if strings.EqualFold(header, "Forwarded") {
+		hopsOf = forwardedFor
+	}
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("IPFromTrustedProxies: invalid ip %s", p)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			p = fmt.Sprintf("%s/%d", p, bits)
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("IPFromTrustedProxies: %v", err)
+		}
+		nets = append(nets, n)
+	}
+	trusted := func(ip net.IP) bool {
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(r *http.Request) string {
+		remote := IPFromRemoteAddr(r)
+		ip := parseIP(remote)
+		if ip == nil || !trusted(ip) {
+			return remote
+		}
+		hops := hopsOf(r.Header)
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := parseIP(hops[i])
+			// obfuscated or unknown hops can't be trusted, keep the last known proxy
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !trusted(hop) {
+				break
+			}
+		}
+		return ip.String()
+	}, nil
+}
+
+// clientIP returns the ip of the request using the configured ClientIP extractor
+func (ga *GAuth) clientIP(r *http.Request) string {
+	if ga.ClientIP == nil {
+		return IPFromRemoteAddr(r)
+	}
+	return ga.ClientIP(r)
+}
+
+// forwardedFor returns the "for" parameters of https://www.rfc-editor.org/rfc/rfc7239 in order
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, elem := range headerValues(h, "Forwarded") {
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+				hops = append(hops, strings.Trim(kv[1], `"`))
+			}
+		}
+	}
+	return hops
+}
+
+// headerValues returns all comma separated values of all headers with name
+func headerValues(h http.Header, name string) []string {
+	var values []string
+	for _, v := range h.Values(name) {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// parseIP accepts an ip with optional port, IPv6 may be in brackets
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
@@ -1,3 +1,185 @@
+// t translates msg with the catalog of the page and replaces its {name} placeholders
+window.t = function (msg, values) {
+  if (!window.t.messages) {
+    const env = document.getElementById("env");
+    window.t.messages = env && env.dataset.messages ? JSON.parse(env.dataset.messages) : {};
+  }
+  if (msg === undefined || msg === null) return msg;
+  let res = window.t.messages[msg] || msg;
+  for (let k in values || {}) {
+    res = res.split("{" + k + "}").join(values[k]);
+  }
+  return res;
+};
+
+// sha256 of an ascii string as 8 signed 32-bit words, it's faster than awaiting
+// crypto.subtle for each attempt and works on plain http
+const sha256K = [];
+const sha256H = [];
+(function () {
+  const isPrime = {};
+  for (let n = 2; sha256K.length < 64; n++) {
+    if (isPrime[n] === false) continue;
+    for (let m = n * n; m < 313 * 313; m += n) isPrime[m] = false;
+    if (sha256H.length < 8) sha256H.push((Math.pow(n, 1 / 2) * 4294967296) | 0);
+    sha256K.push((Math.pow(n, 1 / 3) * 4294967296) | 0);
+  }
+})();
+
+function sha256(ascii) {
+  const bitLength = ascii.length * 8;
+  const words = [];
+  ascii += "\x80";
+  while (ascii.length % 64 - 56) ascii += "\x00";
+  for (let i = 0; i < ascii.length; i++) {
+    words[i >> 2] |= ascii.charCodeAt(i) << ((3 - i) % 4) * 8;
+  }
+  words.push((bitLength / 4294967296) | 0, bitLength);
+  const hash = sha256H.slice(0);
+  const w = new Int32Array(64);
+  for (let j = 0; j < words.length; j += 16) {
+    for (let i = 0; i < 64; i++) {
+      if (i < 16) {
+        w[i] = words[j + i];
+      } else {
+        const w15 = w[i - 15], w2 = w[i - 2];
+        w[i] = w[i - 16] + ((w15 >>> 7 | w15 << 25) ^ (w15 >>> 18 | w15 << 14) ^ (w15 >>> 3)) + w[i - 7] +
+          ((w2 >>> 17 | w2 << 15) ^ (w2 >>> 19 | w2 << 13) ^ (w2 >>> 10));
+      }
+    }
+    let a = hash[0], b = hash[1], c = hash[2], d = hash[3], e = hash[4], f = hash[5], g = hash[6], h = hash[7];
+    for (let i = 0; i < 64; i++) {
+      const t1 = (h + ((e >>> 6 | e << 26) ^ (e >>> 11 | e << 21) ^ (e >>> 25 | e << 7)) + ((e & f) ^ (~e & g)) + sha256K[i] + w[i]) | 0;
+      const t2 = (((a >>> 2 | a << 30) ^ (a >>> 13 | a << 19) ^ (a >>> 22 | a << 10)) + ((a & b) ^ (a & c) ^ (b & c))) | 0;
+      h = g;
+      g = f;
+      f = e;
+      e = (d + t1) | 0;
+      d = c;
+      c = b;
+      b = a;
+      a = (t1 + t2) | 0;
+    }
+    hash[0] = (hash[0] + a) | 0;
+    hash[1] = (hash[1] + b) | 0;
+    hash[2] = (hash[2] + c) | 0;
+    hash[3] = (hash[3] + d) | 0;
+    hash[4] = (hash[4] + e) | 0;
+    hash[5] = (hash[5] + f) | 0;
+    hash[6] = (hash[6] + g) | 0;
+    hash[7] = (hash[7] + h) | 0;
+  }
+  return hash;
+}
+
+function leadingZeroBits(words) {
+  let n = 0;
+  for (let i = 0; i < words.length; i++) {
+    n += Math.clz32(words[i]);
+    if (words[i] !== 0) break;
+  }
+  return n;
+}
+
+// captcha renders the challenge in #captcha-field and gives the response to submit with the form
+window.captcha = {
+  widget: null,
+  counter: 0,
+  solving: false,
+  field: function () {
+    return document.getElementById("captcha-field");
+  },
+  api: function (provider) {
+    return {
+      recaptcha: window.grecaptcha,
+      hcaptcha: window.hcaptcha,
+      turnstile: window.turnstile
+    }[provider];
+  },
+  // hidden is true until the server asks for a captcha that is rendered on demand
+  hidden: function (el) {
+    return el.hasAttribute("data-script") && !Alpine.store("values").captchaShown;
+  },
+  // show renders a captcha on demand, the hosted script calls captchaCallback when it loads
+  show: function () {
+    const el = this.field();
+    if (!el || !this.hidden(el)) return;
+    Alpine.store("values").captchaShown = true;
+    if (el.dataset.provider === "pow") {
+      this.solve(el.dataset.challenge);
+      return;
+    }
+    const script = document.createElement("script");
+    script.src = el.dataset.script;
+    script.defer = true;
+    document.head.appendChild(script);
+  },
+  // response resolves to undefined without a captcha and null when it's not solved yet
+  response: function () {
+    const el = this.field();
+    if (!el || this.hidden(el)) return Promise.resolve(undefined);
+    const d = el.dataset;
+    if (d.provider === "recaptchav3") {
+      return new Promise(function (resolve) {
+        grecaptcha.ready(function () {
+          grecaptcha.execute(d.key, {action: d.action}).then(resolve, function () {
+            resolve(null);
+          });
+        });
+      });
+    }
+    return Promise.resolve(Alpine.store("values").captcha);
+  },
+  // reset is called after a submit since responses can only be used once
+  reset: function () {
+    Alpine.store("values").captcha = null;
+    const el = this.field();
+    if (!el || this.hidden(el)) return;
+    if (el.dataset.provider === "pow") {
+      this.solve(el.dataset.challenge);
+      return;
+    }
+    const api = this.api(el.dataset.provider);
+    if (api && this.widget !== null) api.reset(this.widget);
+  },
+  // solve finds the next counter of the proof-of-work in small batches to keep the page responsive
+  solve: function (challenge) {
+    if (this.solving) return;
+    this.solving = true;
+    const difficulty = parseInt(challenge.split(".")[1], 10);
+    const self = this;
+    function batch() {
+      for (let i = 0; i < 2000; i++) {
+        const resp = challenge + ":" + self.counter++;
+        if (leadingZeroBits(sha256(resp)) >= difficulty) {
+          self.solving = false;
+          Alpine.store("values").captcha = resp;
+          return;
+        }
+      }
+      setTimeout(batch, 0);
+    }
+    batch();
+  }
+};
+
+// captchaCallback is called when the script of a hosted captcha loads
+window.captchaCallback = function () {
+  const el = window.captcha.field();
+  if (!el) return;
+  const opts = {
+    sitekey: el.dataset.key,
+    callback: function (resp) {
+      Alpine.store("values").captcha = resp;
+    },
+    "expired-callback": function () {
+      Alpine.store("values").captcha = null;
+    }
+  };
+  if (el.dataset.action) opts.action = el.dataset.action;
+  window.captcha.widget = window.captcha.api(el.dataset.provider).render(el, opts);
+};
+
 document.addEventListener('alpine:init', function () {
   const store = sessionStorage;
   function sendRequest(method, url, data, onSuccess, onError) {
@@ -19,6 +201,9 @@ document.addEventListener('alpine:init', function () {
       return;
     }
     xhr.setRequestHeader('Content-Type', 'application/json');
+    if (env.csrf) {
+      xhr.setRequestHeader(env.csrfHeader, env.csrf);
+    }
     const accTok = Alpine.store("values").accessToken;
     if (accTok) {
       xhr.setRequestHeader('Authorization', 'Bearer ' + accTok)
@@ -27,6 +212,9 @@ document.addEventListener('alpine:init', function () {
       if (xhr.readyState === 4) {
         Alpine.store("values").loading = false;
         const result = xhr.responseText ? JSON.parse(xhr.responseText) : {};
+        if (xhr.status === 429) {
+          retryCountdown(result.retry_after || parseInt(xhr.getResponseHeader("Retry-After"), 10));
+        }
         if (xhr.status >= 400) {
           if (xhr.status === 401 && accTok) {
             Alpine.store("values").accessToken = null;
@@ -42,6 +230,21 @@ document.addEventListener('alpine:init', function () {
     xhr.send(data ? JSON.stringify(data) : undefined);
   }
   const env = document.getElementById("env").dataset;
+  let retryTimer = null;
+
+  function retryCountdown(seconds) {
+    if (!seconds || seconds < 1) return;
+    const values = Alpine.store("values");
+    values.retryAfter = seconds;
+    clearInterval(retryTimer);
+    retryTimer = setInterval(function () {
+      values.retryAfter--;
+      if (values.retryAfter <= 0) {
+        values.retryAfter = 0;
+        clearInterval(retryTimer);
+      }
+    }, 1000);
+  }
 
   function bPath(p) {
     return env.base + p;
@@ -78,10 +281,16 @@ document.addEventListener('alpine:init', function () {
     });
   }
   Alpine.store('values', {
-    recaptcha: null,
+    captcha: null,
+    captchaShown: false,
     loading: false,
+    retryAfter: 0,
     accessToken: null
   });
+  const captchaField = window.captcha.field();
+  if (captchaField && captchaField.dataset.provider === "pow" && !window.captcha.hidden(captchaField)) {
+    window.captcha.solve(captchaField.dataset.challenge);
+  }
   Alpine.store('notify', {
     alertId: 0,
     alerts: [],
@@ -109,7 +318,7 @@ document.addEventListener('alpine:init', function () {
     },
   });
   Alpine.store('nav', {
-    tab: document.querySelectorAll(".nav a.pointer").length ? document.querySelectorAll(".nav a.pointer")[0].innerText : null,
+    tab: document.querySelectorAll(".nav a[data-tab]").length ? document.querySelectorAll(".nav a[data-tab]")[0].dataset.tab : null,
     setTab: function (tab) {
       this.tab = tab;
     },
@@ -173,6 +382,17 @@ document.addEventListener('alpine:init', function () {
             store.setItem("alertDanger", err.error);
             location.href = "?";
           });
+        } else if (query.a === "lock") {
+          sendRequest("POST", actPath, {
+            action: query.a,
+            token: query.t
+          }, () => {
+            store.setItem("alertSuccess", "Your account is locked.");
+            location.href = "?";
+          }, (err) => {
+            store.setItem("alertDanger", err.error);
+            location.href = "?";
+          });
         } else if (query.a === "login") {
           sendRequest("POST", location.pathname, {
             token: query.t
@@ -195,9 +415,28 @@ document.addEventListener('alpine:init', function () {
               });
               return;
             }
+            if (query.a === "orginvite") {
+              sendRequest("POST", actPath, {
+                action: query.a,
+                token: query.t
+              }, (r) => {
+                store.setItem("alertSuccess", t("You joined {org}!", {org: r.org_name}));
+                location.href = bPath(env.account);
+              }, (err) => {
+                store.setItem("alertDanger", err.error);
+                location.href = bPath(env.account);
+              });
+              return;
+            }
             sendRequest("GET", location.pathname, null, (r) => {
               this.updateAccount(r);
             });
+            if (this.$refs.field_apikeys) {
+              this.loadApiKeys();
+            }
+            if (this.$refs.field_organizations) {
+              this.loadOrgs();
+            }
 
             Alpine.effect(() => {
               if (Alpine.store("nav").tab && this.original) {
@@ -221,6 +460,143 @@ document.addEventListener('alpine:init', function () {
       mfa: {
         url: null
       },
+      apiKeys: {
+        list: [],
+        created: null,
+        name: "",
+        expires: "",
+        scopes: ""
+      },
+      formatDate: function (d) {
+        if (!d || d.indexOf("0001-") === 0) return "-";
+        return new Date(d).toLocaleString();
+      },
+      loadApiKeys: function () {
+        sendRequest("POST", actPath, {
+          action: "apiKeys"
+        }, (r) => {
+          this.apiKeys.list = r;
+        });
+      },
+      newApiKey: function () {
+        this.errors = {};
+        sendRequest("POST", actPath, {
+          action: "newApiKey",
+          name: this.apiKeys.name,
+          expires: this.apiKeys.expires ? String(this.apiKeys.expires) : "",
+          scopes: this.apiKeys.scopes
+        }, (r) => {
+          this.apiKeys.created = r.key;
+          this.apiKeys.name = "";
+          this.apiKeys.expires = "";
+          this.apiKeys.scopes = "";
+          this.loadApiKeys();
+        }, (err) => {
+          if (err.error === "validation") {
+            this.errors = err.data;
+            if (this.errors.captcha === "required") {
+              window.captcha.show();
+            }
+          } else {
+            Alpine.store('notify').alert("danger", err.error);
+          }
+        });
+      },
+      orgs: {
+        memberships: [],
+        active: "",
+        selected: null,
+        members: [],
+        name: "",
+        email: "",
+        role: "member"
+      },
+      orgError: function (err) {
+        if (err.error === "validation") {
+          this.errors = err.data;
+        } else {
+          Alpine.store('notify').alert("danger", err.error);
+        }
+      },
+      loadOrgs: function () {
+        sendRequest("POST", actPath, {
+          action: "orgs"
+        }, (r) => {
+          this.orgs.memberships = r.memberships;
+          this.orgs.active = r.active;
+        });
+      },
+      loadMembers: function (m) {
+        this.orgs.selected = m;
+        sendRequest("POST", actPath, {
+          action: "orgMembers",
+          org: m.org_id
+        }, (r) => {
+          this.orgs.members = r;
+        }, this.orgError.bind(this));
+      },
+      canManageOrg: function () {
+        const m = this.orgs.selected;
+        return m && (m.role === "owner" || m.role === "admin");
+      },
+      newOrg: function () {
+        this.errors = {};
+        sendRequest("POST", actPath, {
+          action: "newOrg",
+          name: this.orgs.name
+        }, () => {
+          this.orgs.name = "";
+          this.loadOrgs();
+        }, this.orgError.bind(this));
+      },
+      orgInvite: function () {
+        this.errors = {};
+        sendRequest("POST", actPath, {
+          action: "orgInvite",
+          org: this.orgs.selected.org_id,
+          email: this.orgs.email,
+          role: this.orgs.role
+        }, () => {
+          Alpine.store('notify').alert("success", t("Invitation sent to {email}.", {email: this.orgs.email}));
+          this.orgs.email = "";
+          this.loadMembers(this.orgs.selected);
+        }, this.orgError.bind(this));
+      },
+      orgAction: function (action, data) {
+        this.errors = {};
+        data.action = action;
+        sendRequest("POST", actPath, data, () => {
+          if (action === "orgSwitch") {
+            // grants changed, get a new access token with the active organization
+            Alpine.store("values").accessToken = null;
+            accessToken(() => {});
+          }
+          if (action === "orgLeave") {
+            this.orgs.selected = null;
+          }
+          this.loadOrgs();
+          if (this.orgs.selected) {
+            this.loadMembers(this.orgs.selected);
+          }
+          Alpine.store('notify').alert("success", "Updated!");
+        }, (err) => {
+          this.orgError(err);
+          if (this.orgs.selected) {
+            this.loadMembers(this.orgs.selected);
+          }
+        });
+      },
+      revokeApiKey: function (id) {
+        if (!confirm(t("Revoke this API key?"))) return;
+        sendRequest("POST", actPath, {
+          action: "revokeApiKey",
+          id: id
+        }, () => {
+          this.apiKeys.created = null;
+          this.loadApiKeys();
+          Alpine.store('notify').alert("success", "API key revoked!");
+        });
+      },
       updateAccount: function (acct, reset) {
         if (acct) {
           this.original = JSON.stringify(acct);
@@ -260,13 +636,18 @@ document.addEventListener('alpine:init', function () {
             return;
           }
         }
-        if (window.grecaptcha) {
-          if (!Alpine.store("values").recaptcha) {
-            this.errors.recaptcha = "required";
+        window.captcha.response().then((resp) => {
+          if (resp === null) {
+            this.errors.captcha = "required";
             return;
           }
-          this.input.recaptcha = Alpine.store("values").recaptcha;
-        }
+          if (resp) {
+            this.input.captcha = resp;
+          }
+          this.send(e);
+        });
+      },
+      send: function (e) {
         let path = location.pathname;
         if (query.a || e.act) {
           path = actPath;
@@ -292,6 +673,7 @@ document.addEventListener('alpine:init', function () {
           this.mfa.recovery = null;
         }
         sendRequest("POST", path, input, (r, code) => {
+          window.captcha.reset();
           if (input.action && success[input.action]) {
             store.setItem("alertSuccess", success[input.action]);
             location.href = "?";
@@ -301,7 +683,7 @@ document.addEventListener('alpine:init', function () {
             if (!input.password && code === 201) {
               const el = document.querySelectorAll("input[type=email]")[0];
               this.input[el.id] = null;
-              Alpine.store('notify').alert("success", "An email was sent to " + input[el.id] + ".");
+              Alpine.store('notify').alert("success", t("An email was sent to {email}.", {email: input[el.id]}));
             } else {
               goLogin();
             }
@@ -313,10 +695,7 @@ document.addEventListener('alpine:init', function () {
             Alpine.store('notify').alert("success", code === 201 ? "Email update link sent to your email." : "Updated!");
           }
         }, function (err) {
-          Alpine.store("values").recaptcha = null;
-          if (window.grecaptcha) {
-            window.grecaptcha.reset(window.recaptcha);
-          }
+          window.captcha.reset();
           if (err.error === "validation") {
             this.errors = err.data;
             if (isLogin && this.$refs.field_code) {
@@ -330,14 +709,3 @@ document.addEventListener('alpine:init', function () {
     }
   });
 });
-
-window.recaptchaCallback = function () {
-  const recaptchaField = document.getElementById("recaptcha-field");
-  if (!recaptchaField) return;
-  window.recaptcha = grecaptcha.render(recaptchaField, {
-    sitekey: recaptchaField.dataset.key,
-    callback: function (resp) {
-      Alpine.store("values").recaptcha = resp;
-    },
-  });
-};
\ No newline at end of file
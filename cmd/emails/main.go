@@ -0,0 +1,82 @@
+// Command emails renders every email with sample data to files for visual regression testing.
+//
+//	go run ./cmd/emails -out testdata/emails -templates ./templates -lang en,es
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/altlimit/gauth"
+	"github.com/altlimit/gauth/email"
+	"github.com/altlimit/gauth/form"
+)
+
+type (
+	sampleProvider struct {
+	}
+
+	User struct {
+		ID       string
+		Name     string `gauth:"name"`
+		Password string `gauth:"password"`
+		Email    string `gauth:"email"`
+		Active   bool   `gauth:"active"`
+	}
+)
+
+func (u *User) IdentitySave(ctx context.Context) (string, error) {
+	return u.ID, nil
+}
+
+func (sp *sampleProvider) IdentityUID(ctx context.Context, id string) (string, error) {
+	return "", gauth.ErrIdentityNotFound
+}
+
+func (sp *sampleProvider) IdentityLoad(ctx context.Context, uid string) (gauth.Identity, error) {
+	return &User{}, gauth.ErrIdentityNotFound
+}
+
+func (sp *sampleProvider) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	return nil
+}
+
+func main() {
+	out := flag.String("out", "emails", "directory to write {lang}/{action}.html and .txt to")
+	tpls := flag.String("templates", "", "directory of email templates, see email.ParseTemplatesFS")
+	langs := flag.String("lang", "", "comma separated languages, defaults to all")
+	appName := flag.String("app", "Demo", "app name")
+	appURL := flag.String("url", "http://localhost:8887", "app url")
+	passwordless := flag.Bool("passwordless", false, "render the emails of passwordless login")
+	flag.Parse()
+
+	var ga *gauth.GAuth
+	if *passwordless {
+		ga = gauth.NewPasswordless(*appName, *appURL, &sampleProvider{})
+	} else {
+		ga = gauth.NewDefault(*appName, *appURL, &sampleProvider{})
+	}
+	ga.Fields = append(ga.Fields,
+		&form.Field{ID: "name", Label: "Name", Type: "text", Validate: gauth.RequiredText, SettingsTab: "Account"},
+	)
+	if *tpls != "" {
+		t, err := email.ParseTemplatesFS(os.DirFS(*tpls))
+		if err != nil {
+			log.Fatal(err)
+		}
+		ga.EmailTemplates = t
+	}
+	ga.MustInit(false)
+
+	var locales []string
+	if *langs != "" {
+		locales = strings.Split(*langs, ",")
+	}
+	if err := ga.WriteEmailPreviews(context.Background(), *out, locales...); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Emails written to", *out)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"html"
 	"log"
 	"net/http"
 	"strconv"
@@ -80,7 +81,7 @@ func dashboardHandler() http.Handler {
 	})
 }
 
-func homeHandler() http.Handler {
+func homeHandler(ga *gauth.GAuth) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 		<head>
@@ -88,7 +89,10 @@ func homeHandler() http.Handler {
 		</head>
 		<body>
 			<a href="/auth/login">Login</a>
-			<a href="/auth/refresh?logout=1">Logout</a>
+			<form method="post" action="/auth/refresh?logout=1" style="display: inline">
+				<input type="hidden" name="csrf_token" value="` + html.EscapeString(ga.CSRFToken(w, r)) + `">
+				<button type="submit">Logout</button>
+			</form>
 			<a href="/dashboard">Dashboard</a>
 			<a href="/auth/account">Account</a>
 		</body>
@@ -113,7 +117,7 @@ func main() {
 	ga.AccessTokenCookieName = "atoken"
 	http.Handle("/auth/", ga.MustInit(true))
 	http.Handle("/dashboard", ga.AuthMiddleware(dashboardHandler()))
-	http.Handle("/", homeHandler())
+	http.Handle("/", homeHandler(ga))
 
 	// passwordless
 	ga = gauth.NewPasswordless("Passwordless", "http://localhost:"+port, &memoryProvider{})
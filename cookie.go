@@ -0,0 +1,105 @@
+package gauth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// CookiePrefixHost locks cookies to the exact host over https with Path=/
+	CookiePrefixHost = "__Host-"
+	// CookiePrefixSecure requires cookies to be set over https
+	CookiePrefixSecure = "__Secure-"
+)
+
+type (
+	// Cookies controls the attributes of every cookie gauth sets: the refresh, access, csrf,
+	// device and language cookies.
+	Cookies struct {
+		// Domain shares the cookies with its subdomains e.g. example.com, it can't be used with CookiePrefixHost
+		Domain string
+		// SameSite overrides the default of Strict for token cookies and Lax for the others,
+		// http.SameSiteNoneMode allows gauth to be used from other sites
+		SameSite http.SameSite
+		// Insecure sends cookies over http, it's always the case with MustInit(true)
+		Insecure bool
+		// Prefix is prepended to all cookie names, CookiePrefixHost or CookiePrefixSecure.
+		// CookiePrefixHost sets the refresh and device cookies on / instead of their handlers.
+		Prefix string
+		// Partitioned keeps cookies in a separate jar per top level site (CHIPS) when
+		// gauth is embedded in another site, it needs SameSite http.SameSiteNoneMode
+		Partitioned bool
+	}
+)
+
+// cookieName returns name with the configured prefix
+func (ga *GAuth) cookieName(name string) string {
+	return ga.Cookies.Prefix + name
+}
+
+// cookie returns the gauth cookie name of the request
+func (ga *GAuth) cookie(r *http.Request, name string) (*http.Cookie, error) {
+	return r.Cookie(ga.cookieName(name))
+}
+
+// secureCookies returns true if cookies must only be sent over https
+func (ga *GAuth) secureCookies() bool {
+	cc := ga.Cookies
+	return !(ga.debug || cc.Insecure) || cc.Prefix != "" || cc.Partitioned || cc.SameSite == http.SameSiteNoneMode
+}
+
+// setCookie writes c with the Cookies policy applied, c.SameSite and c.Path are the defaults of the cookie
+func (ga *GAuth) setCookie(w http.ResponseWriter, c *http.Cookie) {
+	cc := ga.Cookies
+	c.Name = ga.cookieName(c.Name)
+	c.Domain = cc.Domain
+	c.Secure = ga.secureCookies()
+	if cc.SameSite != 0 {
+		c.SameSite = cc.SameSite
+	}
+	if cc.Prefix == CookiePrefixHost {
+		c.Path = "/"
+		c.Domain = ""
+	}
+	if !cc.Partitioned {
+		http.SetCookie(w, c)
+		return
+	}
+	// http.Cookie has no Partitioned attribute before go1.23
+	if v := c.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; Partitioned")
+	}
+}
+
+// clearCookie expires the cookie name set on path
+func (ga *GAuth) clearCookie(w http.ResponseWriter, name string, path string, sameSite http.SameSite) {
+	ga.setCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    "",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		MaxAge:   -1,
+		SameSite: sameSite,
+		Path:     path,
+	})
+}
+
+// validate panics on policies browsers would reject
+func (c Cookies) validate() {
+	switch c.Prefix {
+	case "", CookiePrefixSecure:
+	case CookiePrefixHost:
+		if c.Domain != "" {
+			panic("Cookies.Domain can't be used with " + CookiePrefixHost)
+		}
+	default:
+		panic("Cookies.Prefix must be " + CookiePrefixHost + " or " + CookiePrefixSecure)
+	}
+	if c.Partitioned && c.SameSite != http.SameSiteNoneMode {
+		panic("Cookies.Partitioned requires SameSite None")
+	}
+	if strings.ContainsAny(c.Domain, "/:") {
+		panic("Cookies.Domain must be a host name")
+	}
+}
@@ -0,0 +1,157 @@
+package gauth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrCSRFOrigin = errors.New("cross origin request")
+	ErrCSRFToken  = errors.New("invalid csrf token")
+)
+
+type (
+	// CSRF protects requests that cookies authenticate with a signed double-submit token
+	// and by checking their Origin or Referer.
+	CSRF struct {
+		// Disabled turns off all checks, e.g. when you only use Authorization headers
+		Disabled bool
+		// CookieName defaults to gcsrf, it's readable by scripts so they can send it back
+		CookieName string
+		// HeaderName defaults to X-CSRF-Token, html forms can post a csrf_token field instead
+		HeaderName string
+		// TrustedOrigins can send cookie authenticated requests besides the requested host
+		// and Brand.AppURL, e.g. https://app.example.com
+		TrustedOrigins []string
+	}
+)
+
+const csrfFormField = "csrf_token"
+
+// safeMethod returns true for methods that must not change state
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// CSRFToken returns the token that cookie authenticated requests must send in the CSRF
+// HeaderName or csrf_token form field, it's set as a cookie when missing.
+func (ga *GAuth) CSRFToken(w http.ResponseWriter, r *http.Request) string {
+	tga, _, r, err := ga.tenantRequest(r)
+	if err != nil {
+		return ""
+	}
+	return tga.csrfToken(w, r)
+}
+
+func (ga *GAuth) csrfToken(w http.ResponseWriter, r *http.Request) string {
+	if ga.CSRF.Disabled {
+		return ""
+	}
+	if c, err := ga.cookie(r, ga.CSRF.CookieName); err == nil && ga.validCSRFToken(c.Value) {
+		return c.Value
+	}
+	nonce := randSeq(32)
+	token := nonce + "." + ga.csrfSignature(nonce)
+	ga.setCookie(w, &http.Cookie{
+		Name:     ga.CSRF.CookieName,
+		Value:    token,
+		SameSite: http.SameSiteLaxMode,
+		Path:     "/",
+	})
+	// requests in the same round trip see the new cookie
+	r.AddCookie(&http.Cookie{Name: ga.cookieName(ga.CSRF.CookieName), Value: token})
+	return token
+}
+
+func (ga *GAuth) csrfSignature(nonce string) string {
+	mac := hmac.New(sha256.New, ga.JwtKey)
+	mac.Write([]byte("csrf:" + ga.tenantID() + ":" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (ga *GAuth) validCSRFToken(token string) bool {
+	nonce, sig, ok := strings.Cut(token, ".")
+	return ok && hmac.Equal([]byte(sig), []byte(ga.csrfSignature(nonce)))
+}
+
+// cookieAuthenticated returns true if the request has no Authorization header but carries auth cookies
+func (ga *GAuth) cookieAuthenticated(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" {
+		return false
+	}
+	for _, name := range []string{ga.AccessTokenCookieName, ga.RefreshTokenCookieName} {
+		if name == "" {
+			continue
+		}
+		if _, err := ga.cookie(r, name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCSRF verifies unsafe requests without an Authorization header, browsers must send them
+// from a trusted origin and cookie authenticated ones must have the token of the CSRF cookie.
+func (ga *GAuth) checkCSRF(r *http.Request) error {
+	if ga.CSRF.Disabled || safeMethod(r.Method) || r.Header.Get("Authorization") != "" {
+		return nil
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		if ref, err := url.Parse(r.Header.Get("Referer")); err == nil && ref.Host != "" {
+			origin = ref.Scheme + "://" + ref.Host
+		}
+	}
+	if origin != "" && !ga.trustedOrigin(r, origin) {
+		return ErrCSRFOrigin
+	}
+	if !ga.cookieAuthenticated(r) {
+		return nil
+	}
+	c, err := ga.cookie(r, ga.CSRF.CookieName)
+	if err != nil || !ga.validCSRFToken(c.Value) {
+		return ErrCSRFToken
+	}
+	token := r.Header.Get(ga.CSRF.HeaderName)
+	if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		token = r.PostFormValue(csrfFormField)
+	}
+	if !hmac.Equal([]byte(token), []byte(c.Value)) {
+		return ErrCSRFToken
+	}
+	return nil
+}
+
+func (ga *GAuth) trustedOrigin(r *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	if app, err := url.Parse(ga.Brand.AppURL); err == nil && app.Host != "" &&
+		strings.EqualFold(app.Scheme+"://"+app.Host, origin) {
+		return true
+	}
+	for _, o := range ga.CSRF.TrustedOrigins {
+		if strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ga *GAuth) csrfError(w http.ResponseWriter, err error) {
+	ga.log("csrf", err)
+	ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: err.Error()})
+}
@@ -3,7 +3,6 @@ package gauth
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"time"
 
 	"github.com/altlimit/gauth/email"
@@ -11,126 +10,253 @@ import (
 )
 
 const (
-	actionVerify      = "verify"
-	actionEmailUpdate = "emailupdate"
-	actionReset       = "reset"
-	actionLogin       = "login"
+	actionVerify      = email.ActionVerify
+	actionEmailUpdate = email.ActionEmailUpdate
+	actionReset       = email.ActionReset
+	actionLogin       = email.ActionLogin
+	actionOrgInvite   = email.ActionOrgInvite
+
+	actionPasswordChanged   = email.ActionPasswordChanged
+	actionTwoFactorDisabled = email.ActionTwoFactorDisabled
+	actionEmailChange       = email.ActionEmailChange
+	actionNewDevice         = email.ActionNewDevice
+	// actionLock is the token action of the link in security notifications
+	actionLock = "lock"
 )
 
-func (ga *GAuth) emailHandler(w http.ResponseWriter, r *http.Request) {
-	h := w.Header()
-	h.Set("Content-Type", "text/html")
+func (ga *GAuth) sendMail(ctx context.Context, action string, uid string, req map[string]interface{}) (bool, error) {
+	if ga.emailSender == nil || ga.EmailFieldID == "" {
+		return false, nil
+	}
+	link, expires, err := ga.mailLink(ctx, action, uid, req)
+	if err != nil {
+		return false, err
+	}
+	ctx = ga.mailContext(ctx, req)
+	msg, err := ga.composeMail(ctx, action, link, expires, req)
+	if err != nil || msg == nil {
+		return false, err
+	}
+	if err := ga.emailSender.SendEmail(ctx, msg.To, msg.Subject, msg.Text, msg.HTML); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	ed := ga.emailData()
-	ed.Data = []email.Part{
-		{P: "Click the link below to update your email."},
-		{URL: "#", Label: "Verify"},
+// mailLink signs the token of action and returns the link for its email
+func (ga *GAuth) mailLink(ctx context.Context, action string, uid string, req map[string]interface{}) (string, time.Time, error) {
+	token := jwt.New(jwt.SigningMethodHS256)
+	claims := token.Claims.(jwt.MapClaims)
+	act, actPath := ga.mailAction(action)
+	claims["uid"] = uid
+	claims["act"] = act
+	toEmail := toString(req[ga.EmailFieldID])
+	// updating email will only update record after verifying
+	if action == actionEmailUpdate {
+		claims["email"] = toEmail
+	}
+	if action == actionOrgInvite {
+		claims["email"] = toEmail
+		claims["org"] = toString(req["org"])
+	}
+	expires := time.Now().Add(ga.emailTokenExpiry(action))
+	claims["exp"] = expires.Unix()
+	// links can only be used once
+	claims["jti"] = newNonce()
+	if tid := ga.tenantID(); tid != "" {
+		claims["tid"] = tid
 	}
-	if err := ed.Parse(make(map[string]interface{})); err != nil {
-		ga.internalError(w, err)
-		return
+	jwtKey := ga.JwtKey
+	if action == actionReset {
+		// we append password hash for password resets
+		jwtKey = append(jwtKey, []byte(toString(req[ga.PasswordFieldID]))...)
 	}
-	w.Write([]byte(ed.HTMLContent))
+	tok, err := token.SignedString(jwtKey)
+	if err != nil {
+		return "", expires, fmt.Errorf("sendMail: SignedString error %v", err)
+	}
+	return ga.mailBaseURL(ctx) + actPath + "?a=" + act + "&t=" + tok, expires, nil
 }
 
-func (ga *GAuth) sendMail(ctx context.Context, action string, uid string, req map[string]interface{}) (bool, error) {
-	if ga.emailSender != nil && ga.EmailFieldID != "" {
-		token := jwt.New(jwt.SigningMethodHS256)
-		claims := token.Claims.(jwt.MapClaims)
-		actPath := ga.Path.Login
-
-		claims["uid"] = uid
-		claims["act"] = action
-		toEmail := req[ga.EmailFieldID].(string)
-		// updating email will only update record after verifying
-		if action == actionEmailUpdate {
-			claims["email"] = toEmail
-			actPath = ga.Path.Account
-		}
-		claims["exp"] = time.Now().Add(ga.Timeout.EmailToken).Unix()
-		jwtKey := ga.JwtKey
-		if action == actionReset {
-			// we append password hash for password resets
-			jwtKey = append(jwtKey, []byte(toString(req[ga.PasswordFieldID]))...)
-		}
-		tok, err := token.SignedString(jwtKey)
-		if err != nil {
-			return false, fmt.Errorf("sendMail: SignedString error %v", err)
+// mailAction returns the action of the token and the page of the link in the email of action
+func (ga *GAuth) mailAction(action string) (string, string) {
+	switch {
+	case isNotification(action):
+		// security notifications link to locking the account
+		return actionLock, ga.Path.Login
+	case action == actionEmailUpdate, action == actionOrgInvite:
+		return action, ga.Path.Account
+	}
+	return action, ga.Path.Login
+}
+
+func (ga *GAuth) mailBaseURL(ctx context.Context) string {
+	if bURL, ok := ga.IdentityProvider.(email.EmailBaseURL); ok {
+		if url := bURL.EmailBaseURL(ctx); url != "" {
+			return url
 		}
-		baseURL := ga.Brand.AppURL + ga.Path.Base
-		if bURL, ok := ga.IdentityProvider.(email.EmailBaseURL); ok {
-			if url := bURL.EmailBaseURL(ctx); url != "" {
-				baseURL = url
+	}
+	return ga.Brand.AppURL + ga.Path.Base
+}
+
+// mailContext sets the locale of the recipient, custom emails can use LocaleFromContext for it
+func (ga *GAuth) mailContext(ctx context.Context, req map[string]interface{}) context.Context {
+	if locale := ga.recipientLocale(ctx, req); locale != "" {
+		return context.WithValue(ctx, LocaleKey, locale)
+	}
+	return ctx
+}
+
+// composeMail renders the email of action for the email in req in the locale of ctx,
+// it returns nil when a custom email has no subject.
+func (ga *GAuth) composeMail(ctx context.Context, action string, link string, expires time.Time, req map[string]interface{}) (*RenderedEmail, error) {
+	ed := ga.emailData()
+	locale := LocaleFromContext(ctx)
+	msg := &RenderedEmail{Action: action, Locale: locale, To: toString(req[ga.EmailFieldID])}
+	// placeholders are kept for ed.Parse to replace with the request values
+	t := func(msg string) string {
+		return ga.t(locale, msg, nil)
+	}
+
+	if tpls := ga.emailTemplates(); tpls.Has(action) {
+		fields := make(map[string]interface{})
+		for k, v := range req {
+			switch k {
+			case ga.PasswordFieldID, FieldTOTPSecretID, FieldRecoveryCodesID:
+			default:
+				fields[k] = v
 			}
 		}
-		link := baseURL + actPath + "?a=" + action + "&t=" + tok
-		ed := ga.emailData()
+		subject, text, html, err := tpls.Render(action, &email.TemplateData{
+			Data:    ed,
+			Action:  action,
+			Link:    link,
+			Expires: expires,
+			Fields:  fields,
+			Locale:  locale,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("ga.sendMail: %v", err)
+		}
+		msg.Subject, msg.Text, msg.HTML = subject, text, html
+		return msg, nil
+	}
 
-		switch action {
-		case actionLogin:
-			ed.Subject = "Login / Register Link"
-			ed.Data = []email.Part{
-				{P: "Click the link below to login or register"},
-				{URL: link, Label: "Login"},
-			}
+	switch action {
+	case actionLogin:
+		ed.Subject = t("Login / Register Link")
+		ed.Data = []email.Part{
+			{P: t("Click the link below to login or register")},
+			{URL: link, Label: t("Login")},
+		}
 
-			if evm, ok := ga.IdentityProvider.(email.LoginEmail); ok {
-				ed.Subject, ed.Data = evm.LoginEmail(ctx)
-				if ed.Subject != "" {
-					ed.ReplaceLink(link)
-				}
-			}
-		case actionVerify:
-			ed.Subject = "Verify Your Email"
-			ed.Data = []email.Part{
-				{P: "Click the link below to verify your email."},
-				{URL: link, Label: "Verify"},
-			}
-			if evm, ok := ga.IdentityProvider.(email.ConfirmEmail); ok {
-				ed.Subject, ed.Data = evm.ConfirmEmail(ctx)
-			}
-		case actionEmailUpdate:
-			ed.Subject = "Confirm Email Update"
-			ed.Data = []email.Part{
-				{P: "Click the link below to update your email."},
-				{URL: link, Label: "Verify"},
+		if evm, ok := ga.IdentityProvider.(email.LoginEmail); ok {
+			ed.Subject, ed.Data = evm.LoginEmail(ctx)
+			if ed.Subject != "" {
+				ed.ReplaceLink(link)
 			}
+		}
+	case actionVerify:
+		ed.Subject = t("Verify Your Email")
+		ed.Data = []email.Part{
+			{P: t("Click the link below to verify your email.")},
+			{URL: link, Label: t("Verify")},
+		}
+		if evm, ok := ga.IdentityProvider.(email.ConfirmEmail); ok {
+			ed.Subject, ed.Data = evm.ConfirmEmail(ctx)
+		}
+	case actionEmailUpdate:
+		ed.Subject = t("Confirm Email Update")
+		ed.Data = []email.Part{
+			{P: t("Click the link below to update your email.")},
+			{URL: link, Label: t("Verify")},
+		}
 
-			if evm, ok := ga.IdentityProvider.(email.UpdateEmail); ok {
-				ed.Subject, ed.Data = evm.UpdateEmail(ctx)
-				if ed.Subject != "" {
-					ed.ReplaceLink(link)
-				}
+		if evm, ok := ga.IdentityProvider.(email.UpdateEmail); ok {
+			ed.Subject, ed.Data = evm.UpdateEmail(ctx)
+			if ed.Subject != "" {
+				ed.ReplaceLink(link)
 			}
-		case actionReset:
-			ed.Subject = "Password Reset Link"
-			ed.Data = []email.Part{
-				{P: "Click the link below to reset your password."},
-				{URL: link, Label: "Reset Password"},
+		}
+	case actionOrgInvite:
+		ed.Subject = t("Invitation to {org_name}")
+		ed.Data = []email.Part{
+			{P: t("You have been invited to join {org_name} as {role}.")},
+			{URL: link, Label: t("Accept Invitation")},
+		}
+
+		if oi, ok := ga.IdentityProvider.(email.OrganizationInvite); ok {
+			ed.Subject, ed.Data = oi.OrganizationInvite(ctx)
+			if ed.Subject != "" {
+				ed.ReplaceLink(link)
 			}
+		}
+	case actionReset:
+		ed.Subject = t("Password Reset Link")
+		ed.Data = []email.Part{
+			{P: t("Click the link below to reset your password.")},
+			{URL: link, Label: t("Reset Password")},
+		}
 
-			if rp, ok := ga.IdentityProvider.(email.ResetPassword); ok {
-				ed.Subject, ed.Data = rp.ResetPassword(ctx)
-				if ed.Subject != "" {
-					ed.ReplaceLink(link)
-				}
+		if rp, ok := ga.IdentityProvider.(email.ResetPassword); ok {
+			ed.Subject, ed.Data = rp.ResetPassword(ctx)
+			if ed.Subject != "" {
+				ed.ReplaceLink(link)
 			}
 		}
+	case actionPasswordChanged:
+		ed.Subject = t("Your password was changed")
+		ed.Data = []email.Part{
+			{P: t("The password of your account was changed.")},
+			{P: t("If this wasn't you, lock your account and reset your password.")},
+			{URL: link, Label: t("This wasn't me")},
+		}
 
-		if ed.Subject != "" {
-			ed.ReplaceLink(link)
+		if pc, ok := ga.IdentityProvider.(email.PasswordChanged); ok {
+			ed.Subject, ed.Data = pc.PasswordChanged(ctx)
+		}
+	case actionTwoFactorDisabled:
+		ed.Subject = t("Two-factor authentication disabled")
+		ed.Data = []email.Part{
+			{P: t("Two-factor authentication was disabled on your account.")},
+			{P: t("If this wasn't you, lock your account and reset your password.")},
+			{URL: link, Label: t("This wasn't me")},
 		}
 
-		if err := ed.Parse(req); err != nil {
-			return false, fmt.Errorf("ga.sendMail: parse error %v", err)
+		if td, ok := ga.IdentityProvider.(email.TwoFactorDisabled); ok {
+			ed.Subject, ed.Data = td.TwoFactorDisabled(ctx)
+		}
+	case actionEmailChange:
+		ed.Subject = t("Email change requested")
+		ed.Data = []email.Part{
+			{P: t("A change of your account email to {new_email} was requested.")},
+			{P: t("If this wasn't you, lock your account and reset your password.")},
+			{URL: link, Label: t("This wasn't me")},
 		}
 
-		if ed.Subject != "" {
-			if err := ga.emailSender.SendEmail(ctx, toEmail, ed.Subject, ed.TextContent, ed.HTMLContent); err != nil {
-				return false, err
-			}
-			return true, nil
+		if ec, ok := ga.IdentityProvider.(email.EmailChangeRequested); ok {
+			ed.Subject, ed.Data = ec.EmailChangeRequested(ctx)
 		}
+	case actionNewDevice:
+		ed.Subject = t("New login to your account")
+		ed.Data = []email.Part{
+			{P: t("Your account was accessed from a new device ({ip}, {user_agent}).")},
+			{P: t("If this wasn't you, lock your account and reset your password.")},
+			{URL: link, Label: t("This wasn't me")},
+		}
+
+		if nd, ok := ga.IdentityProvider.(email.NewDeviceLogin); ok {
+			ed.Subject, ed.Data = nd.NewDeviceLogin(ctx)
+		}
+	}
+
+	if ed.Subject == "" {
+		return nil, nil
+	}
+	ed.ReplaceLink(link)
+	if err := ed.Parse(req); err != nil {
+		return nil, fmt.Errorf("ga.sendMail: parse error %v", err)
 	}
-	return false, nil
+	msg.Subject, msg.Text, msg.HTML = ed.Subject, ed.TextContent, ed.HTMLContent
+	return msg, nil
 }
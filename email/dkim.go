@@ -0,0 +1,206 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMSigner adds a DKIM-Signature (RFC 6376) with relaxed/relaxed canonicalization, the public
+// key must be published at {Selector}._domainkey.{Domain}.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	// PrivateKey is an *rsa.PrivateKey (rsa-sha256) or ed25519.PrivateKey (ed25519-sha256, RFC 8463)
+	PrivateKey crypto.Signer
+	// Headers are signed when present, defaults to DKIMHeaders
+	Headers []string
+	// Expiration adds x= to the signature when set
+	Expiration time.Duration
+}
+
+// DKIMHeaders are the headers signed by default
+var DKIMHeaders = []string{"From", "To", "Reply-To", "Subject", "Date", "Message-ID", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding", "Auto-Submitted", "List-Unsubscribe", "List-Unsubscribe-Post"}
+
+// NewDKIMSigner parses a PEM encoded PKCS#1 or PKCS#8 RSA or Ed25519 private key
+func NewDKIMSigner(domain, selector string, pemKey []byte) (*DKIMSigner, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, errors.New("NewDKIMSigner: invalid PEM key")
+	}
+	var key interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewDKIMSigner: %v", err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return &DKIMSigner{Domain: domain, Selector: selector, PrivateKey: k}, nil
+	case ed25519.PrivateKey:
+		return &DKIMSigner{Domain: domain, Selector: selector, PrivateKey: k}, nil
+	}
+	return nil, fmt.Errorf("NewDKIMSigner: unsupported key %T", key)
+}
+
+// Sign returns msg, a message with CRLF line endings, with the DKIM-Signature header prepended
+func (d *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	var algo string
+	switch d.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		algo = "rsa-sha256"
+	case ed25519.PrivateKey:
+		algo = "ed25519-sha256"
+	default:
+		return nil, fmt.Errorf("DKIMSigner: unsupported key %T", d.PrivateKey)
+	}
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return nil, errors.New("DKIMSigner: message has no body")
+	}
+	headers := splitHeaders(msg[:i+2])
+	bh := sha256.Sum256(relaxedBody(msg[i+4:]))
+
+	names := d.Headers
+	if len(names) == 0 {
+		names = DKIMHeaders
+	}
+	// headers are picked from the bottom when a name repeats
+	used := make(map[int]bool)
+	var signed []string
+	var hashed bytes.Buffer
+	for _, name := range names {
+		for j := len(headers) - 1; j >= 0; j-- {
+			k, _, _ := strings.Cut(headers[j], ":")
+			if used[j] || !strings.EqualFold(strings.TrimSpace(k), name) {
+				continue
+			}
+			used[j] = true
+			signed = append(signed, strings.ToLower(name))
+			hashed.WriteString(relaxedHeader(headers[j]) + "\r\n")
+			break
+		}
+	}
+
+	now := time.Now()
+	tags := []string{
+		"v=1",
+		"a=" + algo,
+		"c=relaxed/relaxed",
+		"d=" + d.Domain,
+		"s=" + d.Selector,
+		"t=" + strconv.FormatInt(now.Unix(), 10),
+	}
+	if d.Expiration > 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(d.Expiration).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(signed, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bh[:]),
+		"b=",
+	)
+	header := "DKIM-Signature: " + strings.Join(tags, ";\r\n\t")
+	hashed.WriteString(relaxedHeader(header))
+
+	digest := sha256.Sum256(hashed.Bytes())
+	var sig []byte
+	var err error
+	if key, ok := d.PrivateKey.(ed25519.PrivateKey); ok {
+		sig = ed25519.Sign(key, digest[:])
+	} else {
+		sig, err = d.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DKIMSigner: %v", err)
+	}
+	b := base64.StdEncoding.EncodeToString(sig)
+	var folded strings.Builder
+	for len(b) > 72 {
+		folded.WriteString(b[:72] + "\r\n\t")
+		b = b[72:]
+	}
+	folded.WriteString(b)
+
+	out := make([]byte, 0, len(header)+folded.Len()+len(msg)+2)
+	out = append(out, header...)
+	out = append(out, folded.String()...)
+	out = append(out, "\r\n"...)
+	return append(out, msg...), nil
+}
+
+// splitHeaders returns each header with its folded lines
+func splitHeaders(h []byte) []string {
+	var headers []string
+	for _, line := range strings.SplitAfter(string(h), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) > 0 {
+			headers[len(headers)-1] += line
+			continue
+		}
+		headers = append(headers, line)
+	}
+	for i, v := range headers {
+		headers[i] = strings.TrimSuffix(v, "\r\n")
+	}
+	return headers
+}
+
+// relaxedHeader lowercases the name, unfolds and compresses whitespace
+func relaxedHeader(h string) string {
+	k, v, _ := strings.Cut(h, ":")
+	v = strings.NewReplacer("\r\n", "").Replace(v)
+	return strings.ToLower(strings.TrimSpace(k)) + ":" + strings.TrimSpace(compressWSP(v))
+}
+
+// relaxedBody compresses whitespace, removes it at line ends and ignores empty lines at the end
+func relaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(compressWSP(l), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+func compressWSP(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
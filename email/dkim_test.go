@@ -0,0 +1,147 @@
+package email_test
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/altlimit/gauth/email"
+)
+
+// verifyDKIM checks the first DKIM-Signature of msg with relaxed/relaxed canonicalization
+func verifyDKIM(msg string, pub crypto.PublicKey) error {
+	head, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		return errors.New("no body")
+	}
+	var headers []string
+	for _, l := range strings.Split(head, "\r\n") {
+		if strings.HasPrefix(l, " ") || strings.HasPrefix(l, "\t") {
+			headers[len(headers)-1] += "\r\n" + l
+		} else {
+			headers = append(headers, l)
+		}
+	}
+	wsp := regexp.MustCompile(`[ \t]+`)
+	relaxed := func(h string) string {
+		k, v, _ := strings.Cut(h, ":")
+		v = wsp.ReplaceAllString(strings.ReplaceAll(v, "\r\n", ""), " ")
+		return strings.ToLower(strings.TrimSpace(k)) + ":" + strings.TrimSpace(v)
+	}
+	sigHeader := headers[0]
+	if !strings.HasPrefix(sigHeader, "DKIM-Signature:") {
+		return errors.New("missing signature")
+	}
+	tags := make(map[string]string)
+	for _, t := range strings.Split(relaxed(sigHeader)[len("dkim-signature:"):], ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(t), "=")
+		tags[k] = strings.ReplaceAll(v, " ", "")
+	}
+
+	lines := strings.Split(body, "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(wsp.ReplaceAllString(l, " "), " ")
+	}
+	cbody := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if cbody != "" {
+		cbody += "\r\n"
+	}
+	bh := sha256.Sum256([]byte(cbody))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	var data strings.Builder
+	used := make(map[int]bool)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(headers) - 1; i > 0; i-- {
+			k, _, _ := strings.Cut(headers[i], ":")
+			if !used[i] && strings.EqualFold(k, name) {
+				used[i] = true
+				data.WriteString(relaxed(headers[i]) + "\r\n")
+				break
+			}
+		}
+	}
+	data.WriteString(relaxed(regexp.MustCompile(`(;\s*b=)[^;]*$`).ReplaceAllString(sigHeader, "$1")))
+	digest := sha256.Sum256([]byte(data.String()))
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, digest[:], sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+	}
+	return nil
+}
+
+func TestDKIMSigner(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	// body from RFC 8463 with its known body hash
+	msg := "From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n\r\nWe lost the game.  Are you hungry yet?\r\n\r\nJoe.\r\n"
+	table := []struct {
+		name string
+		pem  []byte
+		pub  crypto.PublicKey
+		algo string
+	}{
+		{"rsa", rsaPEM, &rsaKey.PublicKey, "a=rsa-sha256"},
+		{"ed25519", edPEM, edPub, "a=ed25519-sha256"},
+	}
+	for _, v := range table {
+		d, err := email.NewDKIMSigner("football.example.com", "brisbane", v.pem)
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		signed, err := d.Sign([]byte(msg))
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		out := string(signed)
+		if !strings.Contains(out, v.algo) || !strings.Contains(out, "bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=") ||
+			!strings.Contains(out, "h=from:to:subject:date:message-id;") || !strings.HasSuffix(out, msg) {
+			t.Errorf("%s unexpected signature %s", v.name, out)
+		}
+		if err := verifyDKIM(out, v.pub); err != nil {
+			t.Errorf("%s: %v", v.name, err)
+		}
+		// relaxed canonicalization ignores whitespace changes in transit
+		relayed := strings.Replace(out, "Subject: Is dinner ready?", "Subject:  Is dinner\r\n  ready? ", 1)
+		if err := verifyDKIM(relayed, v.pub); err != nil {
+			t.Errorf("%s relayed: %v", v.name, err)
+		}
+		tampered := strings.Replace(out, "We lost", "We won", 1)
+		if err := verifyDKIM(tampered, v.pub); err == nil {
+			t.Errorf("%s wanted tampered body to fail", v.name)
+		}
+	}
+
+	if _, err := email.NewDKIMSigner("a.a", "s", []byte("not a key")); err == nil {
+		t.Error("wanted invalid key error")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"html/template"
 	"strings"
+	"sync"
 )
 
 type (
@@ -18,6 +19,8 @@ type (
 		TextContent string
 		HTMLContent string
 		Data        []Part
+		// Template replaces the default email.Template when provided
+		Template string
 
 		LogoURL     string
 		HeaderURL   string
@@ -37,6 +40,8 @@ type (
 
 var (
 	emailTpl *template.Template
+	// customTpls has the parsed Data.Template by its source, e.g. one per tenant
+	customTpls sync.Map
 )
 
 // Parse populates Text & HTML Content returning an error
@@ -48,11 +53,25 @@ func (e *Data) Parse(data map[string]interface{}) error {
 		}
 		emailTpl = tpl
 	}
+	tpl := emailTpl
+	if e.Template != "" {
+		if t, ok := customTpls.Load(e.Template); ok {
+			tpl = t.(*template.Template)
+		} else {
+			t, err := template.New("email").Parse(e.Template)
+			if err != nil {
+				return fmt.Errorf("emailData.Parse custom template error %v", err)
+			}
+			customTpls.Store(e.Template, t)
+			tpl = t
+		}
+	}
 	var texts []string
 	buf := bytes.NewBufferString("")
 
 	for k, v := range data {
 		vs := fmt.Sprint(v)
+		e.Subject = strings.ReplaceAll(e.Subject, "{"+k+"}", vs)
 		for i, d := range e.Data {
 			e.Data[i].Label = strings.ReplaceAll(d.Label, "{"+k+"}", vs)
 			e.Data[i].P = strings.ReplaceAll(d.P, "{"+k+"}", vs)
@@ -60,7 +79,7 @@ func (e *Data) Parse(data map[string]interface{}) error {
 		}
 	}
 
-	if err := emailTpl.Execute(buf, e); err != nil {
+	if err := tpl.Execute(buf, e); err != nil {
 		return err
 	}
 	for _, d := range e.Data {
@@ -30,4 +30,28 @@ type (
 	LoginEmail interface {
 		LoginEmail(ctx context.Context) (subject string, parts []Part)
 	}
+
+	// {org_name} and {role} are available in OrganizationInvite
+	OrganizationInvite interface {
+		OrganizationInvite(ctx context.Context) (subject string, parts []Part)
+	}
+
+	// Security notifications, {link} locks the account when the change wasn't made by the user
+	PasswordChanged interface {
+		PasswordChanged(ctx context.Context) (subject string, parts []Part)
+	}
+
+	TwoFactorDisabled interface {
+		TwoFactorDisabled(ctx context.Context) (subject string, parts []Part)
+	}
+
+	// {new_email} is available in EmailChangeRequested, it's sent to the current email
+	EmailChangeRequested interface {
+		EmailChangeRequested(ctx context.Context) (subject string, parts []Part)
+	}
+
+	// {ip} and {user_agent} are available in NewDeviceLogin
+	NewDeviceLogin interface {
+		NewDeviceLogin(ctx context.Context) (subject string, parts []Part)
+	}
 )
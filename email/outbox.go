@@ -0,0 +1,242 @@
+package email
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+type (
+	// Message is a queued email
+	Message struct {
+		ID       string    `json:"id"`
+		To       string    `json:"to"`
+		Subject  string    `json:"subject"`
+		Text     string    `json:"text"`
+		HTML     string    `json:"html"`
+		Created  time.Time `json:"created"`
+		Attempts int       `json:"attempts"`
+		// NextAttempt is when the message is due for delivery
+		NextAttempt time.Time `json:"next_attempt"`
+		LastError   string    `json:"last_error,omitempty"`
+	}
+
+	// QueueStore persists messages of an Outbox, see NewMemoryQueue and NewFileQueue
+	QueueStore interface {
+		Enqueue(ctx context.Context, msg *Message) error
+		// Claim returns a message due at now or nil, a claimed message must not be returned
+		// again until it's passed to Done, Retry or DeadLetter.
+		Claim(ctx context.Context, now time.Time) (*Message, error)
+		// Done removes a delivered message
+		Done(ctx context.Context, msg *Message) error
+		// Retry saves the updated Attempts, NextAttempt and LastError and releases the claim
+		Retry(ctx context.Context, msg *Message) error
+		// DeadLetter moves a message that reached the max attempts out of the queue
+		DeadLetter(ctx context.Context, msg *Message) error
+	}
+
+	// Outbox is a Sender that queues messages and delivers them with background workers
+	// so a slow or failing mail server doesn't fail the request that sends it.
+	Outbox struct {
+		// Sender delivers the messages, defaults to your IdentityProvider when used in gauth
+		Sender Sender
+		// Store is required, a MemoryQueue isn't durable and loses queued messages on restart
+		// so use a FileQueue or your own QueueStore in production.
+		Store QueueStore
+		// Workers defaults to 2
+		Workers int
+		// MaxAttempts before a message is dead lettered, defaults to 5
+		MaxAttempts int
+		// Backoff returns the wait before the next attempt, defaults to 10s doubling up to 1 hour
+		Backoff func(attempts int) time.Duration
+		// PollInterval is how often workers check for due retries, defaults to 1 second
+		PollInterval time.Duration
+		// SendTimeout limits each delivery to the Sender so a hung mail server doesn't block
+		// a worker, defaults to 30 seconds
+		SendTimeout time.Duration
+		// OnDeadLetter is called after a message is moved to the dead letters
+		OnDeadLetter func(msg *Message)
+		Logger       *log.Logger
+
+		start    sync.Once
+		stopOnce sync.Once
+		stop     chan struct{}
+		wake     chan struct{}
+		wg       sync.WaitGroup
+	}
+)
+
+var (
+	ErrOutboxStopped = errors.New("outbox stopped")
+)
+
+// NewOutbox returns an outbox with the default settings, call Start before sending
+func NewOutbox(sender Sender, store QueueStore) *Outbox {
+	return &Outbox{
+		Sender: sender,
+		Store:  store,
+	}
+}
+
+// DefaultBackoff waits 10 seconds doubling every attempt up to 1 hour
+func DefaultBackoff(attempts int) time.Duration {
+	d := 10 * time.Second
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// SendEmail queues the message and returns once the store accepted it
+func (o *Outbox) SendEmail(ctx context.Context, toEmail string, subject string, textBody string, htmlBody string) error {
+	if o.wake == nil {
+		return errors.New("outbox: Start must be called before SendEmail")
+	}
+	select {
+	case <-o.stop:
+		return ErrOutboxStopped
+	default:
+	}
+	now := time.Now()
+	msg := &Message{
+		ID:          newMessageID(),
+		To:          toEmail,
+		Subject:     subject,
+		Text:        textBody,
+		HTML:        htmlBody,
+		Created:     now,
+		NextAttempt: now,
+	}
+	if err := o.Store.Enqueue(ctx, msg); err != nil {
+		return err
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Start runs the workers, it's safe to call more than once
+func (o *Outbox) Start() {
+	o.start.Do(func() {
+		if o.Sender == nil || o.Store == nil {
+			panic("outbox: Sender and Store are required")
+		}
+		if o.Workers < 1 {
+			o.Workers = 2
+		}
+		if o.MaxAttempts < 1 {
+			o.MaxAttempts = 5
+		}
+		if o.Backoff == nil {
+			o.Backoff = DefaultBackoff
+		}
+		if o.PollInterval == 0 {
+			o.PollInterval = time.Second
+		}
+		if o.SendTimeout == 0 {
+			o.SendTimeout = 30 * time.Second
+		}
+		if o.Logger == nil {
+			o.Logger = log.Default()
+		}
+		o.stop = make(chan struct{})
+		o.wake = make(chan struct{}, o.Workers)
+		for i := 0; i < o.Workers; i++ {
+			o.wg.Add(1)
+			go o.worker()
+		}
+	})
+}
+
+// Stop waits for the workers to finish their current message or until ctx is done,
+// queued messages are kept in the store.
+func (o *Outbox) Stop(ctx context.Context) error {
+	if o.stop == nil {
+		return nil
+	}
+	o.stopOnce.Do(func() { close(o.stop) })
+	done := make(chan struct{})
+	go func() {
+		o.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (o *Outbox) worker() {
+	defer o.wg.Done()
+	ticker := time.NewTicker(o.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stop:
+			return
+		default:
+		}
+		ctx := context.Background()
+		msg, err := o.Store.Claim(ctx, time.Now())
+		if err != nil {
+			o.Logger.Println("outbox: claim error", err)
+		}
+		if msg != nil {
+			o.deliver(ctx, msg)
+			continue
+		}
+		select {
+		case <-o.stop:
+			return
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) deliver(ctx context.Context, msg *Message) {
+	sctx, cancel := context.WithTimeout(ctx, o.SendTimeout)
+	err := o.Sender.SendEmail(sctx, msg.To, msg.Subject, msg.Text, msg.HTML)
+	cancel()
+	if err == nil {
+		if err := o.Store.Done(ctx, msg); err != nil {
+			o.Logger.Println("outbox: done error", msg.ID, err)
+		}
+		return
+	}
+	msg.Attempts++
+	msg.LastError = err.Error()
+	if msg.Attempts >= o.MaxAttempts {
+		if err := o.Store.DeadLetter(ctx, msg); err != nil {
+			o.Logger.Println("outbox: dead letter error", msg.ID, err)
+			return
+		}
+		if o.OnDeadLetter != nil {
+			o.OnDeadLetter(msg)
+		}
+		return
+	}
+	msg.NextAttempt = time.Now().Add(o.Backoff(msg.Attempts))
+	if err := o.Store.Retry(ctx, msg); err != nil {
+		o.Logger.Println("outbox: retry error", msg.ID, err)
+	}
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,208 @@
+package email_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/altlimit/gauth/email"
+)
+
+type flakySender struct {
+	lock  sync.Mutex
+	fails int
+	calls int
+	sent  []string
+}
+
+func (fs *flakySender) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.calls++
+	if fs.calls <= fs.fails {
+		return errors.New("smtp unavailable")
+	}
+	fs.sent = append(fs.sent, toEmail)
+	return nil
+}
+
+func (fs *flakySender) result() (int, []string) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.calls, append([]string{}, fs.sent...)
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatal("timed out")
+}
+
+func TestOutboxRetry(t *testing.T) {
+	fs := &flakySender{fails: 2}
+	q := email.NewMemoryQueue()
+	ob := email.NewOutbox(fs, q)
+	ob.Backoff = func(int) time.Duration { return time.Millisecond }
+	ob.PollInterval = time.Millisecond
+	ob.Start()
+	defer ob.Stop(context.Background())
+
+	if err := ob.SendEmail(context.Background(), "a@a.a", "Hi", "text", "html"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		_, sent := fs.result()
+		return len(sent) == 1
+	})
+	if calls, _ := fs.result(); calls != 3 {
+		t.Errorf("wanted 3 calls got %d", calls)
+	}
+	waitFor(t, func() bool { return q.Len() == 0 })
+}
+
+func TestOutboxDeadLetter(t *testing.T) {
+	fs := &flakySender{fails: 100}
+	q := email.NewMemoryQueue()
+	dead := make(chan *email.Message, 1)
+	ob := email.NewOutbox(fs, q)
+	ob.MaxAttempts = 3
+	ob.Backoff = func(int) time.Duration { return time.Millisecond }
+	ob.PollInterval = time.Millisecond
+	ob.OnDeadLetter = func(msg *email.Message) { dead <- msg }
+	ob.Start()
+	defer ob.Stop(context.Background())
+
+	if err := ob.SendEmail(context.Background(), "a@a.a", "Hi", "text", "html"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-dead:
+		if msg.Attempts != 3 || msg.LastError != "smtp unavailable" {
+			t.Errorf("wanted 3 attempts got %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wanted dead letter")
+	}
+	if msgs, _ := q.DeadLetters(context.Background()); len(msgs) != 1 || q.Len() != 0 {
+		t.Errorf("wanted 1 dead letter got %d, %d queued", len(msgs), q.Len())
+	}
+}
+
+func TestFileQueue(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	fq, err := email.NewFileQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, id := range []string{"1", "2", "3"} {
+		if err := fq.Enqueue(ctx, &email.Message{ID: id, To: id + "@a.a", Created: now, NextAttempt: now}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msg, _ := fq.Claim(ctx, now)
+	if err := fq.Done(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = fq.Claim(ctx, now)
+	msg.Attempts = 5
+	if err := fq.DeadLetter(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = fq.Claim(ctx, now)
+	msg.NextAttempt = now.Add(time.Hour)
+	if err := fq.Retry(ctx, msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg, _ := fq.Claim(ctx, now); msg != nil {
+		t.Errorf("wanted no due message got %+v", msg)
+	}
+
+	// a crash between write and rename leaves a temp file
+	tmp := filepath.Join(dir, "queue", ".tmp-123")
+	if err := os.WriteFile(tmp, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening keeps the queued and dead messages
+	fq, err = email.NewFileQueue(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("wanted temp file removed got %v", err)
+	}
+	if fq.Len() != 1 {
+		t.Errorf("wanted 1 queued got %d", fq.Len())
+	}
+	if msg, _ := fq.Claim(ctx, now.Add(time.Hour)); msg == nil || !msg.NextAttempt.After(now) {
+		t.Errorf("wanted retried message got %+v", msg)
+	}
+	if msgs, _ := fq.DeadLetters(ctx); len(msgs) != 1 || msgs[0].Attempts != 5 {
+		t.Errorf("wanted 1 dead letter got %v", msgs)
+	}
+}
+
+type hangingSender struct {
+	errs chan error
+}
+
+func (hs *hangingSender) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	<-ctx.Done()
+	hs.errs <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestOutboxSendTimeout(t *testing.T) {
+	hs := &hangingSender{errs: make(chan error, 10)}
+	q := email.NewMemoryQueue()
+	ob := email.NewOutbox(hs, q)
+	ob.SendTimeout = 10 * time.Millisecond
+	ob.Backoff = func(int) time.Duration { return time.Hour }
+	ob.PollInterval = time.Millisecond
+	ob.Start()
+	defer ob.Stop(context.Background())
+
+	if err := ob.SendEmail(context.Background(), "a@a.a", "Hi", "text", "html"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-hs.errs:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("wanted deadline exceeded got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wanted delivery to time out")
+	}
+	// the timed out message is kept for a retry
+	waitFor(t, func() bool { return q.Len() == 1 })
+}
+
+func TestOutboxStopConcurrent(t *testing.T) {
+	ob := email.NewOutbox(&flakySender{}, email.NewMemoryQueue())
+	ob.Start()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ob.Stop(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := ob.SendEmail(context.Background(), "a@a.a", "Hi", "text", "html"); !errors.Is(err, email.ErrOutboxStopped) {
+		t.Errorf("wanted stopped got %v", err)
+	}
+}
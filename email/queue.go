@@ -0,0 +1,269 @@
+package email
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryQueue keeps messages in memory, it's not durable: queued messages and dead letters
+	// are lost on restart or crash. Use it for tests and development, FileQueue otherwise.
+	MemoryQueue struct {
+		lock    sync.Mutex
+		pending map[string]*Message
+		claimed map[string]bool
+		dead    []*Message
+	}
+
+	// FileQueue writes each message as a json file in dir/queue and moves dead letters to
+	// dir/dead, it's meant for a single process and reloads queued messages on start.
+	FileQueue struct {
+		mq   *MemoryQueue
+		dir  string
+		lock sync.Mutex
+	}
+)
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{
+		pending: make(map[string]*Message),
+		claimed: make(map[string]bool),
+	}
+}
+
+func (mq *MemoryQueue) Enqueue(ctx context.Context, msg *Message) error {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	m := *msg
+	mq.pending[msg.ID] = &m
+	return nil
+}
+
+// Claim returns the oldest due message
+func (mq *MemoryQueue) Claim(ctx context.Context, now time.Time) (*Message, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	var next *Message
+	for id, m := range mq.pending {
+		if mq.claimed[id] || m.NextAttempt.After(now) {
+			continue
+		}
+		if next == nil || m.NextAttempt.Before(next.NextAttempt) {
+			next = m
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	mq.claimed[next.ID] = true
+	m := *next
+	return &m, nil
+}
+
+func (mq *MemoryQueue) Done(ctx context.Context, msg *Message) error {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	delete(mq.pending, msg.ID)
+	delete(mq.claimed, msg.ID)
+	return nil
+}
+
+func (mq *MemoryQueue) Retry(ctx context.Context, msg *Message) error {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	m := *msg
+	mq.pending[msg.ID] = &m
+	delete(mq.claimed, msg.ID)
+	return nil
+}
+
+func (mq *MemoryQueue) DeadLetter(ctx context.Context, msg *Message) error {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	delete(mq.pending, msg.ID)
+	delete(mq.claimed, msg.ID)
+	m := *msg
+	mq.dead = append(mq.dead, &m)
+	return nil
+}
+
+// Len returns the number of queued messages including claimed ones
+func (mq *MemoryQueue) Len() int {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	return len(mq.pending)
+}
+
+// DeadLetters returns the messages that reached the max attempts
+func (mq *MemoryQueue) DeadLetters(ctx context.Context) ([]*Message, error) {
+	mq.lock.Lock()
+	defer mq.lock.Unlock()
+	msgs := make([]*Message, len(mq.dead))
+	for i, d := range mq.dead {
+		m := *d
+		msgs[i] = &m
+	}
+	return msgs, nil
+}
+
+// NewFileQueue creates dir if needed and loads the queued messages
+func NewFileQueue(dir string) (*FileQueue, error) {
+	fq := &FileQueue{mq: NewMemoryQueue(), dir: dir}
+	for _, d := range []string{fq.queueDir(), fq.deadDir()} {
+		if err := os.MkdirAll(d, 0700); err != nil {
+			return nil, fmt.Errorf("NewFileQueue: %v", err)
+		}
+		if err := removeTempFiles(d); err != nil {
+			return nil, fmt.Errorf("NewFileQueue: %v", err)
+		}
+	}
+	msgs, err := readMessages(fq.queueDir())
+	if err != nil {
+		return nil, fmt.Errorf("NewFileQueue: %v", err)
+	}
+	for _, m := range msgs {
+		fq.mq.pending[m.ID] = m
+	}
+	return fq, nil
+}
+
+// Enqueue returns after the message is synced to disk
+func (fq *FileQueue) Enqueue(ctx context.Context, msg *Message) error {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	if err := writeMessage(fq.queueDir(), msg); err != nil {
+		return fmt.Errorf("FileQueue.Enqueue: %v", err)
+	}
+	return fq.mq.Enqueue(ctx, msg)
+}
+
+func (fq *FileQueue) Claim(ctx context.Context, now time.Time) (*Message, error) {
+	return fq.mq.Claim(ctx, now)
+}
+
+func (fq *FileQueue) Done(ctx context.Context, msg *Message) error {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	if err := os.Remove(fq.messagePath(fq.queueDir(), msg.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("FileQueue.Done: %v", err)
+	}
+	return fq.mq.Done(ctx, msg)
+}
+
+func (fq *FileQueue) Retry(ctx context.Context, msg *Message) error {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	if err := writeMessage(fq.queueDir(), msg); err != nil {
+		return fmt.Errorf("FileQueue.Retry: %v", err)
+	}
+	return fq.mq.Retry(ctx, msg)
+}
+
+func (fq *FileQueue) DeadLetter(ctx context.Context, msg *Message) error {
+	fq.lock.Lock()
+	defer fq.lock.Unlock()
+	if err := writeMessage(fq.deadDir(), msg); err != nil {
+		return fmt.Errorf("FileQueue.DeadLetter: %v", err)
+	}
+	if err := os.Remove(fq.messagePath(fq.queueDir(), msg.ID)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("FileQueue.DeadLetter: %v", err)
+	}
+	return fq.mq.Done(ctx, msg)
+}
+
+// Len returns the number of queued messages including claimed ones
+func (fq *FileQueue) Len() int {
+	return fq.mq.Len()
+}
+
+// DeadLetters reads the messages in dir/dead oldest first
+func (fq *FileQueue) DeadLetters(ctx context.Context) ([]*Message, error) {
+	return readMessages(fq.deadDir())
+}
+
+func (fq *FileQueue) queueDir() string {
+	return filepath.Join(fq.dir, "queue")
+}
+
+func (fq *FileQueue) deadDir() string {
+	return filepath.Join(fq.dir, "dead")
+}
+
+func (fq *FileQueue) messagePath(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+// writeMessage writes to a temp file and renames it so a crash never leaves a partial message
+func writeMessage(dir string, msg *Message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, msg.ID+".json"))
+}
+
+// removeTempFiles deletes the temp files of writes interrupted by a crash before their rename
+func removeTempFiles(dir string) error {
+	tmps, err := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	if err != nil {
+		return err
+	}
+	for _, tmp := range tmps {
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMessages(dir string) ([]*Message, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := &Message{}
+		if err := json.Unmarshal(b, m); err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name(), err)
+		}
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Created.Before(msgs[j].Created)
+	})
+	return msgs, nil
+}
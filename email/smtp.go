@@ -0,0 +1,360 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// SMTPStartTLS upgrades the connection and fails if the server doesn't support it
+	SMTPStartTLS SMTPSecurity = iota
+	// SMTPImplicitTLS connects with TLS usually on port 465
+	SMTPImplicitTLS
+	// SMTPPlainText never uses TLS, only for local relays
+	SMTPPlainText
+
+	SMTPAuthPlain = "PLAIN"
+	SMTPAuthLogin = "LOGIN"
+)
+
+type (
+	SMTPSecurity int
+
+	// SMTPSender is an email.Sender that sends multipart/alternative messages, the connection is
+	// kept open for IdleTimeout to be reused by the next email.
+	SMTPSender struct {
+		Host string
+		// Port defaults to 587 or 465 with SMTPImplicitTLS
+		Port     int
+		Username string
+		Password string
+		// Auth is SMTPAuthPlain (default) or SMTPAuthLogin, used when Username is provided
+		Auth     string
+		Security SMTPSecurity
+		// TLSConfig defaults to verifying Host
+		TLSConfig *tls.Config
+		// From is the sender address e.g. "App <no-reply@example.com>"
+		From    string
+		ReplyTo string
+		// Timeout of connecting and each email, defaults to 30 seconds
+		Timeout time.Duration
+		// IdleTimeout closes an unused connection, defaults to 30 seconds
+		IdleTimeout time.Duration
+		// DKIM signs messages when provided
+		DKIM *DKIMSigner
+		// ListUnsubscribe is an optional List-Unsubscribe value e.g. "<https://example.com/unsubscribe>",
+		// https links also get one-click List-Unsubscribe-Post.
+		ListUnsubscribe string
+
+		lock     sync.Mutex
+		client   *smtp.Client
+		conn     net.Conn
+		lastUsed time.Time
+	}
+
+	loginAuth struct {
+		username, password, host string
+	}
+)
+
+func NewSMTPSender(host string, port int, username, password, from string) *SMTPSender {
+	return &SMTPSender{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+func (s *SMTPSender) SendEmail(ctx context.Context, toEmail string, subject string, textBody string, htmlBody string) error {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return fmt.Errorf("SMTPSender: invalid From %v", err)
+	}
+	to, err := mail.ParseAddress(toEmail)
+	if err != nil {
+		return fmt.Errorf("SMTPSender: invalid to %v", err)
+	}
+	msg, err := s.message(from, to, subject, textBody, htmlBody)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, err := s.connection(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.send(c, from.Address, to.Address, msg); err != nil {
+		// the connection state is unknown after an error
+		s.close()
+		return fmt.Errorf("SMTPSender: %v", err)
+	}
+	s.lastUsed = time.Now()
+	return nil
+}
+
+// Close ends the reused connection
+func (s *SMTPSender) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.close()
+}
+
+func (s *SMTPSender) send(c *smtp.Client, from, to string, msg []byte) error {
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// connection returns the open connection if it's still usable or dials a new one
+func (s *SMTPSender) connection(ctx context.Context) (*smtp.Client, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	idle := s.IdleTimeout
+	if idle == 0 {
+		idle = 30 * time.Second
+	}
+	if s.client != nil {
+		if time.Since(s.lastUsed) < idle {
+			s.conn.SetDeadline(deadline)
+			if err := s.client.Reset(); err == nil {
+				return s.client, nil
+			}
+		}
+		s.close()
+	}
+
+	port := s.Port
+	if port == 0 {
+		port = 587
+		if s.Security == SMTPImplicitTLS {
+			port = 465
+		}
+	}
+	tlsConfig := s.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: s.Host}
+	}
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(port))
+	dialer := &net.Dialer{Deadline: deadline}
+	var conn net.Conn
+	var err error
+	if s.Security == SMTPImplicitTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SMTPSender: dial %v", err)
+	}
+	conn.SetDeadline(deadline)
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SMTPSender: %v", err)
+	}
+	fail := func(err error) (*smtp.Client, error) {
+		c.Close()
+		return nil, fmt.Errorf("SMTPSender: %v", err)
+	}
+	if s.Security == SMTPStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fail(errors.New("server does not support STARTTLS"))
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return fail(err)
+		}
+	}
+	if s.Username != "" {
+		var auth smtp.Auth
+		switch strings.ToUpper(s.Auth) {
+		case "", SMTPAuthPlain:
+			auth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+		case SMTPAuthLogin:
+			auth = &loginAuth{username: s.Username, password: s.Password, host: s.Host}
+		default:
+			return fail(fmt.Errorf("unsupported auth %s", s.Auth))
+		}
+		if err := c.Auth(auth); err != nil {
+			return fail(err)
+		}
+	}
+	s.client = c
+	s.conn = conn
+	return c, nil
+}
+
+func (s *SMTPSender) close() error {
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Quit()
+	if err != nil {
+		s.client.Close()
+	}
+	s.client = nil
+	s.conn = nil
+	return err
+}
+
+// message builds a multipart/alternative message with a text/plain and text/html part
+func (s *SMTPSender) message(from, to *mail.Address, subject, textBody, htmlBody string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	h := textproto.MIMEHeader{}
+	h.Set("From", from.String())
+	h.Set("To", to.String())
+	if s.ReplyTo != "" {
+		replyTo, err := mail.ParseAddress(s.ReplyTo)
+		if err != nil {
+			return nil, fmt.Errorf("SMTPSender: invalid ReplyTo %v", err)
+		}
+		h.Set("Reply-To", replyTo.String())
+	}
+	h.Set("Subject", mime.QEncoding.Encode("utf-8", subject))
+	h.Set("Date", time.Now().Format(time.RFC1123Z))
+	h.Set("Message-ID", messageID(from.Address))
+	h.Set("MIME-Version", "1.0")
+	// RFC 3834, auto responders shouldn't reply to auth emails
+	h.Set("Auto-Submitted", "auto-generated")
+	if s.ListUnsubscribe != "" {
+		h.Set("List-Unsubscribe", s.ListUnsubscribe)
+		if strings.Contains(s.ListUnsubscribe, "<https://") {
+			h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		}
+	}
+
+	if htmlBody == "" {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		h.Set("Content-Transfer-Encoding", "quoted-printable")
+		writeHeader(buf, h)
+		if err := writeQuotedPrintable(buf, textBody); err != nil {
+			return nil, err
+		}
+		return s.sign(buf.Bytes())
+	}
+
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", textBody},
+		{"text/html; charset=utf-8", htmlBody},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.content); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	h.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	writeHeader(buf, h)
+	buf.Write(body.Bytes())
+	return s.sign(buf.Bytes())
+}
+
+func (s *SMTPSender) sign(msg []byte) ([]byte, error) {
+	if s.DKIM == nil {
+		return msg, nil
+	}
+	return s.DKIM.Sign(msg)
+}
+
+// messageID returns a unique id at the domain of the sender
+func messageID(from string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	domain := "localhost"
+	if i := strings.LastIndex(from, "@"); i >= 0 {
+		domain = from[i+1:]
+	}
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
+
+func writeHeader(buf *bytes.Buffer, h textproto.MIMEHeader) {
+	for _, k := range []string{"From", "To", "Reply-To", "Subject", "Date", "Message-ID", "MIME-Version", "Auto-Submitted",
+		"List-Unsubscribe", "List-Unsubscribe-Post", "Content-Type", "Content-Transfer-Encoding"} {
+		// Values canonicalizes the key while the header keeps its conventional casing e.g. MIME-Version
+		for _, v := range h.Values(k) {
+			// header values are built from parsed addresses and encoded words, this guards any line break
+			v = strings.NewReplacer("\r", "", "\n", "").Replace(v)
+			buf.WriteString(k + ": " + v + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, content string) error {
+	qw := quotedprintable.NewWriter(w)
+	content = strings.ReplaceAll(strings.ReplaceAll(content, "\r\n", "\n"), "\n", "\r\n")
+	if _, err := qw.Write([]byte(content)); err != nil {
+		return err
+	}
+	return qw.Close()
+}
+
+// Start implements the LOGIN mechanism which like smtp.PlainAuth requires TLS except on localhost
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && a.host != "localhost" && a.host != "127.0.0.1" && a.host != "::1" {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return SMTPAuthLogin, nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
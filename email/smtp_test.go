@@ -0,0 +1,278 @@
+package email_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/altlimit/gauth/email"
+)
+
+// smtpStub is an in-process SMTP server that records the messages it receives
+type smtpStub struct {
+	ln       net.Listener
+	tls      *tls.Config
+	implicit bool
+
+	lock     sync.Mutex
+	conns    int
+	auths    []string
+	messages []string
+}
+
+func newSMTPStub(t *testing.T, tlsConfig *tls.Config, implicit bool) *smtpStub {
+	var ln net.Listener
+	var err error
+	if implicit {
+		ln, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpStub{ln: ln, tls: tlsConfig, implicit: implicit}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.lock.Lock()
+			s.conns++
+			s.lock.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return s
+}
+
+func (s *smtpStub) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			io.WriteString(conn, l+"\r\n")
+		}
+	}
+	readLine := func() string {
+		l, _ := r.ReadString('\n')
+		return strings.TrimRight(l, "\r\n")
+	}
+	secure := s.implicit
+	reply("220 stub ready")
+	for {
+		line := readLine()
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			ext := []string{"250-stub", "250-8BITMIME"}
+			if s.tls != nil && !secure {
+				ext = append(ext, "250-STARTTLS")
+			}
+			reply(append(ext, "250 AUTH PLAIN LOGIN")...)
+		case "STARTTLS":
+			reply("220 go ahead")
+			tc := tls.Server(conn, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			conn = tc
+			r = bufio.NewReader(conn)
+			secure = true
+		case "AUTH":
+			args := strings.Fields(line)
+			var auth string
+			if args[1] == "PLAIN" {
+				b, _ := base64.StdEncoding.DecodeString(args[2])
+				auth = "PLAIN " + strings.ReplaceAll(string(b), "\x00", "|")
+			} else {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				u, _ := base64.StdEncoding.DecodeString(readLine())
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				p, _ := base64.StdEncoding.DecodeString(readLine())
+				auth = "LOGIN " + string(u) + "|" + string(p)
+			}
+			s.lock.Lock()
+			s.auths = append(s.auths, auth)
+			s.lock.Unlock()
+			reply("235 ok")
+		case "DATA":
+			reply("354 send")
+			var data []string
+			for {
+				l := readLine()
+				if l == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(l, "."))
+			}
+			s.lock.Lock()
+			s.messages = append(s.messages, strings.Join(data, "\r\n"))
+			s.lock.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		case "":
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func selfSignedTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}, pool
+}
+
+func TestSMTPSender(t *testing.T) {
+	serverTLS, pool := selfSignedTLS(t)
+	clientTLS := &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+	table := []struct {
+		name     string
+		tls      *tls.Config
+		implicit bool
+		security email.SMTPSecurity
+		auth     string
+		wantAuth string
+		wantErr  bool
+	}{
+		{"starttls plain", serverTLS, false, email.SMTPStartTLS, "", "PLAIN |user|pass", false},
+		{"implicit login", serverTLS, true, email.SMTPImplicitTLS, email.SMTPAuthLogin, "LOGIN user|pass", false},
+		{"plaintext local relay", nil, false, email.SMTPPlainText, email.SMTPAuthLogin, "LOGIN user|pass", false},
+		{"starttls required", nil, false, email.SMTPStartTLS, "", "", true},
+	}
+	for _, v := range table {
+		stub := newSMTPStub(t, v.tls, v.implicit)
+		s := email.NewSMTPSender("127.0.0.1", stub.port(), "user", "pass", "App <no-reply@a.a>")
+		s.Security = v.security
+		s.Auth = v.auth
+		s.TLSConfig = clientTLS
+		s.ReplyTo = "support@a.a"
+		ctx := context.Background()
+		err := s.SendEmail(ctx, "to@a.a", "Héllo", "line 1\nline 2", "<p>html</p>")
+		if v.wantErr {
+			if err == nil {
+				t.Errorf("%s wanted error", v.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		if err := s.SendEmail(ctx, "to2@a.a", "Again", "text", ""); err != nil {
+			t.Fatalf("%s: %v", v.name, err)
+		}
+		s.Close()
+
+		stub.lock.Lock()
+		if stub.conns != 1 {
+			t.Errorf("%s wanted connection reuse got %d connections", v.name, stub.conns)
+		}
+		if len(stub.auths) != 1 || stub.auths[0] != v.wantAuth {
+			t.Errorf("%s wanted auth %s got %v", v.name, v.wantAuth, stub.auths)
+		}
+		if len(stub.messages) != 2 {
+			t.Fatalf("%s wanted 2 messages got %d", v.name, len(stub.messages))
+		}
+		raw := stub.messages[0]
+		stub.lock.Unlock()
+
+		msg, err := mail.ReadMessage(strings.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		if subject != "Héllo" || msg.Header.Get("Reply-To") != "<support@a.a>" || msg.Header.Get("From") != `"App" <no-reply@a.a>` {
+			t.Errorf("%s unexpected headers %v", v.name, msg.Header)
+		}
+		if _, err := msg.Header.Date(); err != nil || msg.Header.Get("Auto-Submitted") != "auto-generated" || msg.Header.Get("MIME-Version") != "1.0" || !strings.HasSuffix(msg.Header.Get("Message-ID"), "@a.a>") {
+			t.Errorf("%s unexpected delivery headers %v", v.name, msg.Header)
+		}
+		mediaType, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+		if mediaType != "multipart/alternative" {
+			t.Fatalf("%s wanted multipart/alternative got %s", v.name, mediaType)
+		}
+		mr := multipart.NewReader(msg.Body, params["boundary"])
+		var types []string
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			b, _ := io.ReadAll(p)
+			types = append(types, p.Header.Get("Content-Type")+"="+strconv.Quote(string(b)))
+		}
+		want := []string{`text/plain; charset=utf-8="line 1\r\nline 2"`, `text/html; charset=utf-8="<p>html</p>"`}
+		if strings.Join(types, ",") != strings.Join(want, ",") {
+			t.Errorf("%s wanted parts %v got %v", v.name, want, types)
+		}
+	}
+}
+
+func TestSMTPSenderDKIM(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(rand.Reader)
+	stub := newSMTPStub(t, nil, false)
+	s := email.NewSMTPSender("127.0.0.1", stub.port(), "", "", "no-reply@a.a")
+	s.Security = email.SMTPPlainText
+	s.DKIM = &email.DKIMSigner{Domain: "a.a", Selector: "gauth", PrivateKey: key}
+	s.ListUnsubscribe = "<https://a.a/unsubscribe>"
+	if err := s.SendEmail(context.Background(), "to@a.a", "Signed", "text\n.dot line", "<p>html</p>"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	stub.lock.Lock()
+	raw := stub.messages[0] + "\r\n"
+	stub.lock.Unlock()
+	if err := verifyDKIM(raw, pub); err != nil {
+		t.Fatalf("%v %s", err, raw)
+	}
+	msg, _ := mail.ReadMessage(strings.NewReader(raw))
+	if !strings.Contains(msg.Header.Get("DKIM-Signature"), "list-unsubscribe-post") || msg.Header.Get("List-Unsubscribe-Post") != "List-Unsubscribe=One-Click" {
+		t.Errorf("unexpected headers %v", msg.Header)
+	}
+}
@@ -0,0 +1,204 @@
+package email
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const (
+	ActionVerify      = "verify"
+	ActionEmailUpdate = "emailupdate"
+	ActionReset       = "reset"
+	ActionLogin       = "login"
+	ActionOrgInvite   = "orginvite"
+
+	// security notifications
+	ActionPasswordChanged   = "passwordchanged"
+	ActionTwoFactorDisabled = "2fadisabled"
+	ActionEmailChange       = "emailchange"
+	ActionNewDevice         = "newdevice"
+)
+
+type (
+	// Templates renders emails per action from html/template and text/template sources,
+	// actions without templates use Data with the default Template.
+	Templates struct {
+		layout *htmltemplate.Template
+		// html sources are kept to be parsed again when the layout changes
+		htmlSrc map[string]string
+		html    map[string]*htmltemplate.Template
+		text    map[string]*texttemplate.Template
+	}
+
+	// TemplateData is passed to the action templates, the embedded Data has the brand and theme
+	TemplateData struct {
+		*Data
+		Action  string
+		Link    string
+		Expires time.Time
+		// Locale of the recipient, templates added as {action}.{locale} e.g. verify.es are preferred
+		Locale string
+		// Fields are the identity fields and request values without secrets
+		Fields map[string]interface{}
+	}
+)
+
+func NewTemplates() *Templates {
+	return &Templates{
+		htmlSrc: make(map[string]string),
+		html:    make(map[string]*htmltemplate.Template),
+		text:    make(map[string]*texttemplate.Template),
+	}
+}
+
+// ParseTemplatesFS loads layout.html and for each action {action}.txt and optionally {action}.html
+// e.g. verify.txt and verify.html, translations are named {action}.{locale} e.g. verify.es.txt
+func ParseTemplatesFS(fsys fs.FS) (*Templates, error) {
+	t := NewTemplates()
+	read := func(name string) (string, error) {
+		b, err := fs.ReadFile(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", nil
+		}
+		return string(b), err
+	}
+	layout, err := read("layout.html")
+	if err != nil {
+		return nil, fmt.Errorf("ParseTemplatesFS: %v", err)
+	}
+	if layout != "" {
+		if err := t.SetLayout(layout); err != nil {
+			return nil, err
+		}
+	}
+	names, err := fs.Glob(fsys, "*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("ParseTemplatesFS: %v", err)
+	}
+	for _, name := range names {
+		action := strings.TrimSuffix(path.Base(name), ".txt")
+		text, err := read(name)
+		if err != nil {
+			return nil, fmt.Errorf("ParseTemplatesFS: %v", err)
+		}
+		html, err := read(action + ".html")
+		if err != nil {
+			return nil, fmt.Errorf("ParseTemplatesFS: %v", err)
+		}
+		if err := t.Add(action, html, text); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// SetLayout sets an html layout that renders the action html with {{template "content" .}}
+func (t *Templates) SetLayout(src string) error {
+	layout, err := htmltemplate.New("layout").Parse(src)
+	if err != nil {
+		return fmt.Errorf("Templates.SetLayout: %v", err)
+	}
+	t.layout = layout
+	for action := range t.htmlSrc {
+		if err := t.parseHTML(action); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add parses the templates of an action, text must define a "subject" template and renders the
+// plain text body. html is optional and defines the "content" of the layout or a full document.
+func (t *Templates) Add(action, html, text string) error {
+	tt, err := texttemplate.New(action).Parse(text)
+	if err != nil {
+		return fmt.Errorf("Templates.Add %s text: %v", action, err)
+	}
+	if tt.Lookup("subject") == nil {
+		return fmt.Errorf("Templates.Add %s text: missing {{define \"subject\"}}", action)
+	}
+	t.text[action] = tt
+	delete(t.htmlSrc, action)
+	delete(t.html, action)
+	if html == "" {
+		return nil
+	}
+	if !strings.Contains(html, `{{define "content"}}`) {
+		html = `{{define "content"}}` + html + `{{end}}`
+	}
+	t.htmlSrc[action] = html
+	return t.parseHTML(action)
+}
+
+// parseHTML parses the action html into a copy of the layout so actions don't share definitions
+func (t *Templates) parseHTML(action string) error {
+	var err error
+	ht := htmltemplate.New(action)
+	if t.layout != nil {
+		if ht, err = t.layout.Clone(); err != nil {
+			return err
+		}
+	}
+	if ht, err = ht.Parse(t.htmlSrc[action]); err != nil {
+		return fmt.Errorf("Templates.Add %s html: %v", action, err)
+	}
+	t.html[action] = ht
+	return nil
+}
+
+// Has returns true if action has templates
+func (t *Templates) Has(action string) bool {
+	if t == nil {
+		return false
+	}
+	_, ok := t.text[action]
+	return ok
+}
+
+// Render returns the subject, text and html of action in the Locale of data when available
+func (t *Templates) Render(action string, data *TemplateData) (subject string, text string, html string, err error) {
+	if data.Locale != "" {
+		if _, ok := t.text[action+"."+data.Locale]; ok {
+			action += "." + data.Locale
+		}
+	}
+	tt, ok := t.text[action]
+	if !ok {
+		return "", "", "", fmt.Errorf("Templates.Render: no templates for %s", action)
+	}
+	if data.Data == nil {
+		data.Data = &Data{}
+	}
+	buf := &bytes.Buffer{}
+	if err := tt.ExecuteTemplate(buf, "subject", data); err != nil {
+		return "", "", "", fmt.Errorf("Templates.Render %s subject: %v", action, err)
+	}
+	subject = strings.TrimSpace(buf.String())
+	data.Subject = subject
+	buf.Reset()
+	if err := tt.Execute(buf, data); err != nil {
+		return "", "", "", fmt.Errorf("Templates.Render %s text: %v", action, err)
+	}
+	text = strings.TrimSpace(buf.String())
+
+	ht, ok := t.html[action]
+	if !ok {
+		return subject, text, "", nil
+	}
+	buf.Reset()
+	name := "content"
+	if t.layout != nil {
+		name = "layout"
+	}
+	if err := ht.ExecuteTemplate(buf, name, data); err != nil {
+		return "", "", "", fmt.Errorf("Templates.Render %s html: %v", action, err)
+	}
+	return subject, text, buf.String(), nil
+}
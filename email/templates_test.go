@@ -0,0 +1,75 @@
+package email_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/altlimit/gauth/email"
+)
+
+func TestTemplates(t *testing.T) {
+	fsys := fstest.MapFS{
+		"layout.html":  {Data: []byte(`<html><body style="color:{{.Primary}}">{{template "content" .}}</body></html>`)},
+		"verify.txt":   {Data: []byte(`{{define "subject"}}Verify {{.Fields.name}}{{end}}Open {{.Link}} before {{.Expires.Format "2006"}}`)},
+		"verify.html":  {Data: []byte(`<a href="{{.Link}}">{{.Subject}} &amp; {{.Fields.name}}</a>`)},
+		"reset.txt":    {Data: []byte(`{{define "subject"}}Reset{{end}}{{.Link}}`)},
+		"reset.es.txt": {Data: []byte(`{{define "subject"}}Restablecer{{end}}{{.Link}}`)},
+	}
+	tpls, err := email.ParseTemplatesFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tpls.Has(email.ActionVerify) || !tpls.Has(email.ActionReset) || tpls.Has(email.ActionLogin) {
+		t.Fatal("wanted verify and reset templates only")
+	}
+	data := &email.TemplateData{
+		Data:    &email.Data{Primary: "#fff"},
+		Link:    "http://a.a/?t=1&x=2",
+		Expires: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		Fields:  map[string]interface{}{"name": "<b>Jo</b>"},
+	}
+	subject, text, html, err := tpls.Render(email.ActionVerify, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Verify <b>Jo</b>" {
+		t.Errorf("unexpected subject %s", subject)
+	}
+	if text != "Open http://a.a/?t=1&x=2 before 2030" {
+		t.Errorf("unexpected text %s", text)
+	}
+	want := `<html><body style="color:#fff"><a href="http://a.a/?t=1&amp;x=2">Verify &lt;b&gt;Jo&lt;/b&gt; &amp; &lt;b&gt;Jo&lt;/b&gt;</a></body></html>`
+	if html != want {
+		t.Errorf("wanted %s got %s", want, html)
+	}
+	if _, _, html, _ := tpls.Render(email.ActionReset, &email.TemplateData{Link: "x"}); html != "" {
+		t.Errorf("wanted text only got %s", html)
+	}
+	for locale, want := range map[string]string{"es": "Restablecer", "fr": "Reset", "": "Reset"} {
+		if subject, _, _, _ := tpls.Render(email.ActionReset, &email.TemplateData{Link: "x", Locale: locale}); subject != want {
+			t.Errorf("%s wanted %s got %s", locale, want, subject)
+		}
+	}
+
+	if err := email.NewTemplates().Add("login", "", "no subject"); err == nil || !strings.Contains(err.Error(), "subject") {
+		t.Errorf("wanted missing subject error got %v", err)
+	}
+}
+
+func TestDataCustomTemplate(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		ed := &email.Data{Subject: "Hi {name}", Template: `<b>{{.Subject}}</b>`}
+		if err := ed.Parse(map[string]interface{}{"name": "A"}); err != nil {
+			t.Fatal(err)
+		}
+		if ed.HTMLContent != "<b>Hi A</b>" {
+			t.Errorf("wanted custom template got %s", ed.HTMLContent)
+		}
+	}
+	ed := &email.Data{Template: `{{.Subject`}
+	if err := ed.Parse(nil); err == nil {
+		t.Error("wanted parse error")
+	}
+}
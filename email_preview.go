@@ -0,0 +1,241 @@
+package gauth
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// RenderedEmail is an email as it would be sent
+	RenderedEmail struct {
+		Action  string `json:"action"`
+		Locale  string `json:"locale"`
+		To      string `json:"to"`
+		Subject string `json:"subject"`
+		Text    string `json:"text"`
+		HTML    string `json:"html"`
+	}
+)
+
+// previewExpires is the fixed expiry of links in previews so renders are reproducible
+var previewExpires = time.Date(2030, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+// EmailActions returns the actions of the emails that can be sent with the current settings
+func (ga *GAuth) EmailActions() []string {
+	var actions []string
+	if ga.PasswordFieldID == "" {
+		actions = append(actions, actionLogin)
+	} else {
+		actions = append(actions, actionVerify, actionReset)
+	}
+	actions = append(actions, actionEmailUpdate)
+	if ga.organizationProvider != nil {
+		actions = append(actions, actionOrgInvite)
+	}
+	if !ga.DisableSecurityNotifications {
+		if ga.PasswordFieldID != "" {
+			actions = append(actions, actionPasswordChanged)
+			if !ga.disable2FA {
+				actions = append(actions, actionTwoFactorDisabled)
+			}
+		}
+		actions = append(actions, actionEmailChange)
+		if ga.DeviceCookieName != "" {
+			actions = append(actions, actionNewDevice)
+		}
+	}
+	return actions
+}
+
+// sampleIdentity returns identity data with the values placeholders of every email use
+func (ga *GAuth) sampleIdentity(locale string) map[string]interface{} {
+	data := make(map[string]interface{})
+	for _, f := range ga.Fields {
+		switch {
+		case f.ID == ga.PasswordFieldID || f.Type == "password":
+		case f.ID == ga.EmailFieldID || f.Type == "email":
+			data[f.ID] = "jane@example.com"
+		case f.Type == "checkbox":
+			data[f.ID] = true
+		case len(f.Options) > 0:
+			data[f.ID] = f.Options[len(f.Options)-1].ID
+		case strings.Contains(f.ID, "name"):
+			data[f.ID] = "Jane Doe"
+		default:
+			data[f.ID] = f.Label
+		}
+	}
+	data["org"] = "org_1"
+	data["org_name"] = "Acme"
+	data["role"] = RoleMember
+	data["new_email"] = "jane.doe@example.com"
+	data["ip"] = "203.0.113.7"
+	data["user_agent"] = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36"
+	if ga.LocaleFieldID != "" {
+		data[ga.LocaleFieldID] = locale
+	}
+	return data
+}
+
+// PreviewEmail renders the email of action in locale with sample identity data and a
+// placeholder link, it returns nil when a custom email of action has no subject.
+func (ga *GAuth) PreviewEmail(ctx context.Context, action string, locale string) (*RenderedEmail, error) {
+	if ga.EmailFieldID == "" {
+		return nil, fmt.Errorf("PreviewEmail: EmailFieldID is required")
+	}
+	locale = ga.I18n.Match(locale)
+	ctx = context.WithValue(ctx, LocaleKey, locale)
+	act, actPath := ga.mailAction(action)
+	link := ga.mailBaseURL(ctx) + actPath + "?a=" + act + "&t=preview"
+	return ga.composeMail(ctx, action, link, previewExpires, ga.sampleIdentity(locale))
+}
+
+// PreviewEmails renders every email of EmailActions for each locale, defaults to all languages of I18n
+func (ga *GAuth) PreviewEmails(ctx context.Context, locales ...string) ([]*RenderedEmail, error) {
+	if len(locales) == 0 {
+		locales = ga.I18n.Languages()
+	}
+	var emails []*RenderedEmail
+	for _, locale := range locales {
+		for _, action := range ga.EmailActions() {
+			msg, err := ga.PreviewEmail(ctx, action, locale)
+			if err != nil {
+				return nil, fmt.Errorf("PreviewEmails: %s %s: %v", locale, action, err)
+			}
+			if msg != nil {
+				emails = append(emails, msg)
+			}
+		}
+	}
+	return emails, nil
+}
+
+// WriteEmailPreviews writes the PreviewEmails of locales to {dir}/{locale}/{action}.html and .txt
+func (ga *GAuth) WriteEmailPreviews(ctx context.Context, dir string, locales ...string) error {
+	emails, err := ga.PreviewEmails(ctx, locales...)
+	if err != nil {
+		return err
+	}
+	for _, msg := range emails {
+		ld := filepath.Join(dir, msg.Locale)
+		if err := os.MkdirAll(ld, 0755); err != nil {
+			return fmt.Errorf("WriteEmailPreviews: %v", err)
+		}
+		text := "Subject: " + msg.Subject + "\n\n" + msg.Text
+		if err := os.WriteFile(filepath.Join(ld, msg.Action+".txt"), []byte(text), 0644); err != nil {
+			return fmt.Errorf("WriteEmailPreviews: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(ld, msg.Action+".html"), []byte(msg.HTML), 0644); err != nil {
+			return fmt.Errorf("WriteEmailPreviews: %v", err)
+		}
+	}
+	return nil
+}
+
+var emailPreviewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Email Preview</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.cols { display: flex; gap: 1em; }
+.cols > * { flex: 1; min-width: 0; border: 1px solid #ccc; height: 80vh; margin: 0; }
+pre { overflow: auto; white-space: pre-wrap; padding: 1em; }
+</style>
+</head>
+<body>
+<ul>
+{{- range $a := .Actions}}
+<li>{{$a}}:{{range $l := $.Locales}} <a href="?action={{$a}}&lang={{$l}}">{{$l}}</a>{{end}}</li>
+{{- end}}
+</ul>
+{{with .Email}}
+<h3>{{.Subject}}</h3>
+<p>To: {{.To}} | <a href="?action={{.Action}}&lang={{.Locale}}&format=html">html</a> | <a href="?action={{.Action}}&lang={{.Locale}}&format=text">text</a></p>
+{{if $.CanSend}}
+<form method="post">
+<input type="hidden" name="action" value="{{.Action}}"><input type="hidden" name="lang" value="{{.Locale}}">
+<input type="email" name="to" placeholder="Send a test to" required> <button type="submit">Send</button>
+{{if $.Sent}} Sent to {{$.Sent}}{{end}}
+</form>
+{{end}}
+<div class="cols">
+<iframe srcdoc="{{.HTML}}"></iframe>
+<pre>{{.Text}}</pre>
+</div>
+{{end}}
+</body>
+</html>`))
+
+// emailPreviewHandler lists the emails and renders the selected one as HTML and text side by side,
+// posting a "to" address sends it with the configured EmailSender.
+func (ga *GAuth) emailPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			ga.validationError(w, "form", "invalid")
+			return
+		}
+		q = r.PostForm
+	}
+	ctx := context.WithValue(r.Context(), RequestKey, r)
+	data := struct {
+		Actions []string
+		Locales []string
+		Email   *RenderedEmail
+		CanSend bool
+		Sent    string
+	}{
+		Actions: ga.EmailActions(),
+		Locales: ga.I18n.Languages(),
+		CanSend: ga.emailSender != nil,
+	}
+	if action := q.Get("action"); action != "" {
+		found := false
+		for _, a := range data.Actions {
+			found = found || a == action
+		}
+		if !found {
+			ga.validationError(w, "action", "invalid")
+			return
+		}
+		msg, err := ga.PreviewEmail(ctx, action, q.Get("lang"))
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		if msg == nil {
+			ga.writeJSON(http.StatusNotFound, w, errorResponse{Error: "custom email has no subject"})
+			return
+		}
+		switch q.Get("format") {
+		case "html":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(msg.HTML))
+			return
+		case "text":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte("Subject: " + msg.Subject + "\n\n" + msg.Text))
+			return
+		}
+		if to := q.Get("to"); to != "" && r.Method == http.MethodPost && data.CanSend {
+			if err := ga.emailSender.SendEmail(ctx, to, msg.Subject, msg.Text, msg.HTML); err != nil {
+				ga.internalError(w, err)
+				return
+			}
+			data.Sent = to
+		}
+		data.Email = msg
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := emailPreviewTemplate.Execute(w, data); err != nil {
+		ga.log("emailPreviewHandler", err)
+	}
+}
@@ -0,0 +1,186 @@
+package gauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrTokenUsed is returned by EmailTokenProvider when the link of an email was already used
+	ErrTokenUsed = errors.New("link already used")
+	// ErrTokenExpired is returned for links of emails past their expiry
+	ErrTokenExpired = errors.New("link expired")
+
+	errInvalidEmailToken = errors.New("invalid email token")
+)
+
+const (
+	// actions of the pages that stale email links redirect to
+	actionLinkUsed    = "linkused"
+	actionLinkExpired = "linkexpired"
+
+	// usedSweepEvery is how many uses of email links the default provider sweeps expired ones
+	usedSweepEvery = 1000
+)
+
+type (
+	// Optionally implement this to share used email links between instances, links of emails
+	// can only be used once. Defaults to an in memory list of used links kept until they expire.
+	EmailTokenProvider interface {
+		// EmailTokenUse marks the id of a link used until it expires, it must return ErrTokenUsed
+		// when it already was.
+		EmailTokenUse(ctx context.Context, jti string, expires time.Time) error
+		// EmailTokenUsed returns true if the id of a link was used
+		EmailTokenUsed(ctx context.Context, jti string) (bool, error)
+	}
+
+	// DefaultEmailTokenProvider keeps every used link until it expires, expired ones are swept
+	// every usedSweepEvery uses so its size is bound by the links used within their expiry.
+	DefaultEmailTokenProvider struct {
+		lock  sync.Mutex
+		used  map[string]time.Time
+		calls int
+	}
+)
+
+func NewDefaultEmailTokenProvider() *DefaultEmailTokenProvider {
+	return &DefaultEmailTokenProvider{used: make(map[string]time.Time)}
+}
+
+func (de *DefaultEmailTokenProvider) EmailTokenUse(ctx context.Context, jti string, expires time.Time) error {
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	now := time.Now()
+	de.calls++
+	if de.calls%usedSweepEvery == 0 {
+		for k, exp := range de.used {
+			if !exp.After(now) {
+				delete(de.used, k)
+			}
+		}
+	}
+	if exp, ok := de.used[jti]; ok && exp.After(now) {
+		return ErrTokenUsed
+	}
+	de.used[jti] = expires
+	return nil
+}
+
+func (de *DefaultEmailTokenProvider) EmailTokenUsed(ctx context.Context, jti string) (bool, error) {
+	de.lock.Lock()
+	defer de.lock.Unlock()
+	exp, ok := de.used[jti]
+	return ok && exp.After(time.Now()), nil
+}
+
+// emailTokenExpiry returns how long the link in the email of action can be used
+func (ga *GAuth) emailTokenExpiry(action string) time.Duration {
+	switch {
+	case action == actionLogin && ga.Timeout.LoginLink > 0:
+		return ga.Timeout.LoginLink
+	case action == actionReset && ga.Timeout.ResetLink > 0:
+		return ga.Timeout.ResetLink
+	}
+	return ga.Timeout.EmailToken
+}
+
+// staleEmailToken returns ErrTokenExpired or ErrTokenUsed when the link of tok can't be used anymore,
+// the signature isn't verified since nothing is granted with it.
+func (ga *GAuth) staleEmailToken(ctx context.Context, tok string) error {
+	claims, err := unverifiedClaims(tok)
+	if err != nil {
+		return nil
+	}
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(time.Now()) {
+		return ErrTokenExpired
+	}
+	if jti := toString(claims["jti"]); jti != "" {
+		used, err := ga.emailTokenProvider.EmailTokenUsed(ctx, jti)
+		if err != nil {
+			return err
+		}
+		if used {
+			return ErrTokenUsed
+		}
+	}
+	return nil
+}
+
+// verifyEmailToken returns the claims of the token of an email link for act, key is appended
+// to the JwtKey like in mailLink. Use the link with useEmailToken once it's accepted.
+func (ga *GAuth) verifyEmailToken(ctx context.Context, tok, key, act string) (map[string]string, error) {
+	if err := ga.staleEmailToken(ctx, tok); err != nil {
+		return nil, err
+	}
+	claims, err := ga.tokenClaims(tok, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidEmailToken, err)
+	}
+	result := make(map[string]string)
+	for k, v := range claims {
+		if vs, ok := v.(string); ok {
+			result[k] = vs
+		}
+	}
+	exp, _ := claims["exp"].(float64)
+	if result["act"] != act || result["jti"] == "" || exp == 0 {
+		return nil, fmt.Errorf("%w: claims of %s", errInvalidEmailToken, act)
+	}
+	result["exp"] = strconv.FormatInt(int64(exp), 10)
+	return result, nil
+}
+
+// useEmailToken marks the link of verified claims used, it returns ErrTokenUsed if it already was
+func (ga *GAuth) useEmailToken(ctx context.Context, claims map[string]string) error {
+	exp, _ := strconv.ParseInt(claims["exp"], 10, 64)
+	return ga.emailTokenProvider.EmailTokenUse(ctx, claims["jti"], time.Unix(exp, 0))
+}
+
+// emailTokenClaims verifies and uses the token of an email link for act
+func (ga *GAuth) emailTokenClaims(ctx context.Context, tok, key, act string) (map[string]string, error) {
+	claims, err := ga.verifyEmailToken(ctx, tok, key, act)
+	if err != nil {
+		return nil, err
+	}
+	if err := ga.useEmailToken(ctx, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// emailTokenError writes 410 Gone for used or expired links so the client can show why
+func (ga *GAuth) emailTokenError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrTokenUsed), errors.Is(err, ErrTokenExpired):
+		ga.writeJSON(http.StatusGone, w, errorResponse{Error: err.Error()})
+	case errors.Is(err, errInvalidEmailToken):
+		ga.log("email token error", err)
+		ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+	default:
+		ga.internalError(w, err)
+	}
+}
+
+// staleLinkRedirect sends pages opened from used or expired email links to a page that explains it
+func (ga *GAuth) staleLinkRedirect(w http.ResponseWriter, r *http.Request) bool {
+	tok := r.URL.Query().Get("t")
+	if tok == "" {
+		return false
+	}
+	switch err := ga.staleEmailToken(r.Context(), tok); {
+	case err == nil:
+		return false
+	case errors.Is(err, ErrTokenUsed):
+		http.Redirect(w, r, ga.Path.Base+ga.Path.Login+"?a="+actionLinkUsed, http.StatusSeeOther)
+	case errors.Is(err, ErrTokenExpired):
+		http.Redirect(w, r, ga.Path.Base+ga.Path.Login+"?a="+actionLinkExpired, http.StatusSeeOther)
+	default:
+		ga.internalError(w, err)
+	}
+	return true
+}
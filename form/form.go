@@ -5,10 +5,13 @@ import (
 	"compress/gzip"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
 	"strings"
+
+	"github.com/altlimit/gauth/captcha"
 )
 
 //go:generate go run ../cmd/assets/main.go
@@ -27,12 +30,21 @@ type (
 	ValidateFunc func(fieldID string, data map[string]interface{}) error
 	Config       struct {
 		AlpineJSURL string
-		Recaptcha   string
-		Brand       Brand
-		Path        Path
+		Captcha     *captcha.Widget
+		// CaptchaOnDemand only renders the captcha after a response asks for it
+		CaptchaOnDemand bool
+		// CSRFToken is sent in the CSRFHeader of every request
+		CSRFToken  string
+		CSRFHeader string
+		// Nonce is the Content-Security-Policy nonce of the inline styles and scripts
+		Nonce string
+		Brand Brand
+		Path  Path
 
 		Title       string
 		Description string
+		// Message is shown under the title, pages without Submit have no form button
+		Message string
 
 		Tab  string
 		Tabs []string
@@ -41,6 +53,12 @@ type (
 		Fields []*Field
 
 		Submit string
+
+		// Locale is the language of the page, Translate and Messages are its catalog for the
+		// server rendered labels and the client side messages.
+		Locale    string
+		Translate func(string) string
+		Messages  map[string]string
 	}
 
 	Link struct {
@@ -108,6 +126,34 @@ func Render(w http.ResponseWriter, c *Config) (err error) {
 	return formTpl.ExecuteTemplate(w, "layout", c)
 }
 
+// T translates msg with Translate or returns it as is
+func (c *Config) T(msg string) string {
+	if c.Translate == nil {
+		return msg
+	}
+	return c.Translate(msg)
+}
+
+// MessagesJSON is the catalog used by the client to translate alerts and validation errors
+func (c *Config) MessagesJSON() string {
+	if len(c.Messages) == 0 {
+		return "{}"
+	}
+	b, err := json.Marshal(c.Messages)
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
+
+// Lang returns the html lang attribute
+func (c *Config) Lang() string {
+	if c.Locale == "" {
+		return "en"
+	}
+	return c.Locale
+}
+
 func eTag(b []byte) string {
 	hasher := md5.New()
 	hasher.Write(b)
@@ -19,8 +19,10 @@ import (
 	"time"
 
 	"github.com/altlimit/gauth/cache"
+	"github.com/altlimit/gauth/captcha"
 	"github.com/altlimit/gauth/email"
 	"github.com/altlimit/gauth/form"
+	"github.com/altlimit/gauth/i18n"
 	"github.com/altlimit/gauth/structtag"
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -32,6 +34,9 @@ const (
 	FieldRecoveryCodesID = "recoverycodes"
 	FieldRememberID      = "remember"
 	FieldTermsID         = "terms"
+	FieldAPIKeysID       = "apikeys"
+	FieldOrganizationsID = "organizations"
+	FieldCaptchaID       = "captcha"
 )
 
 type (
@@ -57,7 +62,13 @@ type (
 
 		// By default this uses embedded alpineJS
 		AlpineJSURL string
-		// Provide a secret to activate recaptcha in register
+		// Captcha is verified on CaptchaFlows, see the captcha package for the providers
+		Captcha captcha.Captcha
+		// CaptchaFlows defaults to FlowRegister, FlowLogin, FlowResetLink and FlowConfirmEmail can be added
+		CaptchaFlows []string
+		// AdaptiveCaptcha requires Captcha on logins only after failures or from new devices
+		AdaptiveCaptcha AdaptiveCaptcha
+		// Provide a secret to use reCAPTCHA v2 as Captcha
 		RecaptchaSiteKey string
 		RecaptchaSecret  string
 		// JwtKey used for registration and token login
@@ -68,6 +79,12 @@ type (
 		RefreshTokenCookieName string
 		// AccessTokenCookieName default is blank, enable to set access token on /
 		AccessTokenCookieName string
+		// CSRF protects requests authenticated by the cookies above
+		CSRF CSRF
+		// SecurityHeaders sets the Content-Security-Policy and framing headers of pages
+		SecurityHeaders SecurityHeaders
+		// Cookies sets the domain, SameSite, Secure, name prefix and partitioning of all cookies
+		Cookies Cookies
 
 		// Page branding
 		Brand form.Brand
@@ -78,37 +95,103 @@ type (
 		// defaults to "gauth"
 		StructTag string
 
+		// I18n translates forms, validation messages and emails, defaults to i18n.NewBundle()
+		I18n *i18n.Bundle
+		// LocaleFieldID is an optional identity field with the preferred language of the recipient of emails
+		LocaleFieldID string
+		// LocaleCookieName remembers the language picked with ?lang=, defaults to lang
+		LocaleCookieName string
+
+		// DisableSecurityNotifications stops emails about password, 2FA and email changes and new device logins
+		DisableSecurityNotifications bool
+		// DeviceCookieName remembers browsers that logged in to notify logins from new devices,
+		// defaults to gdevice, set to "-" to disable new device notifications
+		DeviceCookieName string
+
+		// EmailTemplates replaces the default email of the actions it has templates for
+		EmailTemplates *email.Templates
+
+		// EmailOutbox queues emails delivered by background workers instead of sending them
+		// during the request, its Sender defaults to your IdentityProvider.
+		EmailOutbox *email.Outbox
+
+		// IdentityCache caches IdentityLoad per uid, disabled by default
+		IdentityCache IdentityCache
+
+		// Roles that can be assigned to organization members, defaults to owner, admin and member
+		OrganizationRoles []string
+
+		// TenantProvider enables serving multiple organizations with their own brand, fields and keys,
+		// TenantResolver is required with it to find the tenant of a request.
+		TenantProvider TenantProvider
+		TenantResolver TenantResolver
+
+		// TrustedProxies are CIDRs or ips of your load balancers, forwarding headers are only
+		// used from these addresses. Ignored when ClientIP is provided.
+		TrustedProxies []string
+		// ForwardedHeader is the only header read from TrustedProxies for the client ip, defaults to
+		// X-Forwarded-For, set Forwarded for RFC 7239 proxies.
+		ForwardedHeader string
+		// ClientIP extracts the client ip of a request, defaults to IPFromTrustedProxies(ForwardedHeader, TrustedProxies...)
+		// use IPFromHeader("X-Appengine-User-Ip") for app engine or similar platforms.
+		ClientIP IPExtractor
+
 		rateLimiter          cache.RateLimiter
 		emailSender          email.Sender
 		refreshTokenProvider RefreshTokenProvider
+		emailTokenProvider   EmailTokenProvider
 		accessTokenProvider  AccessTokenProvider
-		lru                  *cache.LRUCache
+		impersonator         ImpersonationProvider
+		apiKeyProvider       APIKeyProvider
+		clientProvider       ClientProvider
+		organizationProvider OrganizationProvider
+		tenant               *Tenant
+		lru                  *cache.LRU[string, bool]
+		identityCache        *cache.LRU[string, Identity]
 		disable2FA           bool
 		disableRecovery      bool
 		debug                bool
 	}
 
 	RateLimit struct {
-		Login        cache.Rate
-		Register     cache.Rate
-		ResetLink    cache.Rate
+		// per identity, also per client of the client credentials grant
+		Login cache.Rate
+		// per ip
+		Register cache.Rate
+		// per identity
+		ResetLink cache.Rate
+		// per identity
 		ConfirmEmail cache.Rate
+
+		// Rules are additional limits per flow (FlowLogin, FlowRegister, etc) evaluated together
+		// with the rates above, defaults to 100 logins per hour per ip.
+		Rules map[string][]RateRule
+		// IPv6Prefix groups IPv6 addresses by subnet for per ip limits, defaults to 64
+		IPv6Prefix int
 	}
 
 	Timeout struct {
-		// 7 days default
+		// 7 days default, links of emails without their own timeout below
 		EmailToken time.Duration
+		// 15 minutes default, passwordless login links
+		LoginLink time.Duration
+		// 1 hour default, password reset links
+		ResetLink time.Duration
 		// 1 day default
 		RefreshToken time.Duration
 		// 7 days default
 		RefreshTokenRemember time.Duration
 		// 1 hour default
 		AccessToken time.Duration
+		// 15 minutes default
+		Impersonation time.Duration
 	}
 
 	errorResponse struct {
 		Error string            `json:"error"`
 		Data  map[string]string `json:"data,omitempty"`
+		// seconds remaining for rate limited responses
+		RetryAfter int `json:"retry_after,omitempty"`
 	}
 )
 
@@ -165,7 +248,20 @@ func NewPasswordless(appName string, appURL string, ap IdentityProvider) *GAuth
 }
 
 func (ga *GAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path[len(ga.Path.Base):]
+	tga, path, r, err := ga.tenantRequest(r)
+	if err != nil {
+		ga.tenantError(w, r, err)
+		return
+	}
+	tga.securityHeaders(w, r)
+	if err := tga.checkCSRF(r); err != nil {
+		tga.csrfError(w, err)
+		return
+	}
+	tga.route(w, tga.withLocale(w, r), strings.TrimPrefix(path, ga.Path.Base))
+}
+
+func (ga *GAuth) route(w http.ResponseWriter, r *http.Request, path string) {
 	switch path {
 	case ga.Path.Login:
 		ga.loginHandler(w, r)
@@ -183,7 +279,8 @@ func (ga *GAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if ga.debug && path == "/email-template" {
-			ga.emailHandler(w, r)
+			ga.emailPreviewHandler(w, r)
+			return
 		}
 		notFound := http.StatusText(http.StatusNotFound)
 		if ga.isJson(r) {
@@ -195,7 +292,7 @@ func (ga *GAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ga *GAuth) emailData() *email.Data {
-	return &email.Data{
+	ed := &email.Data{
 		HeaderLabel:    ga.Brand.AppName,
 		HeaderURL:      ga.Brand.AppURL,
 		FooterLabel:    ga.Brand.AppName,
@@ -205,14 +302,36 @@ func (ga *GAuth) emailData() *email.Data {
 		Accent:         ga.Brand.Accent,
 		Neutral:        ga.Brand.Neutral,
 	}
+	if ga.tenant != nil {
+		ed.Template = ga.tenant.EmailTemplate
+	}
+	return ed
 }
 
-func (ga *GAuth) formConfig() *form.Config {
-	return &form.Config{
+func (ga *GAuth) emailTemplates() *email.Templates {
+	if ga.tenant != nil && ga.tenant.EmailTemplates != nil {
+		return ga.tenant.EmailTemplates
+	}
+	return ga.EmailTemplates
+}
+
+func (ga *GAuth) formConfig(w http.ResponseWriter, r *http.Request) *form.Config {
+	fc := &form.Config{
 		Brand:       ga.Brand,
 		Path:        ga.Path,
 		AlpineJSURL: ga.AlpineJSURL,
+		CSRFToken:   ga.csrfToken(w, r),
+		CSRFHeader:  ga.CSRF.HeaderName,
+		Nonce:       newNonce(),
+	}
+	if locale := LocaleFromContext(r.Context()); locale != "" && ga.I18n != nil {
+		fc.Locale = locale
+		fc.Messages = ga.I18n.Catalog(locale)
+		fc.Translate = func(msg string) string {
+			return ga.I18n.T(locale, msg)
+		}
 	}
+	return fc
 }
 
 func (ga *GAuth) fieldByID(id string) *form.Field {
@@ -239,6 +358,18 @@ func (ga *GAuth) accountFields() ([]string, []*form.Field) {
 		}
 	}
 
+	if ga.apiKeyProvider != nil {
+		tab = "API Keys"
+		tabs = append(tabs, tab)
+		fields = append(fields, &form.Field{ID: FieldAPIKeysID, Type: "apikeys", SettingsTab: tab})
+	}
+
+	if ga.organizationProvider != nil {
+		tab = "Organizations"
+		tabs = append(tabs, tab)
+		fields = append(fields, &form.Field{ID: FieldOrganizationsID, Type: "organizations", SettingsTab: tab, Options: ga.roleOptions()})
+	}
+
 	for _, f := range ga.Fields {
 		tab = strings.Split(f.SettingsTab, ",")[0]
 		if tab != "" {
@@ -258,6 +389,16 @@ func (ga *GAuth) accountFields() ([]string, []*form.Field) {
 	return tabs, fields
 }
 
+func (ga *GAuth) roleOptions() (options []form.Option) {
+	for _, r := range ga.OrganizationRoles {
+		if r == "" {
+			continue
+		}
+		options = append(options, form.Option{ID: r, Label: strings.ToUpper(r[:1]) + r[1:]})
+	}
+	return
+}
+
 func (ga *GAuth) registerFields() (fields []*form.Field) {
 	for _, f := range ga.Fields {
 		// Accounts,only <-- meaning not included in register form
@@ -344,7 +485,7 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 		if !validIDRe.MatchString(f.ID) {
 			panic("invalid field " + f.ID + " must be alphanumeric/_")
 		}
-		if f.ID == FieldActiveID || f.ID == FieldTOTPSecretID || f.ID == FieldRecoveryCodesID || f.ID == FieldTermsID {
+		if f.ID == FieldActiveID || f.ID == FieldTOTPSecretID || f.ID == FieldRecoveryCodesID || f.ID == FieldTermsID || f.ID == FieldAPIKeysID || f.ID == FieldOrganizationsID {
 			panic("field " + f.ID + " is built-in")
 		}
 		if _, ok := data[f.ID]; !ok {
@@ -353,7 +494,7 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 	}
 
 	// Set defaults
-	ga.lru = cache.NewLRUCache(1000)
+	ga.lru = cache.NewLRU(cache.LRUOptions[string, bool]{Capacity: 1000})
 	if ga.Path.Account == "" {
 		ga.Path.Account = "/account"
 	}
@@ -396,6 +537,17 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 			Duration: time.Hour,
 		}
 	}
+	if ga.RateLimit.Rules == nil {
+		ga.RateLimit.Rules = map[string][]RateRule{
+			FlowLogin: {{By: RateByIP, Rate: cache.Rate{Rate: 100, Duration: time.Hour}}},
+		}
+	}
+	if ga.RateLimit.IPv6Prefix < 0 || ga.RateLimit.IPv6Prefix > 128 {
+		panic("RateLimit.IPv6Prefix must be between 0 and 128")
+	}
+	if ga.RateLimit.IPv6Prefix == 0 {
+		ga.RateLimit.IPv6Prefix = 64
+	}
 	if ga.Timeout.AccessToken == 0 {
 		ga.Timeout.AccessToken = time.Hour
 	}
@@ -405,9 +557,18 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 	if ga.Timeout.RefreshTokenRemember == 0 {
 		ga.Timeout.RefreshTokenRemember = time.Hour * 24 * 7
 	}
+	if ga.Timeout.Impersonation == 0 {
+		ga.Timeout.Impersonation = time.Minute * 15
+	}
 	if ga.Timeout.EmailToken == 0 {
 		ga.Timeout.EmailToken = time.Hour * 24 * 7
 	}
+	if ga.Timeout.LoginLink == 0 {
+		ga.Timeout.LoginLink = time.Minute * 15
+	}
+	if ga.Timeout.ResetLink == 0 {
+		ga.Timeout.ResetLink = time.Hour
+	}
 	buf.WriteString("Settings")
 	if ga.JwtKey == nil {
 		key, err := randomJWTKey()
@@ -429,9 +590,61 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 		ga.Path.Home = "/"
 	}
 	buf.WriteString("\n > BasePath: " + ga.Path.Base)
+	if ga.I18n == nil {
+		ga.I18n = i18n.NewBundle()
+	}
+	if ga.DeviceCookieName == "" {
+		ga.DeviceCookieName = "gdevice"
+	} else if ga.DeviceCookieName == "-" {
+		ga.DeviceCookieName = ""
+	}
+	if ga.LocaleCookieName == "" {
+		ga.LocaleCookieName = "lang"
+	}
+	if ga.LocaleFieldID != "" {
+		if _, ok := data[ga.LocaleFieldID]; !ok {
+			panic("field " + ga.LocaleFieldID + " not found in your Identity")
+		}
+	}
+	buf.WriteString("\n > Languages: " + strings.Join(ga.I18n.Languages(), ", "))
+	buf.WriteString("\n > ClientIP: ")
+	if ga.ClientIP != nil {
+		buf.WriteString("Custom")
+	} else {
+		if ga.ForwardedHeader == "" {
+			ga.ForwardedHeader = "X-Forwarded-For"
+		}
+		ipe, err := IPFromTrustedProxies(ga.ForwardedHeader, ga.TrustedProxies...)
+		if err != nil {
+			panic(err)
+		}
+		ga.ClientIP = ipe
+		buf.WriteString(fmt.Sprintf("%s from %d trusted proxies", ga.ForwardedHeader, len(ga.TrustedProxies)))
+	}
 	buf.WriteString("\n > Send Email: ")
 	if es, ok := ga.IdentityProvider.(email.Sender); ok {
 		ga.emailSender = es
+	}
+	if ga.EmailOutbox != nil {
+		if ga.EmailOutbox.Sender == nil {
+			ga.EmailOutbox.Sender = ga.emailSender
+		}
+		if ga.EmailOutbox.Sender == nil {
+			panic("EmailOutbox.Sender is required when IdentityProvider is not an email.Sender")
+		}
+		if ga.EmailOutbox.Store == nil {
+			panic("EmailOutbox.Store is required, e.g. email.NewFileQueue(dir)")
+		}
+		if ga.EmailOutbox.Logger == nil {
+			ga.EmailOutbox.Logger = ga.Logger
+		}
+		ga.EmailOutbox.Start()
+		ga.emailSender = ga.EmailOutbox
+		buf.WriteString("Yes (outbox)")
+		if _, ok := ga.EmailOutbox.Store.(*email.MemoryQueue); ok {
+			buf.WriteString(" InMemory queue is not durable (use email.NewFileQueue)")
+		}
+	} else if ga.emailSender != nil {
 		buf.WriteString("Yes")
 	} else {
 		buf.WriteString("No")
@@ -444,6 +657,14 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 		ga.refreshTokenProvider = &DefaultRefreshTokenProvider{ga: ga}
 		buf.WriteString("Built-in")
 	}
+	buf.WriteString("\n > EmailTokenProvider: ")
+	if etp, ok := ga.IdentityProvider.(EmailTokenProvider); ok {
+		ga.emailTokenProvider = etp
+		buf.WriteString("Custom")
+	} else {
+		ga.emailTokenProvider = NewDefaultEmailTokenProvider()
+		buf.WriteString("InMemory (implement EmailTokenProvider)")
+	}
 	buf.WriteString("\n > AccessTokenProvider: ")
 	if atp, ok := ga.IdentityProvider.(AccessTokenProvider); ok {
 		ga.accessTokenProvider = atp
@@ -452,6 +673,56 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 		ga.accessTokenProvider = &DefaultAccessTokenProvider{ga: ga}
 		buf.WriteString("Built-in")
 	}
+	buf.WriteString("\n > Impersonation: ")
+	if ip, ok := ga.IdentityProvider.(ImpersonationProvider); ok {
+		ga.impersonator = ip
+		buf.WriteString("Enabled")
+	} else {
+		buf.WriteString("Disabled")
+	}
+	buf.WriteString("\n > API Keys: ")
+	if akp, ok := ga.IdentityProvider.(APIKeyProvider); ok {
+		ga.apiKeyProvider = akp
+		buf.WriteString("Enabled")
+	} else {
+		buf.WriteString("Disabled")
+	}
+	buf.WriteString("\n > Client Credentials: ")
+	if cp, ok := ga.IdentityProvider.(ClientProvider); ok {
+		ga.clientProvider = cp
+		buf.WriteString("Enabled")
+	} else {
+		buf.WriteString("Disabled")
+	}
+	buf.WriteString("\n > Organizations: ")
+	if op, ok := ga.IdentityProvider.(OrganizationProvider); ok {
+		ga.organizationProvider = op
+		if len(ga.OrganizationRoles) == 0 {
+			ga.OrganizationRoles = []string{RoleOwner, RoleAdmin, RoleMember}
+		}
+		buf.WriteString("Enabled")
+	} else {
+		buf.WriteString("Disabled")
+	}
+	buf.WriteString("\n > Tenants: ")
+	if ga.TenantProvider != nil {
+		if ga.TenantResolver == nil {
+			panic("TenantResolver must be provided with TenantProvider")
+		}
+		buf.WriteString("Enabled")
+	} else {
+		buf.WriteString("Disabled")
+	}
+	buf.WriteString("\n > Identity Cache: ")
+	if ga.IdentityCache.Size > 0 {
+		if ga.IdentityCache.TTL == 0 {
+			ga.IdentityCache.TTL = time.Minute
+		}
+		ga.identityCache = cache.NewLRU(cache.LRUOptions[string, Identity]{Capacity: ga.IdentityCache.Size})
+		buf.WriteString(fmt.Sprintf("%d for %s", ga.IdentityCache.Size, ga.IdentityCache.TTL))
+	} else {
+		buf.WriteString("Disabled")
+	}
 	buf.WriteString("\n > EmailField: ")
 	if ga.EmailFieldID != "" {
 		if ga.fieldByID(ga.EmailFieldID) == nil {
@@ -478,12 +749,21 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 		ga.rateLimiter = rl
 		buf.WriteString("Custom")
 	} else {
-		ga.rateLimiter = cache.NewMemoryRateLimit()
+		ga.rateLimiter = cache.NewSlidingWindowLog(100000)
 		buf.WriteString("InMemory (implement cache.RateLimiter)")
 	}
-	buf.WriteString("\n > Recaptcha: ")
-	if ga.RecaptchaSecret != "" && ga.RecaptchaSiteKey != "" {
-		buf.WriteString("Enabled")
+	buf.WriteString("\n > Captcha: ")
+	if ga.Captcha == nil && ga.RecaptchaSecret != "" && ga.RecaptchaSiteKey != "" {
+		ga.Captcha = captcha.NewRecaptcha(ga.RecaptchaSiteKey, ga.RecaptchaSecret)
+	}
+	if ga.Captcha != nil {
+		if len(ga.CaptchaFlows) == 0 {
+			ga.CaptchaFlows = []string{FlowRegister}
+		}
+		buf.WriteString(ga.Captcha.Widget().Provider + " (" + strings.Join(ga.CaptchaFlows, ", ") + ")")
+		if ga.adaptiveCaptcha() {
+			buf.WriteString(" adaptive login")
+		}
 	} else {
 		buf.WriteString("Disabled")
 	}
@@ -493,6 +773,42 @@ func (ga *GAuth) MustInit(debug bool) *GAuth {
 	} else {
 		buf.WriteString("No")
 	}
+	buf.WriteString("\n > Security Headers: ")
+	if ga.SecurityHeaders.Disabled {
+		buf.WriteString("Disabled")
+	} else if len(ga.SecurityHeaders.FrameAncestors) > 0 {
+		buf.WriteString("CSP frame-ancestors " + strings.Join(ga.SecurityHeaders.FrameAncestors, " "))
+	} else {
+		buf.WriteString("CSP no framing")
+	}
+	ga.Cookies.validate()
+	buf.WriteString("\n > Cookies: ")
+	if ga.secureCookies() {
+		buf.WriteString("Secure")
+	} else {
+		buf.WriteString("Insecure")
+	}
+	if ga.Cookies.Domain != "" {
+		buf.WriteString(" Domain=" + ga.Cookies.Domain)
+	}
+	if ga.Cookies.Prefix != "" {
+		buf.WriteString(" Prefix=" + ga.Cookies.Prefix)
+	}
+	if ga.Cookies.Partitioned {
+		buf.WriteString(" Partitioned")
+	}
+	buf.WriteString("\n > CSRF: ")
+	if ga.CSRF.Disabled {
+		buf.WriteString("Disabled")
+	} else {
+		if ga.CSRF.CookieName == "" {
+			ga.CSRF.CookieName = "gcsrf"
+		}
+		if ga.CSRF.HeaderName == "" {
+			ga.CSRF.HeaderName = "X-CSRF-Token"
+		}
+		buf.WriteString(ga.CSRF.HeaderName + fmt.Sprintf(" (%d trusted origins)", len(ga.CSRF.TrustedOrigins)))
+	}
 
 	if debug {
 		ga.log(buf.String())
@@ -586,6 +902,10 @@ func (ga *GAuth) tokenClaims(tok, key string) (jwt.MapClaims, error) {
 	}
 
 	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
+		// tenants sharing the same JwtKey can't use each other's tokens
+		if tid, _ := claims["tid"].(string); tid != ga.tenantID() {
+			return nil, errors.New("gauth.tokenClaims tenant mismatch")
+		}
 		return claims, nil
 	}
 	return nil, errors.New("gauth.tokenClaims not valid")
@@ -615,7 +935,11 @@ func (ga *GAuth) saveIdentity(ctx context.Context, id Identity, req map[string]i
 		}
 	}
 
-	return id.IdentitySave(ctx)
+	uid, err := id.IdentitySave(ctx)
+	if err == nil {
+		ga.InvalidateIdentity(ctx, uid)
+	}
+	return uid, err
 }
 
 func (ga *GAuth) loadIdentity(id Identity) map[string]interface{} {
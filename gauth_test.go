@@ -2,20 +2,32 @@ package gauth_test
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/altlimit/gauth"
+	"github.com/altlimit/gauth/cache"
+	"github.com/altlimit/gauth/captcha"
+	"github.com/altlimit/gauth/email"
 	"github.com/altlimit/gauth/form"
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type (
@@ -39,9 +51,16 @@ var (
 	users     = make(map[string]*User)
 	lock      sync.Mutex
 	lastEmail string
+	// sentEmails has every email sent by memoryProvider since it was last reset
+	sentEmails []string
+	// beforeSave is called with the identity being saved, e.g. to run requests during a save
+	beforeSave func(u *User)
 )
 
 func (u *User) IdentitySave(ctx context.Context) (uid string, err error) {
+	if beforeSave != nil {
+		beforeSave(u)
+	}
 	lock.Lock()
 	defer lock.Unlock()
 	if u.ID == "" {
@@ -80,6 +99,7 @@ func (mp *memoryProvider) IdentityLoad(ctx context.Context, uid string) (gauth.I
 func (mp *memoryProvider) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
 	log.Println()
 	lastEmail = toEmail + "|" + subject + "|" + textBody
+	sentEmails = append(sentEmails, lastEmail)
 	return nil
 }
 
@@ -218,6 +238,7 @@ func TestGAuth(t *testing.T) {
 			account["answer"] = "Yes"
 			account["question"] = "What?"
 			b, _ := json.Marshal(account)
+			sentEmails = nil
 			res, resp = sendReq(http.MethodPost, "/auth/account", string(b), map[string]string{"Content-Type": "application/json"})
 			if res.StatusCode != 201 {
 				t.Fatalf("wanted 201 got %d", res.StatusCode)
@@ -228,7 +249,11 @@ func TestGAuth(t *testing.T) {
 			if users["1"].Email != "a@a.a" {
 				return fmt.Errorf("expected first user to be same email got %v", users["1"].Email)
 			}
-			parts := strings.Split(lastEmail, "|")
+			// the current email is told about the change after the update link is sent
+			if len(sentEmails) != 2 || !strings.HasPrefix(sentEmails[1], "a@a.a|Email change requested|") {
+				return fmt.Errorf("wanted update link and notification got %v", sentEmails)
+			}
+			parts := strings.Split(sentEmails[0], "|")
 			if parts[0] != "aa@a.a" {
 				return fmt.Errorf("wanted to email aa@a.a got %s", parts[0])
 			}
@@ -262,3 +287,1951 @@ func TestGAuth(t *testing.T) {
 		}
 	}
 }
+
+type impersonationProvider struct {
+	memoryProvider
+	events []gauth.ImpersonationEvent
+}
+
+func (ip *impersonationProvider) CanImpersonate(ctx context.Context, uid, targetUID string) error {
+	if uid != "admin" {
+		return gauth.ErrTokenDenied
+	}
+	return nil
+}
+
+func (ip *impersonationProvider) ImpersonationAudit(ctx context.Context, event gauth.ImpersonationEvent) error {
+	ip.events = append(ip.events, event)
+	return nil
+}
+
+func TestImpersonate(t *testing.T) {
+	users["admin"] = &User{ID: "admin", Email: "admin@a.a", Active: true}
+	users["customer"] = &User{ID: "customer", Email: "customer@a.a", Active: true}
+	defer func() {
+		delete(users, "admin")
+		delete(users, "customer")
+	}()
+	ip := &impersonationProvider{}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", ip)
+	ga.MustInit(false)
+
+	sendReq := func(tok, m, p, b string) (*http.Response, string) {
+		req := httptest.NewRequest(m, p, strings.NewReader(b))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimRight(string(data), "\n")
+	}
+	ctx := context.Background()
+	adminTok, _ := ga.CreateAccessToken(ctx, "admin", "access", time.Now().Add(time.Minute))
+	customerTok, _ := ga.CreateAccessToken(ctx, "customer", "access", time.Now().Add(time.Minute))
+
+	if res, _ := sendReq(customerTok, http.MethodPost, "/auth/action", `{"action":"impersonate","uid":"admin"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 got %d", res.StatusCode)
+	}
+	res, body := sendReq(adminTok, http.MethodPost, "/auth/action", `{"action":"impersonate","uid":"customer"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	var access struct {
+		Token string `json:"access_token"`
+	}
+	if err := json.Unmarshal([]byte(body), &access); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Authorization", "Bearer "+access.Token)
+	auth, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.UID != "customer" || !auth.Impersonated() || auth.Actor.UID != "admin" {
+		t.Fatalf("wanted customer acted by admin got %+v", auth)
+	}
+
+	if res, body := sendReq(access.Token, http.MethodGet, "/auth/account", ""); res.StatusCode != 200 || !strings.Contains(body, "customer@a.a") {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	if res, _ := sendReq(access.Token, http.MethodPost, "/auth/account", `{"email":"x@a.a"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 got %d", res.StatusCode)
+	}
+	if res, _ := sendReq(access.Token, http.MethodPost, "/auth/action", `{"action":"impersonate","uid":"admin"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 got %d", res.StatusCode)
+	}
+	if res, _ := sendReq(access.Token, http.MethodPost, "/auth/action", `{"action":"stopimpersonate"}`); res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d", res.StatusCode)
+	}
+	if len(ip.events) != 2 || ip.events[0].Action != gauth.ImpersonationStart || ip.events[1].Action != gauth.ImpersonationStop {
+		t.Fatalf("wanted start/stop audit events got %+v", ip.events)
+	}
+}
+
+type apiKeyProvider struct {
+	memoryProvider
+	keys map[string]*gauth.APIKey
+}
+
+func (ap *apiKeyProvider) APIKeyCreate(ctx context.Context, key *gauth.APIKey) error {
+	ap.keys[key.Hash] = key
+	return nil
+}
+
+func (ap *apiKeyProvider) APIKeyLoad(ctx context.Context, hash string) (*gauth.APIKey, error) {
+	if k, ok := ap.keys[hash]; ok {
+		return k, nil
+	}
+	return nil, gauth.ErrAPIKeyNotFound
+}
+
+func (ap *apiKeyProvider) APIKeyList(ctx context.Context, uid string) ([]*gauth.APIKey, error) {
+	var keys []*gauth.APIKey
+	for _, k := range ap.keys {
+		if k.UID == uid {
+			keys = append(keys, k)
+		}
+	}
+	return keys, nil
+}
+
+func (ap *apiKeyProvider) APIKeyUsed(ctx context.Context, uid, id string, t time.Time) error {
+	for _, k := range ap.keys {
+		if k.ID == id {
+			k.LastUsed = t
+		}
+	}
+	return nil
+}
+
+func (ap *apiKeyProvider) APIKeyDelete(ctx context.Context, uid, id string) error {
+	for h, k := range ap.keys {
+		if k.ID == id && k.UID == uid {
+			delete(ap.keys, h)
+			return nil
+		}
+	}
+	return gauth.ErrAPIKeyNotFound
+}
+
+func TestAPIKeys(t *testing.T) {
+	users["keyowner"] = &User{ID: "keyowner", Email: "keys@a.a", Active: true}
+	defer delete(users, "keyowner")
+	ap := &apiKeyProvider{keys: make(map[string]*gauth.APIKey)}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", ap)
+	ga.MustInit(false)
+
+	sendReq := func(tok, m, p, b string) (*http.Response, string) {
+		req := httptest.NewRequest(m, p, strings.NewReader(b))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimRight(string(data), "\n")
+	}
+	tok, _ := ga.CreateAccessToken(context.Background(), "keyowner", "access", time.Now().Add(time.Minute))
+	if _, body := sendReq(tok, http.MethodPost, "/auth/action", `{"action":"newApiKey"}`); body != `{"error":"validation","data":{"apikey_name":"required"}}` {
+		t.Fatalf("wanted validation error got %s", body)
+	}
+	res, body := sendReq(tok, http.MethodPost, "/auth/action", `{"action":"newApiKey","name":"CI","scopes":"read, write","expires":"30"}`)
+	if res.StatusCode != 201 {
+		t.Fatalf("wanted 201 got %d %s", res.StatusCode, body)
+	}
+	var created struct {
+		Key    string       `json:"key"`
+		APIKey gauth.APIKey `json:"apikey"`
+	}
+	if err := json.Unmarshal([]byte(body), &created); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, gauth.APIKeyPrefix) {
+		t.Fatalf("wanted key prefix %s got %s", gauth.APIKeyPrefix, created.Key)
+	}
+	for h := range ap.keys {
+		if h == created.Key {
+			t.Fatalf("api key stored in plain text")
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Authorization", "Bearer "+created.Key)
+	auth, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.UID != "keyowner" || auth.APIKeyID != created.APIKey.ID || strings.Join(auth.Scopes, ",") != "read,write" {
+		t.Fatalf("wanted keyowner with scopes got %+v", auth)
+	}
+	if res, _ := sendReq(created.Key, http.MethodPost, "/auth/account", `{"email":"x@a.a"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 got %d", res.StatusCode)
+	}
+	if _, body := sendReq(tok, http.MethodPost, "/auth/action", `{"action":"apiKeys"}`); !strings.Contains(body, `"name":"CI"`) || strings.Contains(body, `"last_used":"0001-`) {
+		t.Fatalf("wanted used key in list got %s", body)
+	}
+	if res, _ := sendReq(tok, http.MethodPost, "/auth/action", `{"action":"revokeApiKey","id":"`+created.APIKey.ID+`"}`); res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d", res.StatusCode)
+	}
+	if _, err := ga.Authorized(req); err != gauth.ErrInvalidAccessToken {
+		t.Fatalf("wanted ErrInvalidAccessToken got %v", err)
+	}
+}
+
+type clientProvider struct {
+	memoryProvider
+	clients map[string]*gauth.Client
+}
+
+func (cp *clientProvider) ClientLoad(ctx context.Context, clientID string) (*gauth.Client, error) {
+	if c, ok := cp.clients[clientID]; ok {
+		return c, nil
+	}
+	return nil, gauth.ErrClientNotFound
+}
+
+func TestClientCredentials(t *testing.T) {
+	hash, err := gauth.HashClientSecret("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := &clientProvider{clients: map[string]*gauth.Client{
+		"job": {ID: "job", SecretHash: hash, Scopes: []string{"read", "write"}},
+	}}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", cp)
+	ga.MustInit(false)
+
+	sendReq := func(ct, b string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/refresh", strings.NewReader(b))
+		req.Header.Add("Content-Type", ct)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimRight(string(data), "\n")
+	}
+	form := "application/x-www-form-urlencoded"
+	table := []struct {
+		ct       string
+		request  string
+		response string
+		status   int
+	}{
+		{form, "grant_type=password&client_id=job&client_secret=s3cret", `{"error":"unsupported_grant_type"}`, 400},
+		{form, "grant_type=client_credentials&client_id=job&client_secret=wrong", `{"error":"invalid_client"}`, 401},
+		{form, "grant_type=client_credentials&client_id=nope&client_secret=s3cret", `{"error":"invalid_client"}`, 401},
+		{form, "grant_type=client_credentials&client_id=job&client_secret=s3cret&scope=admin", `{"error":"invalid_scope"}`, 400},
+		{form, "grant_type=client_credentials&client_id=job&client_secret=s3cret&scope=read", `~"scope":"read"`, 200},
+		{"application/json", `{"grant_type":"client_credentials","client_id":"job","client_secret":"s3cret"}`, `~"scope":"read write"`, 200},
+	}
+	var access struct {
+		Token string `json:"access_token"`
+	}
+	for _, v := range table {
+		res, resp := sendReq(v.ct, v.request)
+		if !((strings.HasPrefix(v.response, "~") && strings.Contains(resp, v.response[1:]) || resp == v.response) && res.StatusCode == v.status) {
+			t.Errorf("request %s wanted %d `%s` got %d `%s`", v.request, v.status, v.response, res.StatusCode, resp)
+		}
+		if res.StatusCode == 200 {
+			if err := json.Unmarshal([]byte(resp), &access); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/auth/account", nil)
+	req.Header.Add("Authorization", "Bearer "+access.Token)
+	auth, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !auth.IsClient() || auth.ClientID != "job" || auth.UID != "" || strings.Join(auth.Scopes, " ") != "read write" {
+		t.Fatalf("wanted client job got %+v", auth)
+	}
+	var scopes []string
+	if err := auth.Load(&scopes); err != nil || len(scopes) != 2 {
+		t.Fatalf("wanted scopes in grants got %v %v", scopes, err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if w.Code != 403 {
+		t.Fatalf("wanted 403 for client account access got %d", w.Code)
+	}
+}
+
+func TestClientSubject(t *testing.T) {
+	// a client with the same id as a user UID is never authorized as that user
+	users["shared"] = &User{ID: "shared", Email: "shared@a.a", Active: true}
+	defer delete(users, "shared")
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &clientProvider{})
+	ga.MustInit(false)
+
+	tok, err := ga.CreateClientAccessToken(context.Background(), "shared", []string{"read"}, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tok, claims); err != nil || claims["sub"] != "client:shared" {
+		t.Fatalf("wanted namespaced sub got %v %v", claims, err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/auth/account", nil)
+	req.Header.Add("Authorization", "Bearer "+tok)
+	auth, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.UID != "" || auth.ClientID != "shared" {
+		t.Fatalf("wanted client without uid got %+v", auth)
+	}
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if strings.Contains(w.Body.String(), "shared@a.a") {
+		t.Fatalf("wanted no user account for client got %d %s", w.Code, w.Body.String())
+	}
+
+	// the subject of a client token must be namespaced
+	forged, _ := ga.CreateAccessToken(context.Background(), "shared", "access", time.Now().Add(time.Minute))
+	claims = jwt.MapClaims{}
+	new(jwt.Parser).ParseUnverified(forged, claims)
+	claims["client_id"] = "shared"
+	forged, _ = jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ga.JwtKey)
+	req.Header.Set("Authorization", "Bearer "+forged)
+	if _, err := ga.Authorized(req); err != gauth.ErrInvalidAccessToken {
+		t.Fatalf("wanted mismatched client subject rejected got %v", err)
+	}
+}
+
+type tenantProvider struct{}
+
+func (tp *tenantProvider) TenantLoad(ctx context.Context, id string) (*gauth.Tenant, error) {
+	switch id {
+	case "acme":
+		return &gauth.Tenant{ID: id, JwtKey: []byte("acme-secret"), Brand: &form.Brand{AppName: "Acme", AppURL: "http://localhost/acme"}}, nil
+	case "globex":
+		return &gauth.Tenant{ID: id}, nil
+	}
+	return nil, gauth.ErrTenantNotFound
+}
+
+func TestTenants(t *testing.T) {
+	hash, _ := gauth.HashClientSecret("P@ssw0rd")
+	users["tenant"] = &User{ID: "tenant", Email: "tenant@a.a", Password: hash, Active: true}
+	defer delete(users, "tenant")
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.TenantProvider = &tenantProvider{}
+	ga.TenantResolver = gauth.TenantFromPathPrefix
+	ga.MustInit(false)
+
+	sendReq := func(m, p, b string) (*http.Response, string) {
+		req := httptest.NewRequest(m, p, strings.NewReader(b))
+		req.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimRight(string(data), "\n")
+	}
+	req := httptest.NewRequest(http.MethodGet, "/acme/auth/login", nil)
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, "<title>Login - Acme</title>") || !strings.Contains(body, `href="/acme/auth/register"`) {
+		t.Fatalf("wanted acme login page got %d %s", w.Code, body)
+	}
+	if res, _ := sendReq(http.MethodGet, "/initech/auth/login", ""); res.StatusCode != 404 {
+		t.Fatalf("wanted 404 got %d", res.StatusCode)
+	}
+
+	res, body := sendReq(http.MethodPost, "/acme/auth/login", `{"email":"tenant@a.a","password":"P@ssw0rd"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	var refresh struct {
+		Token string `json:"refresh_token"`
+	}
+	json.Unmarshal([]byte(body), &refresh)
+	if res, _ := sendReq(http.MethodPost, "/globex/auth/refresh", `{"token":"`+refresh.Token+`"}`); res.StatusCode != 401 {
+		t.Fatalf("wanted 401 for other tenant got %d", res.StatusCode)
+	}
+	res, body = sendReq(http.MethodPost, "/acme/auth/refresh", `{"token":"`+refresh.Token+`"}`)
+	if res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	var access struct {
+		Token string `json:"access_token"`
+	}
+	json.Unmarshal([]byte(body), &access)
+
+	for p, ok := range map[string]bool{"/acme/dashboard": true, "/globex/dashboard": false, "/dashboard": false} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Add("Authorization", "Bearer "+access.Token)
+		_, err := ga.Authorized(req)
+		if ok != (err == nil) {
+			t.Errorf("path %s wanted authorized %v got %v", p, ok, err)
+		}
+	}
+}
+
+func TestTenantRateLimits(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.TenantProvider = &tenantProvider{}
+	ga.TenantResolver = gauth.TenantFromPathPrefix
+	ga.RateLimit.Login = cache.Rate{Rate: 1, Duration: time.Minute}
+	ga.MustInit(false)
+
+	login := func(prefix string) int {
+		req := httptest.NewRequest(http.MethodPost, prefix+"/auth/login", strings.NewReader(`{"email": "limit@a.a", "password": "P@ssw0rd"}`))
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Code
+	}
+	// the same identity has its own limits in every tenant
+	table := []struct {
+		prefix string
+		status int
+	}{
+		{"/acme", http.StatusBadRequest},
+		{"/acme", http.StatusTooManyRequests},
+		{"/globex", http.StatusBadRequest},
+		{"/globex", http.StatusTooManyRequests},
+	}
+	for _, v := range table {
+		if status := login(v.prefix); status != v.status {
+			t.Errorf("tenant %s wanted %d got %d", v.prefix, v.status, status)
+		}
+	}
+}
+
+func TestTenantAPIKeys(t *testing.T) {
+	ap := &apiKeyProvider{keys: make(map[string]*gauth.APIKey)}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", ap)
+	ga.TenantProvider = &tenantProvider{}
+	ga.TenantResolver = gauth.TenantFromPathPrefix
+	ga.MustInit(false)
+
+	ctx := context.WithValue(context.Background(), gauth.TenantKey, &gauth.Tenant{ID: "acme"})
+	key, ak, err := ga.CreateAPIKey(ctx, "keyowner", "CI", nil, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ak.TenantID != "acme" {
+		t.Fatalf("wanted acme key got %s", ak.TenantID)
+	}
+	// keys are looked up by hash only so the tenant of the key must match the request
+	for p, ok := range map[string]bool{"/acme/dashboard": true, "/globex/dashboard": false, "/dashboard": false} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		req.Header.Add("Authorization", "Bearer "+key)
+		_, err := ga.Authorized(req)
+		if ok != (err == nil) {
+			t.Errorf("path %s wanted authorized %v got %v", p, ok, err)
+		}
+	}
+}
+
+type orgProvider struct {
+	mp      memoryProvider
+	orgs    map[string]string
+	members []*gauth.Membership
+	active  map[string]string
+}
+
+func (op *orgProvider) IdentityUID(ctx context.Context, id string) (string, error) {
+	return op.mp.IdentityUID(ctx, id)
+}
+
+func (op *orgProvider) IdentityLoad(ctx context.Context, uid string) (gauth.Identity, error) {
+	return op.mp.IdentityLoad(ctx, uid)
+}
+
+func (op *orgProvider) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	return op.mp.SendEmail(ctx, toEmail, subject, textBody, htmlBody)
+}
+
+func (op *orgProvider) OrganizationCreate(ctx context.Context, name, ownerUID string) (string, error) {
+	id := "org" + strconv.Itoa(len(op.orgs)+1)
+	op.orgs[id] = name
+	return id, nil
+}
+
+func (op *orgProvider) OrganizationList(ctx context.Context, uid string) ([]*gauth.Membership, error) {
+	var ms []*gauth.Membership
+	for _, m := range op.members {
+		if m.UID == uid {
+			ms = append(ms, m)
+		}
+	}
+	return ms, nil
+}
+
+func (op *orgProvider) OrganizationMembers(ctx context.Context, orgID string) ([]*gauth.Membership, error) {
+	var ms []*gauth.Membership
+	for _, m := range op.members {
+		if m.OrgID == orgID {
+			c := *m
+			ms = append(ms, &c)
+		}
+	}
+	return ms, nil
+}
+
+func (op *orgProvider) OrganizationMemberSave(ctx context.Context, m *gauth.Membership) error {
+	for i, v := range op.members {
+		if v.OrgID == m.OrgID && v.Email == m.Email {
+			op.members[i] = m
+			return nil
+		}
+	}
+	op.members = append(op.members, m)
+	return nil
+}
+
+func (op *orgProvider) OrganizationMemberDelete(ctx context.Context, orgID, email string) error {
+	for i, v := range op.members {
+		if v.OrgID == orgID && v.Email == email {
+			op.members = append(op.members[:i], op.members[i+1:]...)
+			return nil
+		}
+	}
+	return gauth.ErrOrganizationNotFound
+}
+
+func (op *orgProvider) OrganizationActive(ctx context.Context, uid string) (string, error) {
+	return op.active[uid], nil
+}
+
+func (op *orgProvider) OrganizationSetActive(ctx context.Context, uid, orgID string) error {
+	op.active[uid] = orgID
+	return nil
+}
+
+func TestOrganizations(t *testing.T) {
+	hash, _ := gauth.HashClientSecret("P@ssw0rd")
+	users["owner"] = &User{ID: "owner", Email: "owner@a.a", Password: hash, Active: true}
+	users["member"] = &User{ID: "member", Email: "member@a.a", Password: hash, Active: true}
+	defer func() {
+		delete(users, "owner")
+		delete(users, "member")
+	}()
+	op := &orgProvider{orgs: make(map[string]string), active: make(map[string]string)}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", op)
+	ga.MustInit(false)
+
+	sendReq := func(tok, m, p, b string) (*http.Response, string) {
+		req := httptest.NewRequest(m, p, strings.NewReader(b))
+		req.Header.Add("Content-Type", "application/json")
+		if tok != "" {
+			req.Header.Add("Authorization", "Bearer "+tok)
+		}
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimRight(string(data), "\n")
+	}
+	login := func(email string) string {
+		_, body := sendReq("", http.MethodPost, "/auth/login", `{"email":"`+email+`","password":"P@ssw0rd"}`)
+		var refresh struct {
+			Token string `json:"refresh_token"`
+		}
+		json.Unmarshal([]byte(body), &refresh)
+		_, body = sendReq("", http.MethodPost, "/auth/refresh", `{"token":"`+refresh.Token+`"}`)
+		var access struct {
+			Token string `json:"access_token"`
+		}
+		json.Unmarshal([]byte(body), &access)
+		return access.Token
+	}
+	ownerTok := login("owner@a.a")
+	memberTok := login("member@a.a")
+
+	res, body := sendReq(ownerTok, http.MethodPost, "/auth/action", `{"action":"newOrg","name":"Acme"}`)
+	if res.StatusCode != 201 || !strings.Contains(body, `"role":"owner"`) {
+		t.Fatalf("wanted 201 got %d %s", res.StatusCode, body)
+	}
+	if res, _ := sendReq(memberTok, http.MethodPost, "/auth/action", `{"action":"orgMembers","org":"org1"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 for non member got %d", res.StatusCode)
+	}
+	if _, body := sendReq(ownerTok, http.MethodPost, "/auth/action", `{"action":"orgInvite","org":"org1","email":"member@a.a","role":"root"}`); body != `{"error":"validation","data":{"role":"invalid"}}` {
+		t.Fatalf("wanted invalid role got %s", body)
+	}
+	if res, body := sendReq(ownerTok, http.MethodPost, "/auth/action", `{"action":"orgInvite","org":"org1","email":"member@a.a","role":"admin"}`); res.StatusCode != 201 {
+		t.Fatalf("wanted 201 got %d %s", res.StatusCode, body)
+	}
+	parts := strings.Split(lastEmail, "|")
+	if parts[0] != "member@a.a" || parts[1] != "Invitation to Acme" {
+		t.Fatalf("wanted invitation email got %s", lastEmail)
+	}
+	tok := regexp.MustCompile(`t=(.+)`).FindStringSubmatch(parts[2])[1]
+	if res, _ := sendReq(ownerTok, http.MethodPost, "/auth/action", `{"action":"orginvite","token":"`+tok+`"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 for wrong email got %d", res.StatusCode)
+	}
+	if res, body := sendReq(memberTok, http.MethodPost, "/auth/action", `{"action":"orginvite","token":"`+tok+`"}`); res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	if res, _ := sendReq(memberTok, http.MethodPost, "/auth/action", `{"action":"orgRole","org":"org1","email":"owner@a.a","role":"member"}`); res.StatusCode != 403 {
+		t.Fatalf("wanted 403 admin changing owner got %d", res.StatusCode)
+	}
+	if res, _ := sendReq(memberTok, http.MethodPost, "/auth/action", `{"action":"orgSwitch","org":"org1"}`); res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d", res.StatusCode)
+	}
+	memberTok = login("member@a.a")
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Authorization", "Bearer "+memberTok)
+	auth, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grants gauth.OrganizationGrants
+	if err := auth.Load(&grants); err != nil || grants.OrgID != "org1" || grants.Role != "admin" {
+		t.Fatalf("wanted org1 admin grants got %+v %v", grants, err)
+	}
+}
+
+// orgImpersonationProvider uses the default access token provider unlike impersonationProvider
+type orgImpersonationProvider struct {
+	*orgProvider
+}
+
+func (oi *orgImpersonationProvider) CanImpersonate(ctx context.Context, uid, targetUID string) error {
+	if uid != "admin" {
+		return gauth.ErrTokenDenied
+	}
+	return nil
+}
+
+func (oi *orgImpersonationProvider) ImpersonationAudit(ctx context.Context, event gauth.ImpersonationEvent) error {
+	return nil
+}
+
+func TestImpersonateOrganization(t *testing.T) {
+	users["admin"] = &User{ID: "admin", Email: "admin@a.a", Active: true}
+	users["customer"] = &User{ID: "customer", Email: "customer@a.a", Active: true}
+	defer func() {
+		delete(users, "admin")
+		delete(users, "customer")
+	}()
+	op := &orgProvider{orgs: map[string]string{"org1": "Acme"}, active: map[string]string{"customer": "org1"}}
+	op.members = []*gauth.Membership{{OrgID: "org1", UID: "customer", Email: "customer@a.a", Role: "admin", Status: gauth.MemberActive}}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &orgImpersonationProvider{op})
+	ga.MustInit(false)
+
+	ctx := context.Background()
+	adminTok, _ := ga.CreateAccessToken(ctx, "admin", "access", time.Now().Add(time.Minute))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Authorization", "Bearer "+adminTok)
+	actor, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := ga.Impersonate(ctx, actor, "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Add("Authorization", "Bearer "+tok)
+	auth, err := ga.Authorized(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var grants gauth.OrganizationGrants
+	if err := auth.Load(&grants); err != nil || grants.OrgID != "org1" || grants.Role != "admin" || !auth.Impersonated() {
+		t.Fatalf("wanted impersonated org1 admin grants got %+v %v", grants, err)
+	}
+}
+
+func TestRateLimitResponses(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.RateLimit.Login = cache.Rate{Rate: 1, Duration: time.Minute}
+	ga.RateLimit.ResetLink = cache.Rate{Rate: 1, Duration: time.Minute}
+	ga.MustInit(false)
+
+	table := []struct {
+		path    string
+		request string
+	}{
+		{"/auth/login", `{"email": "limit@a.a", "password": "P@ssw0rd"}`},
+		{"/auth/action", `{"action": "resetlink", "email": "limit@a.a"}`},
+	}
+	for _, v := range table {
+		var res *http.Response
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest(http.MethodPost, v.path, strings.NewReader(v.request))
+			w := httptest.NewRecorder()
+			ga.ServeHTTP(w, req)
+			res = w.Result()
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != 429 {
+			t.Fatalf("path %s wanted 429 got %d %s", v.path, res.StatusCode, body)
+		}
+		if res.Header.Get("Retry-After") != "60" || res.Header.Get("RateLimit-Limit") != "1" || res.Header.Get("RateLimit-Remaining") != "0" {
+			t.Errorf("path %s wanted rate limit headers got %v", v.path, res.Header)
+		}
+		if strings.TrimSpace(string(body)) != `{"error":"Try again later","retry_after":60}` {
+			t.Errorf("path %s wanted retry_after got %s", v.path, body)
+		}
+	}
+}
+
+func TestClientCredentialsRateLimit(t *testing.T) {
+	b, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	hash := string(b)
+	cp := &clientProvider{clients: map[string]*gauth.Client{
+		"job":   {ID: "job", SecretHash: hash},
+		"other": {ID: "other", SecretHash: hash},
+		"third": {ID: "third", SecretHash: hash},
+	}}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", cp)
+	ga.RateLimit.Login = cache.Rate{Rate: 1, Duration: time.Minute}
+	ga.RateLimit.Rules = map[string][]gauth.RateRule{
+		gauth.FlowClient: {{By: gauth.RateGlobal, Rate: cache.Rate{Rate: 2, Duration: time.Minute}}},
+	}
+	ga.MustInit(false)
+
+	token := func(clientID string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodPost, "/auth/refresh", strings.NewReader("grant_type=client_credentials&client_id="+clientID+"&client_secret=s3cret"))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		res := w.Result()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, strings.TrimSpace(string(body))
+	}
+	if res, body := token("job"); res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	res, body := token("job")
+	if res.StatusCode != 429 || !strings.HasPrefix(body, `{"error":"Try again later","retry_after":`) {
+		t.Fatalf("wanted 429 per client got %d %s", res.StatusCode, body)
+	}
+	if res.Header.Get("Retry-After") == "" || res.Header.Get("RateLimit-Limit") != "1" {
+		t.Errorf("wanted rate limit headers got %v", res.Header)
+	}
+	// the denied request isn't charged to the global rule
+	if res, body := token("other"); res.StatusCode != 200 {
+		t.Fatalf("wanted 200 got %d %s", res.StatusCode, body)
+	}
+	if res, _ := token("third"); res.StatusCode != 429 || res.Header.Get("RateLimit-Limit") != "2" {
+		t.Fatalf("wanted 429 by the global rule got %d %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestRateLimitRules(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.RateLimit.Rules = map[string][]gauth.RateRule{
+		gauth.FlowLogin: {
+			{By: gauth.RateByIP, Rate: cache.Rate{Rate: 2, Duration: time.Minute}},
+		},
+	}
+	ga.MustInit(false)
+
+	login := func(ip, email string) int {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email": "`+email+`", "password": "P@ssw0rd"}`))
+		req.RemoteAddr = net.JoinHostPort(ip, "1234")
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+	// different identities from the same /64 shares the per ip limit
+	table := []struct {
+		ip     string
+		email  string
+		status int
+	}{
+		{"2001:db8::1", "a@a.a", http.StatusBadRequest},
+		{"2001:db8::2", "b@a.a", http.StatusBadRequest},
+		{"2001:db8::3", "c@a.a", http.StatusTooManyRequests},
+		{"2001:db8:0:1::1", "c@a.a", http.StatusBadRequest},
+		{"10.0.0.1", "d@a.a", http.StatusBadRequest},
+	}
+	for _, v := range table {
+		if status := login(v.ip, v.email); status != v.status {
+			t.Errorf("ip %s email %s wanted %d got %d", v.ip, v.email, v.status, status)
+		}
+	}
+}
+
+func TestRateLimitRulesStopAtDenial(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.RateLimit.Login = cache.Rate{Rate: 1, Duration: time.Minute}
+	ga.RateLimit.Rules = map[string][]gauth.RateRule{
+		gauth.FlowLogin: {
+			{By: gauth.RateByIP, Rate: cache.Rate{Rate: 2, Duration: time.Minute}},
+		},
+	}
+	ga.MustInit(false)
+
+	login := func(email string) int {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email": "`+email+`", "password": "P@ssw0rd"}`))
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Code
+	}
+	// the denied login of a@a.a isn't charged to the per ip rule
+	for i, v := range []struct {
+		email  string
+		status int
+	}{
+		{"a@a.a", http.StatusBadRequest},
+		{"a@a.a", http.StatusTooManyRequests},
+		{"b@a.a", http.StatusBadRequest},
+		{"c@a.a", http.StatusTooManyRequests},
+	} {
+		if status := login(v.email); status != v.status {
+			t.Errorf("%d %s wanted %d got %d", i, v.email, v.status, status)
+		}
+	}
+
+	for _, prefix := range []int{-1, 129} {
+		func() {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("wanted panic for prefix %d", prefix)
+				}
+			}()
+			ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+			ga.RateLimit.IPv6Prefix = prefix
+			ga.MustInit(false)
+		}()
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	if _, err := gauth.IPFromTrustedProxies("X-Forwarded-For", "not an ip"); err == nil {
+		t.Fatal("wanted invalid proxy error")
+	}
+	if _, err := gauth.IPFromTrustedProxies(""); err == nil {
+		t.Fatal("wanted header required error")
+	}
+	xff, err := gauth.IPFromTrustedProxies("X-Forwarded-For", "10.0.0.0/8", "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwd, err := gauth.IPFromTrustedProxies("Forwarded", "10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		ipe     gauth.IPExtractor
+		remote  string
+		headers map[string]string
+		ip      string
+	}{
+		{xff, "1.1.1.1:80", map[string]string{"X-Forwarded-For": "2.2.2.2"}, "1.1.1.1"},
+		{xff, "1.1.1.1:80", map[string]string{"X-Appengine-User-Ip": "2.2.2.2"}, "1.1.1.1"},
+		{xff, "10.0.0.1:80", nil, "10.0.0.1"},
+		{xff, "10.0.0.1:80", map[string]string{"X-Real-IP": "2.2.2.2"}, "10.0.0.1"},
+		{xff, "10.0.0.1:80", map[string]string{"X-Forwarded-For": "2.2.2.2"}, "2.2.2.2"},
+		{xff, "10.0.0.1:80", map[string]string{"X-Forwarded-For": "9.9.9.9, 2.2.2.2, 10.0.0.2"}, "2.2.2.2"},
+		{xff, "10.0.0.1:80", map[string]string{"X-Forwarded-For": "unknown, 10.0.0.2"}, "10.0.0.2"},
+		{xff, "[2001:db8::1]:80", map[string]string{"X-Forwarded-For": "2.2.2.2"}, "2.2.2.2"},
+		// a client forging Forwarded behind a proxy that only appends X-Forwarded-For
+		{xff, "10.0.0.1:80", map[string]string{"Forwarded": "for=1.2.3.4", "X-Forwarded-For": "3.3.3.3"}, "3.3.3.3"},
+		{xff, "10.0.0.1:80", map[string]string{"Forwarded": "for=1.2.3.4"}, "10.0.0.1"},
+		{fwd, "10.0.0.1:80", map[string]string{
+			"Forwarded":       `for=9.9.9.9, for="[2001:db8:cafe::17]:4711";proto=https, for=10.0.0.3`,
+			"X-Forwarded-For": "3.3.3.3",
+		}, "2001:db8:cafe::17"},
+		{fwd, "10.0.0.1:80", map[string]string{"X-Forwarded-For": "3.3.3.3"}, "10.0.0.1"},
+	}
+	for _, v := range table {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = v.remote
+		for k, h := range v.headers {
+			req.Header.Set(k, h)
+		}
+		if ip := v.ipe(req); ip != v.ip {
+			t.Errorf("remote %s headers %v wanted %s got %s", v.remote, v.headers, v.ip, ip)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Appengine-User-Ip", "2.2.2.2")
+	if ip := gauth.IPFromHeader("X-Appengine-User-Ip")(req); ip != "2.2.2.2" {
+		t.Errorf("wanted header ip got %s", ip)
+	}
+}
+
+type countingProvider struct {
+	mp    memoryProvider
+	loads int
+}
+
+func (cp *countingProvider) IdentityUID(ctx context.Context, id string) (string, error) {
+	return cp.mp.IdentityUID(ctx, id)
+}
+
+func (cp *countingProvider) IdentityLoad(ctx context.Context, uid string) (gauth.Identity, error) {
+	lock.Lock()
+	cp.loads++
+	lock.Unlock()
+	return cp.mp.IdentityLoad(ctx, uid)
+}
+
+func TestIdentityCache(t *testing.T) {
+	users["cached"] = &User{ID: "cached", Name: "Before", Email: "cached@a.a", Active: true}
+	defer delete(users, "cached")
+	cp := &countingProvider{}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", cp)
+	ga.IdentityCache.Size = 10
+	ga.Fields = append(ga.Fields, &form.Field{ID: "name", Label: "Name", Type: "text", SettingsTab: "Account"})
+	ga.MustInit(false)
+	tok, _ := ga.CreateAccessToken(context.Background(), "cached", "access", time.Now().Add(time.Minute))
+
+	sendReq := func(m, b string) string {
+		req := httptest.NewRequest(m, "/auth/account", strings.NewReader(b))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		data, _ := ioutil.ReadAll(w.Result().Body)
+		return string(data)
+	}
+	cp.loads = 0
+	sendReq(http.MethodGet, "")
+	if body := sendReq(http.MethodGet, ""); cp.loads != 1 || !strings.Contains(body, "Before") {
+		t.Fatalf("wanted 1 load got %d %s", cp.loads, body)
+	}
+	sendReq(http.MethodPost, `{"name": "After"}`)
+	if users["cached"].Name != "After" {
+		t.Fatalf("wanted saved name got %s", users["cached"].Name)
+	}
+	loads := cp.loads
+	if body := sendReq(http.MethodGet, ""); cp.loads != loads+1 || !strings.Contains(body, "After") {
+		t.Fatalf("wanted reload after save got %d %s", cp.loads, body)
+	}
+}
+
+// defaultTokensProvider records emails and uses the default token providers, its next IdentityLoad
+// can be held once it read the identity like a slow database.
+type defaultTokensProvider struct {
+	mp     memoryProvider
+	emails []string
+	hold   chan struct{}
+	loaded chan struct{}
+}
+
+func (rp *defaultTokensProvider) IdentityUID(ctx context.Context, id string) (string, error) {
+	return rp.mp.IdentityUID(ctx, id)
+}
+
+func (rp *defaultTokensProvider) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	rp.emails = append(rp.emails, toEmail+"|"+subject+"|"+textBody)
+	return nil
+}
+
+func (rp *defaultTokensProvider) IdentityLoad(ctx context.Context, uid string) (gauth.Identity, error) {
+	id, err := rp.mp.IdentityLoad(ctx, uid)
+	lock.Lock()
+	hold, loaded := rp.hold, rp.loaded
+	rp.hold = nil
+	lock.Unlock()
+	if hold != nil {
+		close(loaded)
+		<-hold
+	}
+	return id, err
+}
+
+func TestIdentityCacheConcurrentSave(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("P@ssw0rd"), bcrypt.MinCost)
+	users["racing"] = &User{ID: "racing", Email: "racing@a.a", Password: string(hash), Active: true}
+	defer delete(users, "racing")
+	rp := &defaultTokensProvider{}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", rp)
+	ga.IdentityCache.Size = 10
+	ga.BCryptCost = bcrypt.MinCost
+	ga.MustInit(false)
+	tok, _ := ga.CreateAccessToken(context.Background(), "racing", "access", time.Now().Add(time.Minute))
+
+	sendReq := func(m, p, b string) (int, string) {
+		req := httptest.NewRequest(m, p, strings.NewReader(b))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	login := func(pw string) string {
+		code, body := sendReq(http.MethodPost, "/auth/login", `{"email": "racing@a.a", "password": "`+pw+`"}`)
+		if code != http.StatusOK {
+			t.Fatalf("wanted login got %d %s", code, body)
+		}
+		var refresh struct {
+			Token string `json:"refresh_token"`
+		}
+		json.Unmarshal([]byte(body), &refresh)
+		return refresh.Token
+	}
+	// saveRacing sends a request that saves the identity, while it's saved another request
+	// loads the identity it replaces and only stores it in the cache after the save is done
+	saveRacing := func(body string) {
+		var hold, done chan struct{}
+		beforeSave = func(u *User) {
+			// as if the cached identity just expired
+			ga.InvalidateIdentity(context.Background(), u.ID)
+			loaded := make(chan struct{})
+			hold, done = make(chan struct{}), make(chan struct{})
+			lock.Lock()
+			rp.hold, rp.loaded = hold, loaded
+			lock.Unlock()
+			go func() {
+				defer close(done)
+				sendReq(http.MethodGet, "/auth/account", "")
+			}()
+			<-loaded
+		}
+		defer func() { beforeSave = nil }()
+		rp.emails = nil
+		if code, resp := sendReq(http.MethodPost, "/auth/action", body); code != http.StatusOK {
+			t.Fatalf("wanted 200 got %d %s", code, resp)
+		}
+		if hold == nil {
+			t.Fatal("wanted a save")
+		}
+		close(hold)
+		<-done
+	}
+	refresh := func(rtok string) int {
+		code, _ := sendReq(http.MethodPost, "/auth/refresh", `{"token":"`+rtok+`"}`)
+		return code
+	}
+
+	rtok := login("P@ssw0rd")
+	sendReq(http.MethodPost, "/auth/action", `{"action": "resetlink", "email": "racing@a.a"}`)
+	resetTok := regexp.MustCompile(`\?a=reset&t=(\S+)`).FindStringSubmatch(strings.Join(rp.emails, " "))
+	if resetTok == nil {
+		t.Fatalf("reset link not found in %v", rp.emails)
+	}
+	saveRacing(`{"action": "reset", "token": "` + resetTok[1] + `", "password": "N3w@Passw0rd", "password_confirm": "N3w@Passw0rd"}`)
+	if code := refresh(rtok); code != http.StatusUnauthorized {
+		t.Fatalf("wanted refresh to fail after reset got %d", code)
+	}
+	lockTok := regexp.MustCompile(`\?a=lock&t=(\S+)`).FindStringSubmatch(strings.Join(rp.emails, " "))
+	if lockTok == nil {
+		t.Fatalf("lock link not found in %v", rp.emails)
+	}
+	rtok = login("N3w@Passw0rd")
+	saveRacing(`{"action": "lock", "token": "` + lockTok[1] + `"}`)
+	if code := refresh(rtok); code != http.StatusUnauthorized {
+		t.Fatalf("wanted refresh to fail after lock got %d", code)
+	}
+}
+
+type failingSender struct{}
+
+func (fs *failingSender) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	return errors.New("smtp unavailable")
+}
+
+func TestEmailOutbox(t *testing.T) {
+	users["outbox"] = &User{ID: "outbox", Email: "outbox@a.a", Active: true}
+	defer delete(users, "outbox")
+	queue := email.NewMemoryQueue()
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.EmailOutbox = email.NewOutbox(&failingSender{}, queue)
+	ga.EmailOutbox.Backoff = func(int) time.Duration { return time.Hour }
+	ga.MustInit(false)
+	defer ga.EmailOutbox.Stop(context.Background())
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/action", strings.NewReader(`{"action": "resetlink", "email": "outbox@a.a"}`))
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wanted 200 got %d", w.Code)
+	}
+	if queue.Len() != 1 {
+		t.Errorf("wanted 1 queued got %d", queue.Len())
+	}
+}
+
+func TestEmailOutboxStoreRequired(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.EmailOutbox = email.NewOutbox(nil, nil)
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "EmailOutbox.Store is required") {
+			t.Fatalf("wanted store required panic got %v", r)
+		}
+	}()
+	ga.MustInit(false)
+}
+
+func TestEmailTemplates(t *testing.T) {
+	users["tpl"] = &User{ID: "tpl", Email: "tpl@a.a", Password: "secret-hash", Active: true}
+	defer delete(users, "tpl")
+	tpls := email.NewTemplates()
+	if err := tpls.Add("reset", "", `{{define "subject"}}Reset for {{.Fields.email}}{{end}}{{.Link}}|{{.Fields.password}}`); err != nil {
+		t.Fatal(err)
+	}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.EmailTemplates = tpls
+	ga.MustInit(false)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/action", strings.NewReader(`{"action": "resetlink", "email": "tpl@a.a"}`))
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wanted 200 got %d", w.Code)
+	}
+	parts := strings.Split(lastEmail, "|")
+	if len(parts) != 4 || parts[0] != "tpl@a.a" || parts[1] != "Reset for tpl@a.a" || !strings.HasPrefix(parts[2], "http://localhost:8887/auth/login?a=reset&t=") {
+		t.Fatalf("unexpected email %s", lastEmail)
+	}
+	if parts[3] != "<no value>" {
+		t.Errorf("wanted password hidden from templates got %s", parts[3])
+	}
+}
+
+func TestI18n(t *testing.T) {
+	users["i18n"] = &User{ID: "i18n", Email: "i18n@a.a", Password: "secret-hash", Active: true}
+	defer delete(users, "i18n")
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.MustInit(false)
+
+	table := []struct {
+		query  string
+		header string
+		cookie string
+		lang   string
+		title  string
+	}{
+		{"", "", "", "en", "Forgot Password"},
+		{"", "es-MX,es;q=0.9", "", "es", "Olvidé mi contraseña"},
+		{"?lang=de", "es", "", "de", "Passwort vergessen"},
+		{"", "es", "fr", "fr", "Mot de passe oublié"},
+		{"?lang=ja", "", "", "en", "Forgot Password"},
+	}
+	for _, v := range table {
+		req := httptest.NewRequest(http.MethodGet, "/auth/login"+v.query, nil)
+		if v.header != "" {
+			req.Header.Set("Accept-Language", v.header)
+		}
+		if v.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "lang", Value: v.cookie})
+		}
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		body := w.Body.String()
+		if !strings.Contains(body, `<html lang="`+v.lang+`">`) || !strings.Contains(body, v.title) {
+			t.Errorf("%s %s wanted %s page", v.query, v.header, v.lang)
+		}
+		var cookie string
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "lang" {
+				cookie = c.Value
+			}
+		}
+		if (v.query == "?lang=de") != (cookie == "de") {
+			t.Errorf("%s unexpected lang cookie %q", v.query, cookie)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/action", strings.NewReader(`{"action": "resetlink", "email": "i18n@a.a"}`))
+	req.Header.Set("Accept-Language", "fr")
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("wanted 200 got %d", w.Code)
+	}
+	if !strings.HasPrefix(lastEmail, "i18n@a.a|Lien de réinitialisation du mot de passe|") {
+		t.Errorf("wanted french email got %s", lastEmail)
+	}
+
+	// validation codes stay stable for clients
+	req = httptest.NewRequest(http.MethodPost, "/auth/register", strings.NewReader(`{"email": "x@a.a", "password": "short"}`))
+	req.Header.Set("Accept-Language", "es")
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `"must be 7 characters"`) {
+		t.Errorf("wanted untranslated validation code got %s", w.Body.String())
+	}
+}
+
+type recordingProvider struct {
+	memoryProvider
+	emails []string
+}
+
+func (rp *recordingProvider) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	rp.emails = append(rp.emails, toEmail+"|"+subject+"|"+textBody)
+	return nil
+}
+
+func TestSecurityNotifications(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("P@ssw0rd"), bcrypt.MinCost)
+	users["notify"] = &User{ID: "notify", Email: "notify@a.a", Password: string(hash), TotpSecretKey: "SECRET", Active: true}
+	defer delete(users, "notify")
+	rp := &recordingProvider{}
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", rp)
+	ga.MustInit(false)
+
+	var device *http.Cookie
+	login := func() {
+		rp.emails = nil
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email": "notify@a.a", "password": "P@ssw0rd", "code": "000000"}`))
+		req.Header.Set("User-Agent", "TestBrowser")
+		if device != nil {
+			req.AddCookie(device)
+		}
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "gdevice" {
+				device = c
+			}
+		}
+	}
+	// 2fa code is invalid so no login happens
+	login()
+	if len(rp.emails) != 0 || device != nil {
+		t.Fatalf("wanted no notification for failed login got %v", rp.emails)
+	}
+	users["notify"].TotpSecretKey = ""
+	login()
+	if len(rp.emails) != 1 || !strings.HasPrefix(rp.emails[0], "notify@a.a|New login to your account|") || !strings.Contains(rp.emails[0], "TestBrowser") {
+		t.Fatalf("wanted new device email got %v", rp.emails)
+	}
+	login()
+	if len(rp.emails) != 0 {
+		t.Fatalf("wanted known device got %v", rp.emails)
+	}
+
+	users["notify"].TotpSecretKey = "SECRET"
+	tok, _ := ga.CreateAccessToken(context.Background(), "notify", "access", time.Now().Add(time.Minute))
+	account := func(body string, status int, subjects ...string) {
+		rp.emails = nil
+		req := httptest.NewRequest(http.MethodPost, "/auth/account", strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		req.Header.Add("Authorization", "Bearer "+tok)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		if w.Code != status {
+			t.Fatalf("wanted %d got %d %s", status, w.Code, w.Body.String())
+		}
+		if len(rp.emails) != len(subjects) {
+			t.Fatalf("wanted %v got %v", subjects, rp.emails)
+		}
+		for i, subject := range subjects {
+			if !strings.HasPrefix(rp.emails[i], subject+"|") {
+				t.Errorf("wanted %s got %s", subject, rp.emails[i])
+			}
+		}
+	}
+	account(`{"email": "notify@a.a", "totpsecret": ""}`, http.StatusOK, "notify@a.a|Two-factor authentication disabled")
+	// the current address is told once the confirmation is sent to the new one
+	account(`{"email": "new@a.a"}`, http.StatusCreated, "new@a.a|Confirm Email Update", "notify@a.a|Email change requested")
+	if !strings.Contains(rp.emails[1], "to new@a.a was requested") {
+		t.Errorf("wanted new email in notification got %s", rp.emails[1])
+	}
+	account(`{"email": "notify@a.a", "password": "N3w@Passw0rd"}`, http.StatusOK, "notify@a.a|Your password was changed")
+
+	lockTok := regexp.MustCompile(`\?a=lock&t=(\S+)`).FindStringSubmatch(rp.emails[0])
+	if lockTok == nil {
+		t.Fatalf("lock link not found in %s", rp.emails[0])
+	}
+	lockAccount := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/auth/action", strings.NewReader(`{"action": "lock", "token": "`+token+`"}`))
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Code
+	}
+	if code := lockAccount(tok); code != http.StatusForbidden {
+		t.Errorf("wanted access token rejected got %d", code)
+	}
+	if code := lockAccount(lockTok[1]); code != http.StatusOK {
+		t.Fatalf("wanted 200 got %d", code)
+	}
+	if u := users["notify"]; u.Active || u.Password != "" {
+		t.Errorf("wanted locked account got active %v password %s", u.Active, u.Password)
+	}
+}
+
+func TestEmailPreview(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.MustInit(true)
+
+	if got := strings.Join(ga.EmailActions(), ","); got != "verify,reset,emailupdate,passwordchanged,2fadisabled,emailchange,newdevice" {
+		t.Errorf("unexpected actions %s", got)
+	}
+	msg, err := ga.PreviewEmail(context.Background(), email.ActionNewDevice, "es-MX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Locale != "es" || msg.To != "jane@example.com" || msg.Subject != "Nuevo inicio de sesión en tu cuenta" ||
+		!strings.Contains(msg.Text, "203.0.113.7") || !strings.Contains(msg.HTML, "/auth/login?a=lock&amp;t=preview") {
+		t.Errorf("unexpected preview %+v", msg)
+	}
+
+	dir := t.TempDir()
+	if err := ga.WriteEmailPreviews(context.Background(), dir, "en", "fr"); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "fr", "reset.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "Subject: Lien de réinitialisation du mot de passe\n\n") {
+		t.Errorf("unexpected reset.txt %s", b)
+	}
+	// renders are reproducible for visual regression tests
+	again := t.TempDir()
+	ga.WriteEmailPreviews(context.Background(), again, "en", "fr")
+	for _, f := range []string{"en/verify.html", "fr/emailchange.txt"} {
+		b1, _ := os.ReadFile(filepath.Join(dir, f))
+		b2, _ := os.ReadFile(filepath.Join(again, f))
+		if len(b1) == 0 || string(b1) != string(b2) {
+			t.Errorf("%s wanted same render", f)
+		}
+	}
+
+	table := []struct {
+		query string
+		code  int
+		body  string
+	}{
+		{"", http.StatusOK, `href="?action=verify&lang=de"`},
+		{"?action=reset&lang=de", http.StatusOK, "<iframe srcdoc="},
+		{"?action=verify&lang=en&format=text", http.StatusOK, "Subject: Verify Your Email"},
+		{"?action=login", http.StatusBadRequest, "invalid"},
+	}
+	for _, v := range table {
+		req := httptest.NewRequest(http.MethodGet, "/auth/email-template"+v.query, nil)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		if w.Code != v.code || !strings.Contains(w.Body.String(), v.body) {
+			t.Errorf("%s wanted %d %s got %d %s", v.query, v.code, v.body, w.Code, w.Body.String())
+		}
+	}
+
+	lastEmail = ""
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-template", strings.NewReader("action=verify&lang=en&to=qa@a.a"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if !strings.HasPrefix(lastEmail, "qa@a.a|Verify Your Email|") || !strings.Contains(w.Body.String(), "Sent to qa@a.a") {
+		t.Errorf("wanted test email got %s", lastEmail)
+	}
+}
+
+func TestCaptcha(t *testing.T) {
+	users["captcha"] = &User{ID: "captcha", Email: "captcha@a.a", Password: "secret-hash", Active: true}
+	defer delete(users, "captcha")
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	pow := captcha.NewProofOfWork(nil)
+	pow.Difficulty = 4
+	ga.Captcha = pow
+	ga.CaptchaFlows = []string{gauth.FlowRegister, gauth.FlowLogin, gauth.FlowResetLink}
+	ga.MustInit(false)
+
+	solve := func() string {
+		c := pow.Challenge()
+		for i := 0; ; i++ {
+			resp := c + ":" + strconv.Itoa(i)
+			if captcha.LeadingZeroBits(sha256.Sum256([]byte(resp))) >= pow.Difficulty {
+				return resp
+			}
+		}
+	}
+	for _, p := range []string{"/auth/login", "/auth/login?a=resetlink", "/auth/register"} {
+		req := httptest.NewRequest(http.MethodGet, p, nil)
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		if !strings.Contains(w.Body.String(), `data-provider="pow"`) {
+			t.Errorf("%s wanted captcha widget", p)
+		}
+	}
+
+	resetLink := solve()
+	table := []struct {
+		path string
+		body string
+		code int
+		err  string
+	}{
+		{"/auth/login", `{"email": "captcha@a.a", "password": "x"}`, http.StatusBadRequest, `"captcha":"required"`},
+		{"/auth/login", `{"email": "captcha@a.a", "password": "x", "captcha": "x:1"}`, http.StatusBadRequest, `"captcha":"verification failed"`},
+		{"/auth/login", `{"email": "captcha@a.a", "password": "x", "captcha": "` + solve() + `"}`, http.StatusBadRequest, `"password":"invalid"`},
+		{"/auth/action", `{"action": "resetlink", "email": "captcha@a.a"}`, http.StatusBadRequest, `"captcha":"required"`},
+		{"/auth/action", `{"action": "resetlink", "email": "captcha@a.a", "captcha": "` + resetLink + `"}`, http.StatusOK, ""},
+		{"/auth/action", `{"action": "resetlink", "email": "captcha@a.a", "captcha": "` + resetLink + `"}`, http.StatusBadRequest, `"captcha":"verification failed"`},
+		// not in CaptchaFlows
+		{"/auth/action", `{"action": "confirmemail", "email": "captcha@a.a"}`, http.StatusOK, ""},
+	}
+	for _, v := range table {
+		req := httptest.NewRequest(http.MethodPost, v.path, strings.NewReader(v.body))
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		if w.Code != v.code || !strings.Contains(w.Body.String(), v.err) {
+			t.Errorf("%s wanted %d %s got %d %s", v.body, v.code, v.err, w.Code, w.Body.String())
+		}
+	}
+
+	// reCAPTCHA keys keep working and the verify url can be replaced in tests
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Write([]byte(`{"success": ` + strconv.FormatBool(r.PostForm.Get("response") == "human") + `}`))
+	}))
+	defer srv.Close()
+	ga = gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.RecaptchaSiteKey = "key"
+	ga.RecaptchaSecret = "secret"
+	ga.MustInit(false)
+	ga.Captcha.(*captcha.SiteVerify).VerifyURL = srv.URL
+	req := httptest.NewRequest(http.MethodGet, "/auth/register", nil)
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if !strings.Contains(w.Body.String(), `data-provider="recaptcha" data-key="key"`) || !strings.Contains(w.Body.String(), "google.com/recaptcha/api.js") {
+		t.Error("wanted recaptcha widget")
+	}
+	for _, v := range []struct {
+		body string
+		code int
+	}{
+		{`{"email": "captcha2@a.a", "password": "Passw0rd!", "password_confirm": "Passw0rd!", "recaptcha": "bot"}`, http.StatusBadRequest},
+		{`{"email": "captcha2@a.a", "password": "Passw0rd!", "password_confirm": "Passw0rd!", "recaptcha": "human"}`, http.StatusCreated},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/auth/register", strings.NewReader(v.body))
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		if w.Code != v.code {
+			t.Errorf("%s wanted %d got %d %s", v.body, v.code, w.Code, w.Body.String())
+		}
+	}
+	for k, u := range users {
+		if u.Email == "captcha2@a.a" {
+			delete(users, k)
+		}
+	}
+}
+
+func TestAdaptiveCaptcha(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("P@ssw0rd"), bcrypt.MinCost)
+	users["adaptive"] = &User{ID: "adaptive", Email: "adaptive@a.a", Password: string(hash), Active: true}
+	defer delete(users, "adaptive")
+	pow := captcha.NewProofOfWork(nil)
+	pow.Difficulty = 4
+	solve := func() string {
+		c := pow.Challenge()
+		for i := 0; ; i++ {
+			resp := c + ":" + strconv.Itoa(i)
+			if captcha.LeadingZeroBits(sha256.Sum256([]byte(resp))) >= pow.Difficulty {
+				return resp
+			}
+		}
+	}
+	login := func(ga *gauth.GAuth, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w
+	}
+
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.Captcha = pow
+	ga.AdaptiveCaptcha.Identity = cache.Rate{Rate: 2, Duration: time.Minute}
+	ga.MustInit(false)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if body := w.Body.String(); !strings.Contains(body, `x-show="$store.values.captchaShown"`) || !strings.Contains(body, `data-script=""`) {
+		t.Error("wanted captcha on demand")
+	}
+	wrong := `{"email": "adaptive@a.a", "password": "wrong"}`
+	right := `{"email": "adaptive@a.a", "password": "P@ssw0rd"}`
+	table := []struct {
+		body string
+		code int
+		want string
+	}{
+		{wrong, http.StatusBadRequest, `"password":"invalid"`},
+		{wrong, http.StatusBadRequest, `"password":"invalid"`},
+		{wrong, http.StatusBadRequest, `"captcha":"required"`},
+		// a correct password gets the same response
+		{right, http.StatusBadRequest, `"captcha":"required"`},
+		{`{"email": "adaptive@a.a", "password": "P@ssw0rd", "captcha": "x:1"}`, http.StatusBadRequest, `"captcha":"verification failed"`},
+		{`{"email": "adaptive@a.a", "password": "P@ssw0rd", "captcha": "` + solve() + `"}`, http.StatusOK, "refresh_token"},
+	}
+	for i, v := range table {
+		w := login(ga, v.body)
+		if w.Code != v.code || !strings.Contains(w.Body.String(), v.want) {
+			t.Errorf("%d wanted %d %s got %d %s", i, v.code, v.want, w.Code, w.Body.String())
+		}
+	}
+
+	ga = gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.Captcha = pow
+	ga.AdaptiveCaptcha.NewDevice = true
+	ga.MustInit(false)
+	if w := login(ga, right); !strings.Contains(w.Body.String(), `"captcha":"required"`) {
+		t.Errorf("wanted captcha on new device got %s", w.Body.String())
+	}
+	w = login(ga, `{"email": "adaptive@a.a", "password": "P@ssw0rd", "captcha": "`+solve()+`"}`)
+	var device *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "gdevice" {
+			device = c
+		}
+	}
+	if w.Code != http.StatusOK || device == nil {
+		t.Fatalf("wanted login with device cookie got %d %s", w.Code, w.Body.String())
+	}
+	if w := login(ga, right, device); w.Code != http.StatusOK {
+		t.Errorf("wanted known device login without captcha got %d %s", w.Code, w.Body.String())
+	}
+
+	// a wrong 2fa code after a correct password is one attempt
+	users["adaptive"].TotpSecretKey = "SECRET"
+	ga = gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.Captcha = pow
+	ga.AdaptiveCaptcha.Identity = cache.Rate{Rate: 2, Duration: time.Minute}
+	ga.MustInit(false)
+	for i, want := range []string{`"code":"invalid"`, `"code":"invalid"`, `"captcha":"required"`} {
+		if w := login(ga, `{"email": "adaptive@a.a", "password": "P@ssw0rd", "code": "000000"}`); !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%d wanted %s got %s", i, want, w.Body.String())
+		}
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("P@ssw0rd"), bcrypt.MinCost)
+	users["csrf"] = &User{ID: "csrf", Email: "csrf@a.a", Password: string(hash), Active: true}
+	defer delete(users, "csrf")
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.AccessTokenCookieName = "atoken"
+	ga.CSRF.TrustedOrigins = []string{"https://app.example.com"}
+	ga.MustInit(false)
+	app := ga.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/login", nil)
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	var csrf *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "gcsrf" {
+			csrf = c
+		}
+	}
+	if csrf == nil || !strings.Contains(w.Body.String(), `data-csrf="`+csrf.Value+`" data-csrf-header="X-CSRF-Token"`) {
+		t.Fatalf("wanted csrf cookie and token in page")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email": "csrf@a.a", "password": "P@ssw0rd"}`))
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	rtoken := w.Result().Cookies()[len(w.Result().Cookies())-1]
+	if w.Code != http.StatusOK || rtoken.Name != "rtoken" {
+		t.Fatalf("login failed %d %s", w.Code, w.Body.String())
+	}
+	req = httptest.NewRequest(http.MethodGet, "/auth/refresh", nil)
+	req.AddCookie(rtoken)
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	var atoken *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "atoken" {
+			atoken = c
+		}
+	}
+	if atoken == nil {
+		t.Fatal("wanted access token cookie")
+	}
+	forged := &http.Cookie{Name: "gcsrf", Value: "nonce.signature"}
+
+	table := []struct {
+		name    string
+		method  string
+		path    string
+		body    string
+		cookies []*http.Cookie
+		headers map[string]string
+		code    int
+	}{
+		{"cross origin login", http.MethodPost, "/auth/login", `{}`, nil, map[string]string{"Origin": "https://evil.com"}, http.StatusForbidden},
+		{"cross origin referer", http.MethodPost, "/auth/login", `{}`, nil, map[string]string{"Referer": "https://evil.com/page"}, http.StatusForbidden},
+		{"trusted origin", http.MethodPost, "/auth/login", `{}`, nil, map[string]string{"Origin": "https://app.example.com"}, http.StatusBadRequest},
+		{"same origin", http.MethodPost, "/auth/login", `{}`, nil, map[string]string{"Origin": "http://example.com"}, http.StatusBadRequest},
+		{"logout link", http.MethodGet, "/auth/refresh?logout=1", "", []*http.Cookie{rtoken}, nil, http.StatusMethodNotAllowed},
+		{"logout without token", http.MethodDelete, "/auth/refresh", "", []*http.Cookie{rtoken, csrf}, nil, http.StatusForbidden},
+		{"logout forged token", http.MethodDelete, "/auth/refresh", "", []*http.Cookie{rtoken, forged}, map[string]string{"X-CSRF-Token": forged.Value}, http.StatusForbidden},
+		{"app without token", http.MethodPost, "/app", "", []*http.Cookie{atoken, csrf}, nil, http.StatusForbidden},
+		{"app with token", http.MethodPost, "/app", "", []*http.Cookie{atoken, csrf}, map[string]string{"X-CSRF-Token": csrf.Value}, http.StatusOK},
+		{"app get", http.MethodGet, "/app", "", []*http.Cookie{atoken}, nil, http.StatusOK},
+		{"app bearer", http.MethodPost, "/app", "", nil, map[string]string{"Authorization": "Bearer " + atoken.Value, "Origin": "https://evil.com"}, http.StatusOK},
+		{"logout form", http.MethodPost, "/auth/refresh?logout=1", "csrf_token=" + csrf.Value, []*http.Cookie{rtoken, csrf}, map[string]string{"Content-Type": "application/x-www-form-urlencoded"}, http.StatusSeeOther},
+	}
+	for _, v := range table {
+		var body io.Reader
+		if v.body != "" {
+			body = strings.NewReader(v.body)
+		}
+		req := httptest.NewRequest(v.method, v.path, body)
+		for _, c := range v.cookies {
+			req.AddCookie(c)
+		}
+		for k, h := range v.headers {
+			req.Header.Set(k, h)
+		}
+		w := httptest.NewRecorder()
+		if v.path == "/app" {
+			app.ServeHTTP(w, req)
+		} else {
+			ga.ServeHTTP(w, req)
+		}
+		if w.Code != v.code {
+			t.Errorf("%s wanted %d got %d %s", v.name, v.code, w.Code, w.Body.String())
+		}
+	}
+	req = httptest.NewRequest(http.MethodPost, "/auth/refresh?logout=1", strings.NewReader("csrf_token="+csrf.Value))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(rtoken)
+	req.AddCookie(csrf)
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	cleared := false
+	for _, c := range w.Result().Cookies() {
+		cleared = cleared || (c.Name == "rtoken" && c.MaxAge < 0)
+	}
+	if w.Header().Get("Location") != "/auth/login" || !cleared {
+		t.Errorf("wanted logout redirect got %s", w.Header().Get("Location"))
+	}
+}
+
+func TestCookies(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("P@ssw0rd"), bcrypt.MinCost)
+	users["cookies"] = &User{ID: "cookies", Email: "cookies@a.a", Password: string(hash), Active: true}
+	defer delete(users, "cookies")
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("wanted panic for __Host- with Domain")
+			}
+		}()
+		ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+		ga.Cookies = gauth.Cookies{Prefix: gauth.CookiePrefixHost, Domain: "example.com"}
+		ga.MustInit(false)
+	}()
+
+	login := func(ga *gauth.GAuth) []string {
+		req := httptest.NewRequest(http.MethodPost, "/auth/login", strings.NewReader(`{"email": "cookies@a.a", "password": "P@ssw0rd"}`))
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("login failed %d %s", w.Code, w.Body.String())
+		}
+		return w.Result().Header.Values("Set-Cookie")
+	}
+	find := func(cookies []string, name string) string {
+		for _, c := range cookies {
+			if strings.HasPrefix(c, name+"=") {
+				return c
+			}
+		}
+		return ""
+	}
+
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.Cookies = gauth.Cookies{Prefix: gauth.CookiePrefixHost}
+	ga.MustInit(true)
+	cookies := login(ga)
+	rtoken := find(cookies, "__Host-rtoken")
+	if rtoken == "" || !strings.Contains(rtoken, "Path=/;") || !strings.Contains(rtoken, "Secure") ||
+		strings.Contains(rtoken, "Domain") || !strings.Contains(rtoken, "SameSite=Strict") {
+		t.Fatalf("wanted __Host- refresh cookie on / got %v", cookies)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/auth/refresh", nil)
+	req.Header.Set("Cookie", strings.SplitN(rtoken, ";", 2)[0])
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "access_token") {
+		t.Fatalf("wanted refresh with prefixed cookie got %d %s", w.Code, w.Body.String())
+	}
+
+	ga = gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.Cookies = gauth.Cookies{Domain: "example.com", SameSite: http.SameSiteNoneMode, Partitioned: true}
+	ga.MustInit(false)
+	cookies = login(ga)
+	rtoken = find(cookies, "rtoken")
+	if !strings.Contains(rtoken, "Domain=example.com") || !strings.Contains(rtoken, "SameSite=None") ||
+		!strings.Contains(rtoken, "Secure") || !strings.HasSuffix(rtoken, "; Partitioned") {
+		t.Fatalf("wanted shared partitioned cookie got %v", cookies)
+	}
+	if device := find(cookies, "gdevice"); !strings.HasSuffix(device, "; Partitioned") {
+		t.Fatalf("wanted partitioned device cookie got %v", cookies)
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	ga := gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.Brand.LogoURL = "https://cdn.example.com/logo.png"
+	ga.Captcha = captcha.NewTurnstile("site", "secret")
+	ga.MustInit(false)
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/register", nil)
+	w := httptest.NewRecorder()
+	ga.ServeHTTP(w, req)
+	h := w.Result().Header
+	csp := h.Get("Content-Security-Policy")
+	nonce := regexp.MustCompile(`'nonce-([^']+)'`).FindStringSubmatch(csp)
+	if nonce == nil {
+		t.Fatalf("wanted nonce in policy got %s", csp)
+	}
+	for _, want := range []string{"'strict-dynamic'", "frame-ancestors 'none'", "img-src 'self' data: https://cdn.example.com",
+		"frame-src https://challenges.cloudflare.com", "object-src 'none'"} {
+		if !strings.Contains(csp, want) {
+			t.Errorf("wanted %s in policy got %s", want, csp)
+		}
+	}
+	body := w.Body.String()
+	if strings.Count(body, `nonce="`+nonce[1]+`"`) != 4 {
+		t.Errorf("wanted nonce on style and scripts got %s", body)
+	}
+	if h.Get("X-Frame-Options") != "DENY" || h.Get("Cache-Control") != "no-store" || h.Get("Referrer-Policy") != "same-origin" {
+		t.Errorf("wanted security headers got %v", h)
+	}
+
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/register", nil))
+	if strings.Contains(w.Result().Header.Get("Content-Security-Policy"), nonce[1]) {
+		t.Error("wanted a new nonce per request")
+	}
+
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/login?a=reset&t=token", nil))
+	if w.Result().Header.Get("Referrer-Policy") != "no-referrer" {
+		t.Errorf("wanted no-referrer on token pages got %v", w.Result().Header)
+	}
+
+	ga = gauth.NewDefault("Demo Memory", "http://localhost:8887", &memoryProvider{})
+	ga.SecurityHeaders.FrameAncestors = []string{"https://app.example.com"}
+	ga.MustInit(false)
+	w = httptest.NewRecorder()
+	ga.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	h = w.Result().Header
+	if h.Get("X-Frame-Options") != "" || !strings.Contains(h.Get("Content-Security-Policy"), "frame-ancestors https://app.example.com") {
+		t.Errorf("wanted framing by app got %v", h)
+	}
+}
+
+func TestEmailTokens(t *testing.T) {
+	users["links"] = &User{ID: "links", Email: "links@a.a", Active: true}
+	defer delete(users, "links")
+	rp := &recordingProvider{}
+	ga := gauth.NewPasswordless("Demo Memory", "http://localhost:8887", rp)
+	ga.JwtKey = []byte("secret")
+	ga.MustInit(false)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		var rd io.Reader
+		if body != "" {
+			rd = strings.NewReader(body)
+		}
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, httptest.NewRequest(method, path, rd))
+		return w
+	}
+	if w := send(http.MethodPost, "/auth/login", `{"email": "links@a.a"}`); w.Code != http.StatusCreated {
+		t.Fatalf("wanted login link got %d %s", w.Code, w.Body.String())
+	}
+	tok := regexp.MustCompile(`\?a=login&t=(\S+)`).FindStringSubmatch(rp.emails[0])[1]
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tok, claims); err != nil || claims["jti"] == "" {
+		t.Fatalf("wanted jti got %v %v", claims, err)
+	}
+	if exp := time.Unix(int64(claims["exp"].(float64)), 0); time.Until(exp) > 15*time.Minute || time.Until(exp) < 14*time.Minute {
+		t.Errorf("wanted login link to expire in 15 minutes got %v", exp)
+	}
+
+	if w := send(http.MethodPost, "/auth/login", `{"token": "`+tok+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("wanted login got %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodPost, "/auth/login", `{"token": "`+tok+`"}`); w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "link already used") {
+		t.Fatalf("wanted used link got %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodGet, "/auth/login?a=login&t="+tok, ""); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/auth/login?a=linkused" {
+		t.Fatalf("wanted redirect to used page got %d %v", w.Code, w.Header())
+	}
+	if w := send(http.MethodGet, "/auth/login?a=linkused", ""); !strings.Contains(w.Body.String(), "This link was already used") || strings.Contains(w.Body.String(), `type="submit"`) {
+		t.Errorf("wanted used link page got %s", w.Body.String())
+	}
+
+	expired := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"uid": "links@a.a", "act": "login", "jti": "expired", "exp": time.Now().Add(-time.Minute).Unix(),
+	})
+	tok, _ = expired.SignedString(ga.JwtKey)
+	if w := send(http.MethodPost, "/auth/login", `{"token": "`+tok+`"}`); w.Code != http.StatusGone || !strings.Contains(w.Body.String(), "link expired") {
+		t.Fatalf("wanted expired link got %d %s", w.Code, w.Body.String())
+	}
+	if w := send(http.MethodGet, "/auth/login?a=login&t="+tok, ""); w.Header().Get("Location") != "/auth/login?a=linkexpired" {
+		t.Fatalf("wanted redirect to expired page got %d %v", w.Code, w.Header())
+	}
+	noJTI := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"uid": "links@a.a", "act": "login", "exp": time.Now().Add(time.Minute).Unix(),
+	})
+	tok, _ = noJTI.SignedString(ga.JwtKey)
+	if w := send(http.MethodPost, "/auth/login", `{"token": "`+tok+`"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("wanted reusable token rejected got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDefaultEmailTokenProvider(t *testing.T) {
+	ctx := context.Background()
+	de := gauth.NewDefaultEmailTokenProvider()
+	if err := de.EmailTokenUse(ctx, "first", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := de.EmailTokenUse(ctx, "old", time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// many links used after it don't make a used link usable again
+	for i := 0; i < 20000; i++ {
+		de.EmailTokenUse(ctx, strconv.Itoa(i), time.Now().Add(time.Hour))
+	}
+	if err := de.EmailTokenUse(ctx, "first", time.Now().Add(time.Hour)); err != gauth.ErrTokenUsed {
+		t.Errorf("wanted used link got %v", err)
+	}
+	if used, _ := de.EmailTokenUsed(ctx, "first"); !used {
+		t.Error("wanted first used")
+	}
+	if used, _ := de.EmailTokenUsed(ctx, "old"); used {
+		t.Error("wanted expired link swept")
+	}
+}
+
+func TestLockRevokesPasswordless(t *testing.T) {
+	users["lockless"] = &User{ID: "lockless", Email: "lockless@a.a", Active: true}
+	defer delete(users, "lockless")
+	rp := &defaultTokensProvider{}
+	ga := gauth.NewPasswordless("Demo Memory", "http://localhost:8887", rp)
+	ga.MustInit(false)
+
+	send := func(path, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	send("/auth/login", `{"email": "lockless@a.a"}`)
+	loginTok := regexp.MustCompile(`\?a=login&t=(\S+)`).FindStringSubmatch(strings.Join(rp.emails, " "))
+	if loginTok == nil {
+		t.Fatalf("login link not found in %v", rp.emails)
+	}
+	rp.emails = nil
+	code, body := send("/auth/login", `{"token": "`+loginTok[1]+`"}`)
+	if code != http.StatusOK {
+		t.Fatalf("wanted login got %d %s", code, body)
+	}
+	var refresh struct {
+		Token string `json:"refresh_token"`
+	}
+	json.Unmarshal([]byte(body), &refresh)
+	if code, body := send("/auth/refresh", `{"token":"`+refresh.Token+`"}`); code != http.StatusOK {
+		t.Fatalf("wanted refresh got %d %s", code, body)
+	}
+	lockTok := regexp.MustCompile(`\?a=lock&t=(\S+)`).FindStringSubmatch(strings.Join(rp.emails, " "))
+	if lockTok == nil {
+		t.Fatalf("lock link not found in %v", rp.emails)
+	}
+	if code, body := send("/auth/action", `{"action": "lock", "token": "`+lockTok[1]+`"}`); code != http.StatusOK {
+		t.Fatalf("wanted lock got %d %s", code, body)
+	}
+	if code, _ := send("/auth/refresh", `{"token":"`+refresh.Token+`"}`); code != http.StatusUnauthorized {
+		t.Fatalf("wanted refresh after lock to fail got %d", code)
+	}
+}
+
+// noActiveUser is an Identity without an active field
+type noActiveUser struct {
+	ID    string
+	Email string `gauth:"email"`
+}
+
+var noActiveUsers = make(map[string]*noActiveUser)
+
+func (u *noActiveUser) IdentitySave(ctx context.Context) (string, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if u.ID == "" {
+		u.ID = "na" + strconv.Itoa(len(noActiveUsers)+1)
+	}
+	noActiveUsers[u.ID] = u
+	return u.ID, nil
+}
+
+type noActiveProvider struct {
+	emails []string
+}
+
+func (np *noActiveProvider) IdentityUID(ctx context.Context, id string) (string, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	for k, v := range noActiveUsers {
+		if v.Email == id {
+			return k, nil
+		}
+	}
+	return "", gauth.ErrIdentityNotFound
+}
+
+func (np *noActiveProvider) IdentityLoad(ctx context.Context, uid string) (gauth.Identity, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if u, ok := noActiveUsers[uid]; ok {
+		c := *u
+		return &c, nil
+	}
+	return &noActiveUser{}, gauth.ErrIdentityNotFound
+}
+
+func (np *noActiveProvider) SendEmail(ctx context.Context, toEmail, subject, textBody, htmlBody string) error {
+	np.emails = append(np.emails, toEmail+"|"+subject+"|"+textBody)
+	return nil
+}
+
+func TestLockRequiresActiveField(t *testing.T) {
+	noActiveUsers["na"] = &noActiveUser{ID: "na", Email: "na@a.a"}
+	defer delete(noActiveUsers, "na")
+	np := &noActiveProvider{}
+	ga := gauth.NewPasswordless("Demo Memory", "http://localhost:8887", np)
+	ga.MustInit(false)
+
+	send := func(path, body string) (int, string) {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		ga.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+	send("/auth/login", `{"email": "na@a.a"}`)
+	loginTok := regexp.MustCompile(`\?a=login&t=(\S+)`).FindStringSubmatch(strings.Join(np.emails, " "))
+	if loginTok == nil {
+		t.Fatalf("login link not found in %v", np.emails)
+	}
+	np.emails = nil
+	if code, body := send("/auth/login", `{"token": "`+loginTok[1]+`"}`); code != http.StatusOK {
+		t.Fatalf("wanted login got %d %s", code, body)
+	}
+	lockTok := regexp.MustCompile(`\?a=lock&t=(\S+)`).FindStringSubmatch(strings.Join(np.emails, " "))
+	if lockTok == nil {
+		t.Fatalf("lock link not found in %v", np.emails)
+	}
+	// the lock can't deny the sessions so it fails instead of pretending it worked
+	for i := 0; i < 2; i++ {
+		if code, _ := send("/auth/action", `{"action": "lock", "token": "`+lockTok[1]+`"}`); code != http.StatusInternalServerError {
+			t.Fatalf("wanted lock to fail without active field got %d", code)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 module github.com/altlimit/gauth
 
-go 1.16
+go 1.20
 
 require golang.org/x/crypto v0.0.0-20220622213112-05595931fe9d
 
 require (
 	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
-	github.com/golang-jwt/jwt/v4 v4.4.2 // indirect
-	github.com/pquerna/otp v1.3.0 // indirect
+	github.com/golang-jwt/jwt/v4 v4.4.2
+	github.com/pquerna/otp v1.3.0
 )
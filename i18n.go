@@ -0,0 +1,67 @@
+package gauth
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/altlimit/gauth/i18n"
+)
+
+// LocaleFromContext returns the language negotiated for the request, empty outside of gauth handlers
+func LocaleFromContext(ctx context.Context) string {
+	l, _ := ctx.Value(LocaleKey).(string)
+	return l
+}
+
+// withLocale stores the locale of the request in its context from ?lang=, the locale cookie or
+// Accept-Language in that order, a supported ?lang= is remembered in the cookie.
+func (ga *GAuth) withLocale(w http.ResponseWriter, r *http.Request) *http.Request {
+	if ga.I18n == nil {
+		return r
+	}
+	var prefs []string
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		if ga.LocaleCookieName != "" && ga.I18n.Supported(lang) {
+			ga.setCookie(w, &http.Cookie{
+				Name:     ga.LocaleCookieName,
+				Value:    ga.I18n.Match(lang),
+				Path:     "/",
+				MaxAge:   365 * 24 * 60 * 60,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		prefs = append(prefs, lang)
+	}
+	if ga.LocaleCookieName != "" {
+		if c, err := ga.cookie(r, ga.LocaleCookieName); err == nil {
+			prefs = append(prefs, c.Value)
+		}
+	}
+	prefs = append(prefs, i18n.ParseAcceptLanguage(r.Header.Get("Accept-Language"))...)
+	return r.WithContext(context.WithValue(r.Context(), LocaleKey, ga.I18n.Match(prefs...)))
+}
+
+// recipientLocale prefers the language saved in the identity's LocaleFieldID
+func (ga *GAuth) recipientLocale(ctx context.Context, data map[string]interface{}) string {
+	if ga.I18n == nil {
+		return ""
+	}
+	if ga.LocaleFieldID != "" {
+		if l := toString(data[ga.LocaleFieldID]); l != "" {
+			return ga.I18n.Match(l)
+		}
+	}
+	if l := LocaleFromContext(ctx); l != "" {
+		return l
+	}
+	return ga.I18n.Match()
+}
+
+// t translates msg to locale and replaces its {name} placeholders
+func (ga *GAuth) t(locale string, msg string, values map[string]interface{}) string {
+	if ga.I18n != nil && locale != "" {
+		msg = ga.I18n.T(locale, msg)
+	}
+	return i18n.Format(msg, values)
+}
@@ -0,0 +1,381 @@
+package i18n
+
+// defaultCatalogs translates the built-in forms, validation errors, notifications and emails
+var defaultCatalogs = map[string]Catalog{
+	"en": {},
+	"es": {
+		// forms
+		"Login":                   "Iniciar sesión",
+		"Register":                "Registrarse",
+		"Forgot Password":         "Olvidé mi contraseña",
+		"Send Reset Link":         "Enviar enlace de restablecimiento",
+		"Reset Password":          "Restablecer contraseña",
+		"Update":                  "Actualizar",
+		"Login or Register":       "Iniciar sesión o registrarse",
+		"Send Link":               "Enviar enlace",
+		"Enter Code":              "Introduce el código",
+		"Remember":                "Recordarme",
+		"Settings":                "Configuración",
+		"Save":                    "Guardar",
+		"Email":                   "Correo electrónico",
+		"Password":                "Contraseña",
+		"Re-Type Password":        "Repite la contraseña",
+		"Confirm Password":        "Confirma la contraseña",
+		"Account":                 "Cuenta",
+		"2FA":                     "2FA",
+		"API Keys":                "Claves API",
+		"Organizations":           "Organizaciones",
+		"Home":                    "Inicio",
+		"Logout":                  "Cerrar sesión",
+		"Reset 2FA":               "Restablecer 2FA",
+		"Generate Recovery Codes": "Generar códigos de recuperación",
+		"This will only be shown to you once. Hit save to activate.": "Solo se mostrará una vez. Pulsa guardar para activarlo.",
+		"Copy this key now, it will only be shown to you once.":      "Copia esta clave ahora, solo se mostrará una vez.",
+		"Name":                               "Nombre",
+		"Expires In Days (optional)":         "Caduca en días (opcional)",
+		"Scopes (comma separated, optional)": "Ámbitos (separados por comas, opcional)",
+		"Create API Key":                     "Crear clave API",
+		"Scopes":                             "Ámbitos",
+		"Expires":                            "Caduca",
+		"Last Used":                          "Último uso",
+		"Revoke":                             "Revocar",
+		"Organization":                       "Organización",
+		"Role":                               "Rol",
+		"Active":                             "Activa",
+		"Switch":                             "Cambiar",
+		"Members":                            "Miembros",
+		"New Organization":                   "Nueva organización",
+		"Create Organization":                "Crear organización",
+		"Invite Email":                       "Correo a invitar",
+		"Send Invitation":                    "Enviar invitación",
+		"Leave Organization":                 "Salir de la organización",
+		"Remove":                             "Eliminar",
+		"Owner":                              "Propietario",
+		"Admin":                              "Administrador",
+		"Member":                             "Miembro",
+		"Re-Send Verification Link":          "Reenviar enlace de verificación",
+		"Try again in {seconds}s":            "Inténtalo de nuevo en {seconds}s",
+		// notifications
+		"An error has occurred.":  "Se ha producido un error.",
+		"Email Verified":          "Correo verificado",
+		"Email updated!":          "¡Correo actualizado!",
+		"Updated!":                "¡Actualizado!",
+		"Revoke this API key?":    "¿Revocar esta clave API?",
+		"Reset link sent!":        "¡Enlace de restablecimiento enviado!",
+		"Password updated!":       "¡Contraseña actualizada!",
+		"Confirmation link sent!": "¡Enlace de confirmación enviado!",
+		"Email confirmation link sent to your email.": "Te enviamos un enlace de confirmación a tu correo.",
+		"Registration success!":                       "¡Registro completado!",
+		"Email update link sent to your email.":       "Te enviamos un enlace para actualizar tu correo.",
+		"You joined {org}!":                           "¡Te uniste a {org}!",
+		"Invitation sent to {email}.":                 "Invitación enviada a {email}.",
+		"An email was sent to {email}.":               "Se envió un correo a {email}.",
+		// validation
+		"required":                     "obligatorio",
+		"invalid":                      "no válido",
+		"inactive":                     "inactivo",
+		"not found":                    "no encontrado",
+		"too long":                     "demasiado largo",
+		"enter a valid email":          "introduce un correo válido",
+		"must be 7 characters":         "debe tener 7 caracteres",
+		"must have upper case":         "debe tener mayúsculas",
+		"must have lower case":         "debe tener minúsculas",
+		"must have number":             "debe tener un número",
+		"must have special characters": "debe tener caracteres especiales",
+		"already registered":           "ya registrado",
+		"already a member":             "ya es miembro",
+		"verification failed":          "verificación fallida",
+		"can't change your own role":   "no puedes cambiar tu propio rol",
+		"can't remove yourself":        "no puedes eliminarte a ti mismo",
+		"owner can't leave":            "el propietario no puede salir",
+		"Try again later":              "Inténtalo más tarde",
+		"invited":                      "invitado",
+		"API key revoked!":             "¡Clave API revocada!",
+		"password do not match":        "las contraseñas no coinciden",
+		"Verifying your browser...":    "Verificando tu navegador...",
+		"identity not found":           "identidad no encontrada",
+		"link already used":            "el enlace ya fue usado",
+		"link expired":                 "el enlace expiró",
+		"Link Already Used":            "Enlace ya usado",
+		"Link Expired":                 "Enlace expirado",
+		"This link was already used, request a new one if you still need it.": "Este enlace ya fue usado, solicita uno nuevo si aún lo necesitas.",
+		"This link has expired, request a new one to continue.":               "Este enlace ha expirado, solicita uno nuevo para continuar.",
+		"owner":  "propietario",
+		"admin":  "administrador",
+		"member": "miembro",
+		// emails
+		"Login / Register Link":                      "Enlace para iniciar sesión o registrarse",
+		"Click the link below to login or register":  "Haz clic en el enlace para iniciar sesión o registrarte",
+		"Verify Your Email":                          "Verifica tu correo",
+		"Click the link below to verify your email.": "Haz clic en el enlace para verificar tu correo.",
+		"Verify":               "Verificar",
+		"Confirm Email Update": "Confirma el cambio de correo",
+		"Click the link below to update your email.":                        "Haz clic en el enlace para actualizar tu correo.",
+		"Invitation to {org_name}":                                          "Invitación a {org_name}",
+		"You have been invited to join {org_name} as {role}.":               "Te han invitado a unirte a {org_name} como {role}.",
+		"Accept Invitation":                                                 "Aceptar invitación",
+		"Password Reset Link":                                               "Enlace para restablecer la contraseña",
+		"Click the link below to reset your password.":                      "Haz clic en el enlace para restablecer tu contraseña.",
+		"Your password was changed":                                         "Tu contraseña fue cambiada",
+		"The password of your account was changed.":                         "La contraseña de tu cuenta fue cambiada.",
+		"If this wasn't you, lock your account and reset your password.":    "Si no fuiste tú, bloquea tu cuenta y restablece tu contraseña.",
+		"This wasn't me":                                                    "No fui yo",
+		"Two-factor authentication disabled":                                "Autenticación de dos factores desactivada",
+		"Two-factor authentication was disabled on your account.":           "La autenticación de dos factores fue desactivada en tu cuenta.",
+		"Email change requested":                                            "Cambio de correo solicitado",
+		"A change of your account email to {new_email} was requested.":      "Se solicitó cambiar el correo de tu cuenta a {new_email}.",
+		"New login to your account":                                         "Nuevo inicio de sesión en tu cuenta",
+		"Your account was accessed from a new device ({ip}, {user_agent}).": "Se accedió a tu cuenta desde un nuevo dispositivo ({ip}, {user_agent}).",
+		"Your account is locked.":                                           "Tu cuenta está bloqueada.",
+	},
+	"fr": {
+		// forms
+		"Login":                   "Connexion",
+		"Register":                "Inscription",
+		"Forgot Password":         "Mot de passe oublié",
+		"Send Reset Link":         "Envoyer le lien de réinitialisation",
+		"Reset Password":          "Réinitialiser le mot de passe",
+		"Update":                  "Mettre à jour",
+		"Login or Register":       "Connexion ou inscription",
+		"Send Link":               "Envoyer le lien",
+		"Enter Code":              "Saisissez le code",
+		"Remember":                "Se souvenir de moi",
+		"Settings":                "Paramètres",
+		"Save":                    "Enregistrer",
+		"Email":                   "E-mail",
+		"Password":                "Mot de passe",
+		"Re-Type Password":        "Retapez le mot de passe",
+		"Confirm Password":        "Confirmez le mot de passe",
+		"Account":                 "Compte",
+		"2FA":                     "2FA",
+		"API Keys":                "Clés API",
+		"Organizations":           "Organisations",
+		"Home":                    "Accueil",
+		"Logout":                  "Déconnexion",
+		"Reset 2FA":               "Réinitialiser la 2FA",
+		"Generate Recovery Codes": "Générer des codes de récupération",
+		"This will only be shown to you once. Hit save to activate.": "Ceci ne sera affiché qu'une fois. Enregistrez pour l'activer.",
+		"Copy this key now, it will only be shown to you once.":      "Copiez cette clé maintenant, elle ne sera affichée qu'une fois.",
+		"Name":                               "Nom",
+		"Expires In Days (optional)":         "Expire dans (jours, facultatif)",
+		"Scopes (comma separated, optional)": "Portées (séparées par des virgules, facultatif)",
+		"Create API Key":                     "Créer une clé API",
+		"Scopes":                             "Portées",
+		"Expires":                            "Expire",
+		"Last Used":                          "Dernière utilisation",
+		"Revoke":                             "Révoquer",
+		"Organization":                       "Organisation",
+		"Role":                               "Rôle",
+		"Active":                             "Active",
+		"Switch":                             "Basculer",
+		"Members":                            "Membres",
+		"New Organization":                   "Nouvelle organisation",
+		"Create Organization":                "Créer l'organisation",
+		"Invite Email":                       "E-mail à inviter",
+		"Send Invitation":                    "Envoyer l'invitation",
+		"Leave Organization":                 "Quitter l'organisation",
+		"Remove":                             "Retirer",
+		"Owner":                              "Propriétaire",
+		"Admin":                              "Administrateur",
+		"Member":                             "Membre",
+		"Re-Send Verification Link":          "Renvoyer le lien de vérification",
+		"Try again in {seconds}s":            "Réessayez dans {seconds}s",
+		// notifications
+		"An error has occurred.":  "Une erreur s'est produite.",
+		"Email Verified":          "E-mail vérifié",
+		"Email updated!":          "E-mail mis à jour !",
+		"Updated!":                "Mis à jour !",
+		"Revoke this API key?":    "Révoquer cette clé API ?",
+		"Reset link sent!":        "Lien de réinitialisation envoyé !",
+		"Password updated!":       "Mot de passe mis à jour !",
+		"Confirmation link sent!": "Lien de confirmation envoyé !",
+		"Email confirmation link sent to your email.": "Un lien de confirmation a été envoyé à votre e-mail.",
+		"Registration success!":                       "Inscription réussie !",
+		"Email update link sent to your email.":       "Un lien de mise à jour a été envoyé à votre e-mail.",
+		"You joined {org}!":                           "Vous avez rejoint {org} !",
+		"Invitation sent to {email}.":                 "Invitation envoyée à {email}.",
+		"An email was sent to {email}.":               "Un e-mail a été envoyé à {email}.",
+		// validation
+		"required":                     "obligatoire",
+		"invalid":                      "invalide",
+		"inactive":                     "inactif",
+		"not found":                    "introuvable",
+		"too long":                     "trop long",
+		"enter a valid email":          "saisissez un e-mail valide",
+		"must be 7 characters":         "doit contenir 7 caractères",
+		"must have upper case":         "doit contenir une majuscule",
+		"must have lower case":         "doit contenir une minuscule",
+		"must have number":             "doit contenir un chiffre",
+		"must have special characters": "doit contenir des caractères spéciaux",
+		"already registered":           "déjà inscrit",
+		"already a member":             "déjà membre",
+		"verification failed":          "échec de la vérification",
+		"can't change your own role":   "vous ne pouvez pas changer votre propre rôle",
+		"can't remove yourself":        "vous ne pouvez pas vous retirer",
+		"owner can't leave":            "le propriétaire ne peut pas quitter",
+		"Try again later":              "Réessayez plus tard",
+		"invited":                      "invité",
+		"API key revoked!":             "Clé API révoquée !",
+		"password do not match":        "les mots de passe ne correspondent pas",
+		"Verifying your browser...":    "Vérification de votre navigateur...",
+		"identity not found":           "identité introuvable",
+		"link already used":            "lien déjà utilisé",
+		"link expired":                 "lien expiré",
+		"Link Already Used":            "Lien déjà utilisé",
+		"Link Expired":                 "Lien expiré",
+		"This link was already used, request a new one if you still need it.": "Ce lien a déjà été utilisé, demandez-en un nouveau si vous en avez encore besoin.",
+		"This link has expired, request a new one to continue.":               "Ce lien a expiré, demandez-en un nouveau pour continuer.",
+		"owner":  "propriétaire",
+		"admin":  "administrateur",
+		"member": "membre",
+		// emails
+		"Login / Register Link":                      "Lien de connexion ou d'inscription",
+		"Click the link below to login or register":  "Cliquez sur le lien ci-dessous pour vous connecter ou vous inscrire",
+		"Verify Your Email":                          "Vérifiez votre e-mail",
+		"Click the link below to verify your email.": "Cliquez sur le lien ci-dessous pour vérifier votre e-mail.",
+		"Verify":               "Vérifier",
+		"Confirm Email Update": "Confirmez le changement d'e-mail",
+		"Click the link below to update your email.":                        "Cliquez sur le lien ci-dessous pour mettre à jour votre e-mail.",
+		"Invitation to {org_name}":                                          "Invitation à {org_name}",
+		"You have been invited to join {org_name} as {role}.":               "Vous avez été invité à rejoindre {org_name} en tant que {role}.",
+		"Accept Invitation":                                                 "Accepter l'invitation",
+		"Password Reset Link":                                               "Lien de réinitialisation du mot de passe",
+		"Click the link below to reset your password.":                      "Cliquez sur le lien ci-dessous pour réinitialiser votre mot de passe.",
+		"Your password was changed":                                         "Votre mot de passe a été modifié",
+		"The password of your account was changed.":                         "Le mot de passe de votre compte a été modifié.",
+		"If this wasn't you, lock your account and reset your password.":    "Si ce n'était pas vous, verrouillez votre compte et réinitialisez votre mot de passe.",
+		"This wasn't me":                                                    "Ce n'était pas moi",
+		"Two-factor authentication disabled":                                "Authentification à deux facteurs désactivée",
+		"Two-factor authentication was disabled on your account.":           "L'authentification à deux facteurs a été désactivée sur votre compte.",
+		"Email change requested":                                            "Changement d'e-mail demandé",
+		"A change of your account email to {new_email} was requested.":      "Un changement de l'e-mail de votre compte vers {new_email} a été demandé.",
+		"New login to your account":                                         "Nouvelle connexion à votre compte",
+		"Your account was accessed from a new device ({ip}, {user_agent}).": "Votre compte a été utilisé depuis un nouvel appareil ({ip}, {user_agent}).",
+		"Your account is locked.":                                           "Votre compte est verrouillé.",
+	},
+	"de": {
+		// forms
+		"Login":                   "Anmelden",
+		"Register":                "Registrieren",
+		"Forgot Password":         "Passwort vergessen",
+		"Send Reset Link":         "Link zum Zurücksetzen senden",
+		"Reset Password":          "Passwort zurücksetzen",
+		"Update":                  "Aktualisieren",
+		"Login or Register":       "Anmelden oder registrieren",
+		"Send Link":               "Link senden",
+		"Enter Code":              "Code eingeben",
+		"Remember":                "Angemeldet bleiben",
+		"Settings":                "Einstellungen",
+		"Save":                    "Speichern",
+		"Email":                   "E-Mail",
+		"Password":                "Passwort",
+		"Re-Type Password":        "Passwort wiederholen",
+		"Confirm Password":        "Passwort bestätigen",
+		"Account":                 "Konto",
+		"2FA":                     "2FA",
+		"API Keys":                "API-Schlüssel",
+		"Organizations":           "Organisationen",
+		"Home":                    "Startseite",
+		"Logout":                  "Abmelden",
+		"Reset 2FA":               "2FA zurücksetzen",
+		"Generate Recovery Codes": "Wiederherstellungscodes erzeugen",
+		"This will only be shown to you once. Hit save to activate.": "Dies wird nur einmal angezeigt. Zum Aktivieren speichern.",
+		"Copy this key now, it will only be shown to you once.":      "Kopieren Sie den Schlüssel jetzt, er wird nur einmal angezeigt.",
+		"Name":                               "Name",
+		"Expires In Days (optional)":         "Läuft ab in Tagen (optional)",
+		"Scopes (comma separated, optional)": "Bereiche (kommagetrennt, optional)",
+		"Create API Key":                     "API-Schlüssel erstellen",
+		"Scopes":                             "Bereiche",
+		"Expires":                            "Läuft ab",
+		"Last Used":                          "Zuletzt verwendet",
+		"Revoke":                             "Widerrufen",
+		"Organization":                       "Organisation",
+		"Role":                               "Rolle",
+		"Active":                             "Aktiv",
+		"Switch":                             "Wechseln",
+		"Members":                            "Mitglieder",
+		"New Organization":                   "Neue Organisation",
+		"Create Organization":                "Organisation erstellen",
+		"Invite Email":                       "E-Mail einladen",
+		"Send Invitation":                    "Einladung senden",
+		"Leave Organization":                 "Organisation verlassen",
+		"Remove":                             "Entfernen",
+		"Owner":                              "Inhaber",
+		"Admin":                              "Administrator",
+		"Member":                             "Mitglied",
+		"Re-Send Verification Link":          "Bestätigungslink erneut senden",
+		"Try again in {seconds}s":            "Erneut versuchen in {seconds}s",
+		// notifications
+		"An error has occurred.":  "Ein Fehler ist aufgetreten.",
+		"Email Verified":          "E-Mail bestätigt",
+		"Email updated!":          "E-Mail aktualisiert!",
+		"Updated!":                "Aktualisiert!",
+		"Revoke this API key?":    "Diesen API-Schlüssel widerrufen?",
+		"Reset link sent!":        "Link zum Zurücksetzen gesendet!",
+		"Password updated!":       "Passwort aktualisiert!",
+		"Confirmation link sent!": "Bestätigungslink gesendet!",
+		"Email confirmation link sent to your email.": "Ein Bestätigungslink wurde an Ihre E-Mail gesendet.",
+		"Registration success!":                       "Registrierung erfolgreich!",
+		"Email update link sent to your email.":       "Ein Link zum Ändern der E-Mail wurde gesendet.",
+		"You joined {org}!":                           "Sie sind {org} beigetreten!",
+		"Invitation sent to {email}.":                 "Einladung an {email} gesendet.",
+		"An email was sent to {email}.":               "Eine E-Mail wurde an {email} gesendet.",
+		// validation
+		"required":                     "erforderlich",
+		"invalid":                      "ungültig",
+		"inactive":                     "inaktiv",
+		"not found":                    "nicht gefunden",
+		"too long":                     "zu lang",
+		"enter a valid email":          "gültige E-Mail eingeben",
+		"must be 7 characters":         "muss 7 Zeichen lang sein",
+		"must have upper case":         "muss Großbuchstaben enthalten",
+		"must have lower case":         "muss Kleinbuchstaben enthalten",
+		"must have number":             "muss eine Zahl enthalten",
+		"must have special characters": "muss Sonderzeichen enthalten",
+		"already registered":           "bereits registriert",
+		"already a member":             "bereits Mitglied",
+		"verification failed":          "Überprüfung fehlgeschlagen",
+		"can't change your own role":   "eigene Rolle kann nicht geändert werden",
+		"can't remove yourself":        "Sie können sich nicht selbst entfernen",
+		"owner can't leave":            "Inhaber kann nicht austreten",
+		"Try again later":              "Später erneut versuchen",
+		"invited":                      "eingeladen",
+		"API key revoked!":             "API-Schlüssel widerrufen!",
+		"password do not match":        "Passwörter stimmen nicht überein",
+		"Verifying your browser...":    "Browser wird überprüft...",
+		"identity not found":           "Identität nicht gefunden",
+		"link already used":            "Link bereits verwendet",
+		"link expired":                 "Link abgelaufen",
+		"Link Already Used":            "Link bereits verwendet",
+		"Link Expired":                 "Link abgelaufen",
+		"This link was already used, request a new one if you still need it.": "Dieser Link wurde bereits verwendet, fordere einen neuen an, falls du ihn noch brauchst.",
+		"This link has expired, request a new one to continue.":               "Dieser Link ist abgelaufen, fordere einen neuen an, um fortzufahren.",
+		"owner":  "Inhaber",
+		"admin":  "Administrator",
+		"member": "Mitglied",
+		// emails
+		"Login / Register Link":                      "Link zum Anmelden oder Registrieren",
+		"Click the link below to login or register":  "Klicken Sie auf den Link, um sich anzumelden oder zu registrieren",
+		"Verify Your Email":                          "Bestätigen Sie Ihre E-Mail",
+		"Click the link below to verify your email.": "Klicken Sie auf den Link, um Ihre E-Mail zu bestätigen.",
+		"Verify":               "Bestätigen",
+		"Confirm Email Update": "E-Mail-Änderung bestätigen",
+		"Click the link below to update your email.":                        "Klicken Sie auf den Link, um Ihre E-Mail zu ändern.",
+		"Invitation to {org_name}":                                          "Einladung zu {org_name}",
+		"You have been invited to join {org_name} as {role}.":               "Sie wurden eingeladen, {org_name} als {role} beizutreten.",
+		"Accept Invitation":                                                 "Einladung annehmen",
+		"Password Reset Link":                                               "Link zum Zurücksetzen des Passworts",
+		"Click the link below to reset your password.":                      "Klicken Sie auf den Link, um Ihr Passwort zurückzusetzen.",
+		"Your password was changed":                                         "Ihr Passwort wurde geändert",
+		"The password of your account was changed.":                         "Das Passwort Ihres Kontos wurde geändert.",
+		"If this wasn't you, lock your account and reset your password.":    "Wenn Sie das nicht waren, sperren Sie Ihr Konto und setzen Sie Ihr Passwort zurück.",
+		"This wasn't me":                                                    "Das war ich nicht",
+		"Two-factor authentication disabled":                                "Zwei-Faktor-Authentifizierung deaktiviert",
+		"Two-factor authentication was disabled on your account.":           "Die Zwei-Faktor-Authentifizierung wurde für Ihr Konto deaktiviert.",
+		"Email change requested":                                            "E-Mail-Änderung angefordert",
+		"A change of your account email to {new_email} was requested.":      "Eine Änderung der E-Mail Ihres Kontos zu {new_email} wurde angefordert.",
+		"New login to your account":                                         "Neue Anmeldung bei Ihrem Konto",
+		"Your account was accessed from a new device ({ip}, {user_agent}).": "Auf Ihr Konto wurde von einem neuen Gerät zugegriffen ({ip}, {user_agent}).",
+		"Your account is locked.":                                           "Ihr Konto ist gesperrt.",
+	},
+}
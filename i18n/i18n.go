@@ -0,0 +1,187 @@
+package i18n
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type (
+	// Catalog maps the English message to its translation, messages may have {name} placeholders
+	Catalog map[string]string
+
+	// Bundle holds the catalogs of all supported languages
+	Bundle struct {
+		// Fallback is used when no requested language is supported, defaults to en
+		Fallback string
+
+		lock     sync.RWMutex
+		catalogs map[string]Catalog
+	}
+)
+
+// NewBundle returns a bundle with the built-in catalogs
+func NewBundle() *Bundle {
+	b := &Bundle{Fallback: "en", catalogs: make(map[string]Catalog)}
+	for lang, c := range defaultCatalogs {
+		b.Add(lang, c)
+	}
+	return b
+}
+
+// Add adds or overrides messages of lang, an empty catalog adds a language that uses the English messages
+func (b *Bundle) Add(lang string, c Catalog) {
+	lang = normalize(lang)
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.catalogs == nil {
+		b.catalogs = make(map[string]Catalog)
+	}
+	dst, ok := b.catalogs[lang]
+	if !ok {
+		dst = make(Catalog)
+		b.catalogs[lang] = dst
+	}
+	for k, v := range c {
+		dst[k] = v
+	}
+}
+
+// Languages returns the supported languages sorted
+func (b *Bundle) Languages() []string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var langs []string
+	for l := range b.catalogs {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Match returns the first supported language of prefs trying the base language of a region
+// e.g. es-MX matches es, otherwise returns Fallback.
+func (b *Bundle) Match(prefs ...string) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for _, p := range prefs {
+		if l, ok := b.lookup(p); ok {
+			return l
+		}
+	}
+	return b.fallback()
+}
+
+// Supported returns true if lang or its base language has a catalog
+func (b *Bundle) Supported(lang string) bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	_, ok := b.lookup(lang)
+	return ok
+}
+
+func (b *Bundle) lookup(lang string) (string, bool) {
+	lang = normalize(lang)
+	if lang == "" {
+		return "", false
+	}
+	if _, ok := b.catalogs[lang]; ok {
+		return lang, true
+	}
+	if i := strings.Index(lang, "-"); i > 0 {
+		if _, ok := b.catalogs[lang[:i]]; ok {
+			return lang[:i], true
+		}
+	}
+	return "", false
+}
+
+// T returns the translation of msg in lang or msg itself
+func (b *Bundle) T(lang, msg string) string {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if c, ok := b.catalogs[normalize(lang)]; ok {
+		if t, ok := c[msg]; ok && t != "" {
+			return t
+		}
+	}
+	return msg
+}
+
+// Catalog returns a copy of the messages of lang
+func (b *Bundle) Catalog(lang string) Catalog {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	c := make(Catalog)
+	for k, v := range b.catalogs[normalize(lang)] {
+		c[k] = v
+	}
+	return c
+}
+
+func (b *Bundle) fallback() string {
+	if b.Fallback == "" {
+		return "en"
+	}
+	return normalize(b.Fallback)
+}
+
+// Format replaces {name} placeholders of msg with values
+func Format(msg string, values map[string]interface{}) string {
+	for k, v := range values {
+		msg = strings.ReplaceAll(msg, "{"+k+"}", toString(v))
+	}
+	return msg
+}
+
+// ParseAcceptLanguage returns the languages of an Accept-Language header ordered by quality
+func ParseAcceptLanguage(header string) []string {
+	type lq struct {
+		lang string
+		q    float64
+	}
+	var langs []lq
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.TrimSpace(fields[0])
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, lq{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool {
+		return langs[i].q > langs[j].q
+	})
+	res := make([]string, len(langs))
+	for i, l := range langs {
+		res[i] = l.lang
+	}
+	return res
+}
+
+func normalize(lang string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(lang), "_", "-"))
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(*string); ok {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,65 @@
+package i18n_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/altlimit/gauth/i18n"
+)
+
+func TestParseAcceptLanguage(t *testing.T) {
+	table := []struct {
+		header string
+		want   []string
+	}{
+		{"", nil},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr-CH", "fr", "en", "de"}},
+		{"en;q=0.1, es-MX", []string{"es-MX", "en"}},
+		{"de;q=0, es", []string{"es"}},
+	}
+	for _, v := range table {
+		got := i18n.ParseAcceptLanguage(v.header)
+		if strings.Join(got, ",") != strings.Join(v.want, ",") {
+			t.Errorf("%q wanted %v got %v", v.header, v.want, got)
+		}
+	}
+}
+
+func TestBundle(t *testing.T) {
+	b := i18n.NewBundle()
+	table := []struct {
+		prefs []string
+		want  string
+	}{
+		{[]string{"es-MX"}, "es"},
+		{[]string{"pt_BR", "FR"}, "fr"},
+		{[]string{"ja"}, "en"},
+		{nil, "en"},
+	}
+	for _, v := range table {
+		if got := b.Match(v.prefs...); got != v.want {
+			t.Errorf("%v wanted %s got %s", v.prefs, v.want, got)
+		}
+	}
+	if b.Supported("ja") || !b.Supported("de-AT") {
+		t.Error("unexpected supported languages")
+	}
+	if got := b.T("es", "must have upper case"); got != "debe tener mayúsculas" {
+		t.Errorf("wanted spanish got %s", got)
+	}
+	if got := b.T("es", "unknown message"); got != "unknown message" {
+		t.Errorf("wanted fallback to msg got %s", got)
+	}
+
+	b.Add("pt-BR", i18n.Catalog{"Login": "Entrar"})
+	b.Add("es", i18n.Catalog{"Login": "Entrar"})
+	if got := b.Match("pt-BR"); got != "pt-br" || b.T(got, "Login") != "Entrar" || b.T("pt-br", "Register") != "Register" {
+		t.Errorf("unexpected pt-br %s", got)
+	}
+	if b.T("es", "Login") != "Entrar" || b.T("es", "Register") != "Registrarse" {
+		t.Error("wanted es override merged with built-in catalog")
+	}
+	if got := i18n.Format(b.T("fr", "You joined {org}!"), map[string]interface{}{"org": "Acme"}); got != "Vous avez rejoint Acme !" {
+		t.Errorf("unexpected format %s", got)
+	}
+}
@@ -0,0 +1,62 @@
+package gauth
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+type (
+	// IdentityCache enables a read-through cache of IdentityLoad keyed by uid, entries are
+	// removed when gauth saves the identity. Call InvalidateIdentity when you update
+	// identities outside of gauth or rely on TTL for staleness.
+	IdentityCache struct {
+		// Size is the max identities kept, 0 disables the cache
+		Size int
+		// TTL defaults to 1 minute
+		TTL time.Duration
+	}
+)
+
+// InvalidateIdentity removes uid from the identity cache
+func (ga *GAuth) InvalidateIdentity(ctx context.Context, uid string) {
+	if ga.identityCache != nil {
+		ga.identityCache.Delete(ga.identityCacheKey(ctx, uid))
+	}
+}
+
+func (ga *GAuth) identityCacheKey(ctx context.Context, uid string) string {
+	tid := ga.tenantID()
+	if t := TenantFromContext(ctx); t != nil {
+		tid = t.ID
+	}
+	return tid + ":" + uid
+}
+
+// identityLoad calls IdentityProvider.IdentityLoad through the identity cache if enabled
+func (ga *GAuth) identityLoad(ctx context.Context, uid string) (Identity, error) {
+	if ga.identityCache == nil || uid == "" {
+		return ga.IdentityProvider.IdentityLoad(ctx, uid)
+	}
+	id, err := ga.identityCache.GetOrLoad(ga.identityCacheKey(ctx, uid), ga.IdentityCache.TTL, func(string) (Identity, error) {
+		return ga.IdentityProvider.IdentityLoad(ctx, uid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return copyIdentity(id), nil
+}
+
+// copyIdentity returns a shallow copy of a struct pointer so saveIdentity never changes a cached identity
+func copyIdentity(id Identity) Identity {
+	v := reflect.ValueOf(id)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return id
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	if cid, ok := c.Interface().(Identity); ok {
+		return cid
+	}
+	return id
+}
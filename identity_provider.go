@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/golang-jwt/jwt/v4"
 )
@@ -45,6 +46,59 @@ type (
 		// your middleware.
 		CreateAccessToken(ctx context.Context, uid string, cid string) (interface{}, error)
 	}
+
+	// Optionally implement this to allow support staff to login as another user, tokens issued
+	// carries an "act" claim of the actor and can't be used to change sensitive account settings.
+	ImpersonationProvider interface {
+		// CanImpersonate should return ErrTokenDenied if uid is not allowed to act as targetUID
+		CanImpersonate(ctx context.Context, uid, targetUID string) error
+		// ImpersonationAudit is called when an impersonation starts or stops
+		ImpersonationAudit(ctx context.Context, event ImpersonationEvent) error
+	}
+
+	// Optionally implement this to enable the "API Keys" tab in the account page, keys are
+	// accepted as a bearer token in Authorized and AuthMiddleware.
+	APIKeyProvider interface {
+		// APIKeyCreate saves a new key, only the hash of the key is provided
+		APIKeyCreate(ctx context.Context, key *APIKey) error
+		// APIKeyLoad should return ErrAPIKeyNotFound if no key matches the hash
+		APIKeyLoad(ctx context.Context, hash string) (*APIKey, error)
+		APIKeyList(ctx context.Context, uid string) ([]*APIKey, error)
+		// APIKeyUsed is called on every successful authorization to update LastUsed
+		APIKeyUsed(ctx context.Context, uid, id string, t time.Time) error
+		// APIKeyDelete should return ErrAPIKeyNotFound if id does not belong to uid
+		APIKeyDelete(ctx context.Context, uid, id string) error
+	}
+
+	// Optionally implement this to revoke sessions or alert your team when a user locks their account
+	// from the "This wasn't me" link of a security notification.
+	AccountLockProvider interface {
+		AccountLocked(ctx context.Context, uid string) error
+	}
+
+	// Optionally implement this to allow the client_credentials grant on the refresh endpoint
+	// for machine to machine access tokens.
+	ClientProvider interface {
+		// ClientLoad should return ErrClientNotFound if it doesn't exists
+		ClientLoad(ctx context.Context, clientID string) (*Client, error)
+	}
+
+	// Optionally implement this to enable the "Organizations" tab in the account page, the active
+	// organization and role is added in the default access token grants as OrganizationGrants.
+	OrganizationProvider interface {
+		// OrganizationCreate returns the id of the new organization, the owner membership is saved after
+		OrganizationCreate(ctx context.Context, name, ownerUID string) (orgID string, err error)
+		// OrganizationList returns all memberships of uid with OrgName populated
+		OrganizationList(ctx context.Context, uid string) ([]*Membership, error)
+		// OrganizationMembers returns all members and pending invitations of an organization
+		OrganizationMembers(ctx context.Context, orgID string) ([]*Membership, error)
+		// OrganizationMemberSave creates or updates a membership identified by OrgID and Email
+		OrganizationMemberSave(ctx context.Context, m *Membership) error
+		OrganizationMemberDelete(ctx context.Context, orgID, email string) error
+		// OrganizationActive returns the active organization of uid or empty if none
+		OrganizationActive(ctx context.Context, uid string) (orgID string, err error)
+		OrganizationSetActive(ctx context.Context, uid, orgID string) error
+	}
 )
 
 var (
@@ -77,7 +131,7 @@ func (ve ValidationError) Error() string {
 func (dr *DefaultRefreshTokenProvider) CreateRefreshToken(ctx context.Context, uid string) (cid string, err error) {
 	if req, ok := ctx.Value(RequestKey).(*http.Request); ok {
 		pw := toString(ctx.Value(pwHashKey))
-		cid := clientFromRequest(req, pw, "")
+		cid := clientFromRequest(dr.ga.clientIP(req), req, pw, "")
 		return cid, nil
 	}
 	return "", errors.New("RequestKey not found")
@@ -89,22 +143,39 @@ func (dr *DefaultRefreshTokenProvider) DeleteRefreshToken(ctx context.Context, u
 	return nil
 }
 
-// Default behaviour of access token is check cid against client and current pw hash and "access" grants
+// Default behaviour of access token is check cid against client, current pw hash and active field and "access" grants
+// or OrganizationGrants of the active organization if OrganizationProvider is implemented
 func (da *DefaultAccessTokenProvider) CreateAccessToken(ctx context.Context, uid string, cid string) (interface{}, error) {
 	if req, ok := ctx.Value(RequestKey).(*http.Request); ok {
 		_, ok := da.ga.lru.Get("x:" + uid + cid)
 		if !ok {
+			identity, err := da.ga.identityLoad(ctx, uid)
+			if err == ErrIdentityNotFound {
+				return nil, ErrTokenDenied
+			}
+			if err != nil {
+				return nil, err
+			}
+			data := da.ga.loadIdentity(identity)
+			// inactive identities e.g. locked accounts can't refresh, even without a password
+			if active, ok := data[FieldActiveID].(bool); ok && !active {
+				return nil, ErrTokenDenied
+			}
 			var pw string
 			if da.ga.PasswordFieldID != "" {
-				identity, err := da.ga.IdentityProvider.IdentityLoad(ctx, uid)
-				if err != nil {
-					return nil, err
-				}
-				data := da.ga.loadIdentity(identity)
 				pw = toString(data[da.ga.PasswordFieldID])
 			}
-			reqCID := clientFromRequest(req, pw, cid[strings.Index(cid, "$"):])
+			reqCID := clientFromRequest(da.ga.clientIP(req), req, pw, cid[strings.Index(cid, "$"):])
 			if cid == reqCID {
+				if da.ga.organizationProvider != nil {
+					grants, err := da.ga.organizationGrants(ctx, uid)
+					if err != nil {
+						return nil, err
+					}
+					if grants != nil {
+						return grants, nil
+					}
+				}
 				return "access", nil
 			}
 		}
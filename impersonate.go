@@ -0,0 +1,169 @@
+package gauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	ImpersonationStart = "start"
+	ImpersonationStop  = "stop"
+
+	// ImpersonationCID is the cid passed to your AccessTokenProvider when creating an impersonation token
+	ImpersonationCID = "impersonation"
+)
+
+type (
+	// ImpersonationEvent is sent to ImpersonationAudit on start and stop
+	ImpersonationEvent struct {
+		Action   string
+		ActorUID string
+		UID      string
+		IP       string
+		Time     time.Time
+	}
+)
+
+var (
+	ErrImpersonationDisabled = errors.New("impersonation disabled")
+)
+
+// Impersonate returns a short lived access token for targetUID with an "act" claim of the actor,
+// the actor must be a user that is not impersonating already and is checked against CanImpersonate.
+func (ga *GAuth) Impersonate(ctx context.Context, actor *Auth, targetUID string) (string, error) {
+	if ga.impersonator == nil {
+		return "", ErrImpersonationDisabled
+	}
+	if actor == nil || !actor.canManageAccount() || actor.UID == targetUID || targetUID == "" {
+		return "", ErrTokenDenied
+	}
+	if err := ga.impersonator.CanImpersonate(ctx, actor.UID, targetUID); err != nil {
+		return "", err
+	}
+	if _, err := ga.identityLoad(ctx, targetUID); err != nil {
+		return "", err
+	}
+
+	var grants interface{} = "access"
+	if _, ok := ga.accessTokenProvider.(*DefaultAccessTokenProvider); ok {
+		// same grants as the target's own sessions, the refresh token check doesn't apply here
+		if ga.organizationProvider != nil {
+			g, err := ga.organizationGrants(ctx, targetUID)
+			if err != nil {
+				return "", err
+			}
+			if g != nil {
+				grants = g
+			}
+		}
+	} else {
+		g, err := ga.accessTokenProvider.CreateAccessToken(ctx, targetUID, ImpersonationCID)
+		if err != nil {
+			return "", err
+		}
+		grants = g
+	}
+
+	tok, err := ga.signAccessToken(targetUID, grants, time.Now().Add(ga.Timeout.Impersonation), jwt.MapClaims{
+		"act": map[string]string{"sub": actor.UID},
+	})
+	if err != nil {
+		return "", fmt.Errorf("Impersonate: %v", err)
+	}
+	if err := ga.auditImpersonation(ctx, ImpersonationStart, actor.UID, targetUID); err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+// StopImpersonation records the end of an impersonation, the token itself expires with Timeout.Impersonation.
+func (ga *GAuth) StopImpersonation(ctx context.Context, auth *Auth) error {
+	if ga.impersonator == nil {
+		return ErrImpersonationDisabled
+	}
+	if auth == nil || !auth.Impersonated() {
+		return ErrTokenDenied
+	}
+	return ga.auditImpersonation(ctx, ImpersonationStop, auth.Actor.UID, auth.UID)
+}
+
+func (ga *GAuth) auditImpersonation(ctx context.Context, action, actorUID, uid string) error {
+	event := ImpersonationEvent{
+		Action:   action,
+		ActorUID: actorUID,
+		UID:      uid,
+		Time:     time.Now(),
+	}
+	if req, ok := ctx.Value(RequestKey).(*http.Request); ok {
+		event.IP = ga.clientIP(req)
+	}
+	if err := ga.impersonator.ImpersonationAudit(ctx, event); err != nil {
+		return fmt.Errorf("auditImpersonation: %v", err)
+	}
+	return nil
+}
+
+func (ga *GAuth) impersonateHandler(w http.ResponseWriter, r *http.Request, action string, targetUID string) {
+	auth, err := ga.Authorized(r)
+	if err != nil {
+		ga.log("AuthorizedError: ", err)
+		ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+	ctx := context.WithValue(r.Context(), RequestKey, r)
+	if action == ImpersonationStop {
+		if err := ga.StopImpersonation(ctx, auth); err != nil {
+			if err == ErrTokenDenied {
+				ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+				return
+			}
+			ga.internalError(w, err)
+			return
+		}
+		if ga.AccessTokenCookieName != "" {
+			// clearing the cookie makes the next request refresh back to the actor's own session
+			ga.clearCookie(w, ga.AccessTokenCookieName, "/", http.SameSiteStrictMode)
+		}
+		ga.writeJSON(http.StatusOK, w, nil)
+		return
+	}
+
+	if targetUID == "" {
+		ga.validationError(w, "uid", "required")
+		return
+	}
+	tok, err := ga.Impersonate(ctx, auth, targetUID)
+	if err != nil {
+		switch err {
+		case ErrTokenDenied, ErrImpersonationDisabled:
+			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+		case ErrIdentityNotFound:
+			ga.validationError(w, "uid", "not found")
+		default:
+			ga.internalError(w, err)
+		}
+		return
+	}
+	expire := ga.Timeout.Impersonation
+	if ga.AccessTokenCookieName != "" {
+		ga.setCookie(w, &http.Cookie{
+			Name:     ga.AccessTokenCookieName,
+			Value:    tok,
+			Expires:  time.Now().Add(expire),
+			HttpOnly: true,
+			MaxAge:   int(expire.Seconds()),
+			SameSite: http.SameSiteStrictMode,
+			Path:     "/",
+		})
+	}
+	ga.writeJSON(http.StatusOK, w, map[string]interface{}{
+		"access_token": tok,
+		"token_type":   "Bearer",
+		"expires_in":   expire.Seconds(),
+	})
+}
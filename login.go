@@ -8,7 +8,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/altlimit/gauth/cache"
 	"github.com/altlimit/gauth/form"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/pquerna/otp/totp"
@@ -17,7 +16,10 @@ import (
 func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 	withPW := ga.PasswordFieldID != ""
 	if r.Method == http.MethodGet {
-		fc := ga.formConfig()
+		if ga.staleLinkRedirect(w, r) {
+			return
+		}
+		fc := ga.formConfig(w, r)
 		action := r.URL.Query().Get("a")
 		if withPW {
 			fc.Links = append(fc.Links, &form.Link{
@@ -31,10 +33,30 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 		case "resetlink":
 			fc.Title = "Forgot Password"
 			fc.Submit = "Send Reset Link"
+			fc.Captcha = ga.captchaWidget(FlowResetLink)
+			fc.Links = append(fc.Links, &form.Link{
+				URL:   ga.Path.Base + ga.Path.Login,
+				Label: "Login",
+			})
+		case actionLinkUsed, actionLinkExpired:
+			fc.Fields = nil
+			if action == actionLinkUsed {
+				fc.Title = "Link Already Used"
+				fc.Message = "This link was already used, request a new one if you still need it."
+			} else {
+				fc.Title = "Link Expired"
+				fc.Message = "This link has expired, request a new one to continue."
+			}
 			fc.Links = append(fc.Links, &form.Link{
 				URL:   ga.Path.Base + ga.Path.Login,
 				Label: "Login",
 			})
+			if withPW && ga.emailSender != nil && ga.EmailFieldID != "" {
+				fc.Links = append(fc.Links, &form.Link{
+					URL:   "?a=resetlink",
+					Label: "Forgot Password",
+				})
+			}
 		case "reset":
 			fc.Fields = ga.resetFields()
 			fc.Title = "Reset Password"
@@ -44,6 +66,12 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 				Label: "Login",
 			})
 		default:
+			// verification links can be re-sent from the login form
+			fc.Captcha = ga.captchaWidget(FlowLogin, FlowConfirmEmail)
+			if fc.Captcha == nil && ga.adaptiveCaptcha() {
+				fc.Captcha = ga.Captcha.Widget()
+				fc.CaptchaOnDemand = true
+			}
 			if !withPW {
 				fc.Title = "Login or Register"
 				fc.Submit = "Send Link"
@@ -64,7 +92,7 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 				fc.Fields = append(fc.Fields, &form.Field{ID: FieldRememberID, Type: "checkbox", Label: "Remember"})
 			}
 		}
-		if err := form.Render(w, fc); err != nil {
+		if err := ga.renderForm(w, fc); err != nil {
 			ga.internalError(w, err)
 		}
 		return
@@ -83,6 +111,7 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 		identity string
 		passwd   string
 		isToken  bool
+		newUser  bool
 	)
 	if token, ok := req["token"].(string); ok && !withPW && token != "" {
 		identity = token
@@ -105,21 +134,50 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 		ga.validationError(w, valErrs...)
 		return
 	}
-
-	if err := ga.rateLimiter.RateLimit(ctx, "login:"+strings.ToLower(identity), ga.RateLimit.Login.Rate, ga.RateLimit.Login.Duration); err != nil {
-		if _, ok := err.(cache.RateLimitError); ok {
-			ga.validationError(w, ga.IdentityFieldID, "try again later")
+	// links from login emails were already requested with a captcha
+	response := toString(req[FieldCaptchaID])
+	if !isToken && !ga.validCaptcha(w, r, FlowLogin, response) {
+		return
+	}
+	adaptive := ga.adaptiveCaptcha()
+	solved := false
+	if adaptive && response != "" {
+		if !ga.verifyCaptcha(w, r, response) {
 			return
 		}
-		ga.internalError(w, err)
+		solved = true
+	}
+	// risky returns true after requiring a captcha or writing an error
+	// the risk is counted once per attempt and reused after the password for the 2fa code
+	riskCounted, isRisky := false, false
+	risky := func() bool {
+		if !adaptive {
+			return false
+		}
+		if !riskCounted {
+			var err error
+			isRisky, err = ga.loginRisk(ctx, r, identity)
+			if err != nil {
+				ga.internalError(w, err)
+				return true
+			}
+			riskCounted = true
+		}
+		if isRisky && !solved {
+			ga.validationError(w, FieldCaptchaID, "required")
+			return true
+		}
+		return false
+	}
+
+	if !ga.rateLimitFlow(ctx, w, r, FlowLogin, identity) {
 		return
 	}
 
 	if isToken {
-		claims, err := ga.tokenStringClaims(identity, "")
-		if err != nil || claims["act"] != actionLogin {
-			ga.log("verify token error", err)
-			ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+		claims, err := ga.emailTokenClaims(ctx, identity, "", actionLogin)
+		if err != nil {
+			ga.emailTokenError(w, err)
 			return
 		}
 		identity = claims["uid"]
@@ -134,6 +192,10 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	uid, err := ga.IdentityProvider.IdentityUID(ctx, identity)
+	if adaptive && !solved && ga.AdaptiveCaptcha.NewDevice && (err == nil || err == ErrIdentityNotFound) && !ga.knownDevice(r, uid) {
+		ga.validationError(w, FieldCaptchaID, "required")
+		return
+	}
 	if err == ErrIdentityNotFound && !withPW {
 		// skip, no user yet
 	} else if err != nil {
@@ -142,7 +204,9 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		if err == ErrIdentityNotFound {
-			ga.validationError(w, ga.PasswordFieldID, "invalid")
+			if !risky() {
+				ga.validationError(w, ga.PasswordFieldID, "invalid")
+			}
 			return
 		}
 		if ve, ok := err.(ValidationError); ok {
@@ -153,7 +217,7 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	id, err := ga.IdentityProvider.IdentityLoad(ctx, uid)
+	id, err := ga.identityLoad(ctx, uid)
 	if err != nil {
 		if err != ErrIdentityNotFound || withPW {
 			ga.internalError(w, err)
@@ -164,7 +228,12 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 
 	if withPW {
 		if !validPassword(toString(data[ga.PasswordFieldID]), passwd) {
-			ga.validationError(w, ga.PasswordFieldID, "invalid")
+			if !risky() {
+				ga.validationError(w, ga.PasswordFieldID, "invalid")
+			}
+			return
+		}
+		if risky() {
 			return
 		}
 
@@ -198,7 +267,9 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			if !usedRecovery && !totp.Validate(code, totpSecret) {
-				ga.validationError(w, FieldCodeID, "invalid")
+				if !risky() {
+					ga.validationError(w, FieldCodeID, "invalid")
+				}
 				return
 			}
 		}
@@ -209,7 +280,15 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 			ga.internalError(w, err)
 			return
 		}
+		newUser = true
 	}
+	if !newUser && !ga.knownDevice(r, uid) {
+		ga.notify(ctx, actionNewDevice, uid, data, map[string]interface{}{
+			"ip":         ga.clientIP(r),
+			"user_agent": r.UserAgent(),
+		})
+	}
+	ga.rememberDevice(w, uid)
 
 	expire := ga.Timeout.RefreshToken
 	if v, ok := req[FieldRememberID].(bool); ok && v {
@@ -231,12 +310,11 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if ga.RefreshTokenCookieName != "" {
-		http.SetCookie(w, &http.Cookie{
+		ga.setCookie(w, &http.Cookie{
 			Name:     ga.RefreshTokenCookieName,
 			Value:    tok,
 			Expires:  expiry,
 			HttpOnly: true,
-			Secure:   !ga.debug,
 			MaxAge:   int(expire.Seconds()),
 			SameSite: http.SameSiteStrictMode,
 			Path:     ga.Path.Base + ga.Path.Refresh,
@@ -245,14 +323,17 @@ func (ga *GAuth) loginHandler(w http.ResponseWriter, r *http.Request) {
 	ga.writeJSON(http.StatusOK, w, map[string]string{"refresh_token": tok})
 }
 
-// CreateRefreshToken you can use this to create custom tokens such as for API keys or anything that has a longer expiration
-// than provided configration.
+// CreateRefreshToken you can use this to create custom tokens that has a longer expiration than provided configration,
+// for user managed API keys implement APIKeyProvider instead.
 func (ga *GAuth) CreateRefreshToken(ctx context.Context, uid, cid string, expiry time.Time) (string, error) {
 	refreshToken := jwt.New(jwt.SigningMethodHS256)
 	claims := refreshToken.Claims.(jwt.MapClaims)
 	claims["exp"] = expiry.Unix()
 	claims["sub"] = uid
 	claims["cid"] = cid
+	if tid := ga.tenantID(); tid != "" {
+		claims["tid"] = tid
+	}
 	token, err := refreshToken.SignedString(ga.JwtKey)
 	if err != nil {
 		return "", fmt.Errorf("CreateRefreshToken: SignedString error %v", err)
@@ -262,14 +343,29 @@ func (ga *GAuth) CreateRefreshToken(ctx context.Context, uid, cid string, expiry
 
 // CreateAccessToken returns an access token
 func (ga *GAuth) CreateAccessToken(ctx context.Context, sub string, grants interface{}, expiry time.Time) (string, error) {
+	token, err := ga.signAccessToken(sub, grants, expiry, nil)
+	if err != nil {
+		return "", fmt.Errorf("CreateAccessToken: %v", err)
+	}
+	return token, nil
+}
+
+// signAccessToken adds extra claims such as act or client_id to an access token
+func (ga *GAuth) signAccessToken(sub string, grants interface{}, expiry time.Time, extra jwt.MapClaims) (string, error) {
 	accessToken := jwt.New(jwt.SigningMethodHS256)
 	accessClaims := accessToken.Claims.(jwt.MapClaims)
+	for k, v := range extra {
+		accessClaims[k] = v
+	}
 	accessClaims["sub"] = sub
 	accessClaims["exp"] = expiry.Unix()
 	accessClaims["grants"] = grants
+	if tid := ga.tenantID(); tid != "" {
+		accessClaims["tid"] = tid
+	}
 	token, err := accessToken.SignedString(ga.JwtKey)
 	if err != nil {
-		return "", fmt.Errorf("CreateAccessToken: SignedString error %v", err)
+		return "", fmt.Errorf("SignedString error %v", err)
 	}
 	return token, nil
 }
@@ -278,13 +374,27 @@ func (ga *GAuth) refreshHandler(w http.ResponseWriter, r *http.Request) {
 	var (
 		req struct {
 			Token string `json:"token"`
+
+			// used for client credentials grant
+			GrantType    string `json:"grant_type"`
+			ClientID     string `json:"client_id"`
+			ClientSecret string `json:"client_secret"`
+			Scope        string `json:"scope"`
 		}
 
 		result interface{}
 	)
 	status := http.StatusOK
 	ref := r.URL.Query().Get("ref")
+	isLogout := r.URL.Query().Get("logout") == "1"
 	defer func() {
+		if status == 0 {
+			return
+		}
+		if er, ok := result.(errorResponse); ok {
+			ga.writeJSON(status, w, er)
+			return
+		}
 		err, ok := result.(error)
 		if ok || status >= 400 {
 			errMsg := http.StatusText(status)
@@ -306,21 +416,50 @@ func (ga *GAuth) refreshHandler(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, ref, http.StatusTemporaryRedirect)
 			return
 		}
-		if status == http.StatusTemporaryRedirect {
-			http.Redirect(w, r, result.(string), http.StatusTemporaryRedirect)
+		if status == http.StatusTemporaryRedirect || status == http.StatusSeeOther {
+			http.Redirect(w, r, result.(string), status)
 			return
 		}
 		ga.writeJSON(status, w, result)
 	}()
 
+	if r.Method == http.MethodGet && isLogout {
+		// any page could log users out with a link
+		w.Header().Set("Allow", "POST, DELETE")
+		status = http.StatusMethodNotAllowed
+		return
+	}
 	if r.Method == http.MethodPost {
-		if err := ga.bind(r, &req); err != nil {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			if err := r.ParseForm(); err != nil {
+				status = http.StatusBadRequest
+				result = err
+				return
+			}
+			req.GrantType = r.PostForm.Get("grant_type")
+			req.ClientID = r.PostForm.Get("client_id")
+			req.ClientSecret = r.PostForm.Get("client_secret")
+			req.Scope = r.PostForm.Get("scope")
+		} else if err := ga.bind(r, &req); err != nil {
 			status = http.StatusBadRequest
 			result = err
 			return
 		}
+		if req.GrantType != "" {
+			if id, secret, ok := r.BasicAuth(); ok {
+				req.ClientID, req.ClientSecret = id, secret
+			}
+			status, result = ga.clientCredentials(w, r, req.GrantType, req.ClientID, req.ClientSecret, req.Scope)
+			return
+		}
+		// html forms can logout with the cookie, checkCSRF requires their csrf_token
+		if req.Token == "" && isLogout && ga.RefreshTokenCookieName != "" {
+			if c, err := ga.cookie(r, ga.RefreshTokenCookieName); err == nil {
+				req.Token = c.Value
+			}
+		}
 	} else if (r.Method == http.MethodGet || r.Method == http.MethodDelete) && ga.RefreshTokenCookieName != "" {
-		c, err := r.Cookie(ga.RefreshTokenCookieName)
+		c, err := ga.cookie(r, ga.RefreshTokenCookieName)
 		if err != nil {
 			if err == http.ErrNoCookie {
 				status = http.StatusUnauthorized
@@ -353,7 +492,6 @@ func (ga *GAuth) refreshHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	ctx := r.Context()
-	isLogout := r.URL.Query().Get("logout") == "1"
 	if r.Method == http.MethodDelete || isLogout {
 		err := ga.refreshTokenProvider.DeleteRefreshToken(ctx, claims["sub"], cid)
 		if err != nil {
@@ -363,35 +501,18 @@ func (ga *GAuth) refreshHandler(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if ga.RefreshTokenCookieName != "" {
-			http.SetCookie(w, &http.Cookie{
-				Name:     ga.RefreshTokenCookieName,
-				Value:    "",
-				Expires:  time.Unix(0, 0),
-				HttpOnly: true,
-				Secure:   !ga.debug,
-				MaxAge:   -1,
-				SameSite: http.SameSiteStrictMode,
-				Path:     ga.Path.Base + ga.Path.Refresh,
-			})
+			ga.clearCookie(w, ga.RefreshTokenCookieName, ga.Path.Base+ga.Path.Refresh, http.SameSiteStrictMode)
 		}
 		if ga.AccessTokenCookieName != "" {
-			http.SetCookie(w, &http.Cookie{
-				Name:     ga.AccessTokenCookieName,
-				Value:    "",
-				Expires:  time.Unix(0, 0),
-				HttpOnly: true,
-				Secure:   !ga.debug,
-				MaxAge:   -1,
-				SameSite: http.SameSiteStrictMode,
-				Path:     "/",
-			})
+			ga.clearCookie(w, ga.AccessTokenCookieName, "/", http.SameSiteStrictMode)
 		}
 		if isLogout {
 			url := ga.Path.Base + ga.Path.Login
 			if ref := r.Header.Get("Referer"); ref != "" {
 				url = ref
 			}
-			status = http.StatusTemporaryRedirect
+			// a GET after the logout form
+			status = http.StatusSeeOther
 			result = url
 		}
 		return
@@ -417,12 +538,11 @@ func (ga *GAuth) refreshHandler(w http.ResponseWriter, r *http.Request) {
 
 	expire := ga.Timeout.AccessToken
 	if ga.AccessTokenCookieName != "" {
-		http.SetCookie(w, &http.Cookie{
+		ga.setCookie(w, &http.Cookie{
 			Name:     ga.AccessTokenCookieName,
 			Value:    tok,
 			Expires:  time.Now().Add(expire),
 			HttpOnly: true,
-			Secure:   !ga.debug,
 			MaxAge:   int(expire.Seconds()),
 			SameSite: http.SameSiteStrictMode,
 			Path:     "/",
@@ -0,0 +1,132 @@
+package gauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func isNotification(action string) bool {
+	switch action {
+	case actionPasswordChanged, actionTwoFactorDisabled, actionEmailChange, actionNewDevice:
+		return true
+	}
+	return false
+}
+
+// notify sends a security notification to the email in data, failures are only logged
+// since the change it's about already happened.
+func (ga *GAuth) notify(ctx context.Context, action string, uid string, data map[string]interface{}, values map[string]interface{}) {
+	if ga.DisableSecurityNotifications || ga.emailSender == nil || ga.EmailFieldID == "" {
+		return
+	}
+	req := make(map[string]interface{})
+	for k, v := range data {
+		req[k] = v
+	}
+	for k, v := range values {
+		req[k] = v
+	}
+	toEmail := toString(req[ga.EmailFieldID])
+	if toEmail == "" {
+		return
+	}
+	req[ga.EmailFieldID] = toEmail
+	if _, err := ga.sendMail(ctx, action, uid, req); err != nil {
+		ga.log("notify", action, err)
+	}
+}
+
+// knownDevice returns true if the device cookie was issued to uid by rememberDevice
+func (ga *GAuth) knownDevice(r *http.Request, uid string) bool {
+	if ga.DeviceCookieName == "" {
+		return true
+	}
+	c, err := ga.cookie(r, ga.DeviceCookieName)
+	if err != nil {
+		return false
+	}
+	nonce, sig, ok := strings.Cut(c.Value, ".")
+	return ok && hmac.Equal([]byte(sig), []byte(ga.deviceSignature(nonce, uid)))
+}
+
+// rememberDevice sets a cookie that identifies this browser as used by uid
+func (ga *GAuth) rememberDevice(w http.ResponseWriter, uid string) {
+	if ga.DeviceCookieName == "" {
+		return
+	}
+	nonce := randSeq(16)
+	maxAge := 365 * 24 * time.Hour
+	ga.setCookie(w, &http.Cookie{
+		Name:     ga.DeviceCookieName,
+		Value:    nonce + "." + ga.deviceSignature(nonce, uid),
+		Expires:  time.Now().Add(maxAge),
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Path:     ga.Path.Base,
+	})
+}
+
+func (ga *GAuth) deviceSignature(nonce, uid string) string {
+	mac := hmac.New(sha256.New, ga.JwtKey)
+	mac.Write([]byte("device:" + ga.tenantID() + ":" + uid + ":" + nonce))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// lockHandler deactivates the account from the link of a security notification and clears the
+// password, the default access token provider denies refresh of inactive identities so their
+// sessions end within an access token lifetime. The Identity must have a bool gauth:"active"
+// field. The user can reset the password and verify the email again to unlock it.
+func (ga *GAuth) lockHandler(w http.ResponseWriter, r *http.Request, token string) {
+	ctx := context.WithValue(r.Context(), RequestKey, r)
+	claims, err := ga.verifyEmailToken(ctx, token, "", actionLock)
+	if err != nil {
+		ga.emailTokenError(w, err)
+		return
+	}
+	uid := claims["uid"]
+	if uid == "" {
+		ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+		return
+	}
+	identity, err := ga.identityLoad(ctx, uid)
+	if err == ErrIdentityNotFound {
+		ga.writeJSON(http.StatusNotFound, w, errorResponse{Error: "identity not found"})
+		return
+	}
+	if err != nil {
+		ga.internalError(w, err)
+		return
+	}
+	// without an active field nothing denies the sessions of the account, the link stays
+	// unused so it still works once the field is added
+	if _, ok := ga.loadIdentity(identity)[FieldActiveID].(bool); !ok {
+		ga.internalError(w, errors.New("lockHandler: Identity has no active field to lock"))
+		return
+	}
+	if err := ga.useEmailToken(ctx, claims); err != nil {
+		ga.emailTokenError(w, err)
+		return
+	}
+	update := map[string]interface{}{FieldActiveID: false}
+	if ga.PasswordFieldID != "" {
+		update[ga.PasswordFieldID] = ""
+	}
+	if _, err := ga.saveIdentity(ctx, identity, update); err != nil {
+		ga.internalError(w, err)
+		return
+	}
+	if al, ok := ga.IdentityProvider.(AccountLockProvider); ok {
+		if err := al.AccountLocked(ctx, uid); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+	}
+	ga.writeJSON(http.StatusOK, w, nil)
+}
@@ -0,0 +1,345 @@
+package gauth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	RoleOwner  = "owner"
+	RoleAdmin  = "admin"
+	RoleMember = "member"
+
+	MemberInvited = "invited"
+	MemberActive  = "active"
+)
+
+type (
+	// Membership links a user (or a pending invited email) to an organization with a role
+	Membership struct {
+		OrgID   string `json:"org_id"`
+		OrgName string `json:"org_name"`
+		// UID is empty while the invitation is not yet accepted
+		UID    string `json:"uid,omitempty"`
+		Email  string `json:"email"`
+		Role   string `json:"role"`
+		Status string `json:"status"`
+	}
+
+	// OrganizationGrants are the grants of the default access token when organizations are enabled
+	OrganizationGrants struct {
+		OrgID string `json:"org"`
+		Role  string `json:"role"`
+	}
+)
+
+var (
+	ErrOrganizationNotFound = errors.New("organization not found")
+)
+
+// canManage returns true for roles that can invite, remove and update roles of members
+func (m *Membership) canManage() bool {
+	return m.Status == MemberActive && (m.Role == RoleOwner || m.Role == RoleAdmin)
+}
+
+func (ga *GAuth) validRole(role string) bool {
+	for _, r := range ga.OrganizationRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// membership returns the active membership of uid in orgID or nil
+func (ga *GAuth) membership(ctx context.Context, uid, orgID string) (*Membership, error) {
+	members, err := ga.organizationProvider.OrganizationList(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range members {
+		if m.OrgID == orgID && m.Status == MemberActive {
+			return m, nil
+		}
+	}
+	return nil, nil
+}
+
+// organizationGrants returns the active organization and role of uid for access token grants
+func (ga *GAuth) organizationGrants(ctx context.Context, uid string) (*OrganizationGrants, error) {
+	orgID, err := ga.organizationProvider.OrganizationActive(ctx, uid)
+	if err != nil || orgID == "" {
+		return nil, err
+	}
+	m, err := ga.membership(ctx, uid, orgID)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	return &OrganizationGrants{OrgID: m.OrgID, Role: m.Role}, nil
+}
+
+func (ga *GAuth) organizationHandler(w http.ResponseWriter, r *http.Request, req map[string]string) {
+	if ga.organizationProvider == nil {
+		ga.writeJSON(http.StatusNotFound, w, nil)
+		return
+	}
+	auth, err := ga.Authorized(r)
+	if err != nil {
+		ga.log("AuthorizedError: ", err)
+		ga.writeJSON(http.StatusUnauthorized, w, errorResponse{Error: http.StatusText(http.StatusUnauthorized)})
+		return
+	}
+	forbidden := func() {
+		ga.writeJSON(http.StatusForbidden, w, errorResponse{Error: http.StatusText(http.StatusForbidden)})
+	}
+	action := req["action"]
+	if auth.IsClient() || (action != "orgs" && action != "orgMembers" && !auth.canManageAccount()) {
+		forbidden()
+		return
+	}
+	ctx := context.WithValue(r.Context(), RequestKey, r)
+	op := ga.organizationProvider
+	orgID := req["org"]
+
+	// actions that doesn't require an existing membership
+	switch action {
+	case "orgs":
+		members, err := op.OrganizationList(ctx, auth.UID)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		active, err := op.OrganizationActive(ctx, auth.UID)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		if members == nil {
+			members = []*Membership{}
+		}
+		ga.writeJSON(http.StatusOK, w, map[string]interface{}{
+			"active":      active,
+			"memberships": members,
+		})
+		return
+	case "newOrg":
+		name := strings.TrimSpace(req["name"])
+		if name == "" {
+			ga.validationError(w, "org_name", "required")
+			return
+		}
+		if len(name) > 100 {
+			ga.validationError(w, "org_name", "too long")
+			return
+		}
+		identity, err := ga.identityLoad(ctx, auth.UID)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		m := &Membership{
+			OrgName: name,
+			UID:     auth.UID,
+			Email:   toString(ga.loadIdentity(identity)[ga.EmailFieldID]),
+			Role:    RoleOwner,
+			Status:  MemberActive,
+		}
+		if m.OrgID, err = op.OrganizationCreate(ctx, name, auth.UID); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		if err := op.OrganizationMemberSave(ctx, m); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusCreated, w, m)
+		return
+	case actionOrgInvite:
+		// accepting an invitation link, the invited email must be the email of the logged in user
+		claims, err := ga.verifyEmailToken(ctx, req["token"], "", actionOrgInvite)
+		if err != nil {
+			ga.emailTokenError(w, err)
+			return
+		}
+		identity, err := ga.identityLoad(ctx, auth.UID)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		email := toString(ga.loadIdentity(identity)[ga.EmailFieldID])
+		if !strings.EqualFold(email, claims["email"]) {
+			forbidden()
+			return
+		}
+		members, err := op.OrganizationMembers(ctx, claims["org"])
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		for _, m := range members {
+			if m.Status == MemberInvited && strings.EqualFold(m.Email, email) {
+				if err := ga.useEmailToken(ctx, claims); err != nil {
+					ga.emailTokenError(w, err)
+					return
+				}
+				m.UID = auth.UID
+				m.Status = MemberActive
+				if err := op.OrganizationMemberSave(ctx, m); err != nil {
+					ga.internalError(w, err)
+					return
+				}
+				ga.writeJSON(http.StatusOK, w, m)
+				return
+			}
+		}
+		// invitation was revoked
+		forbidden()
+		return
+	}
+
+	if orgID == "" {
+		ga.validationError(w, "org", "required")
+		return
+	}
+	me, err := ga.membership(ctx, auth.UID, orgID)
+	if err != nil {
+		ga.internalError(w, err)
+		return
+	}
+	if me == nil {
+		forbidden()
+		return
+	}
+	switch action {
+	case "orgSwitch":
+		if err := op.OrganizationSetActive(ctx, auth.UID, orgID); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusOK, w, nil)
+		return
+	case "orgMembers":
+		members, err := op.OrganizationMembers(ctx, orgID)
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		if members == nil {
+			members = []*Membership{}
+		}
+		ga.writeJSON(http.StatusOK, w, members)
+		return
+	case "orgLeave":
+		if me.Role == RoleOwner {
+			ga.validationError(w, "org", "owner can't leave")
+			return
+		}
+		if err := op.OrganizationMemberDelete(ctx, orgID, me.Email); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusOK, w, nil)
+		return
+	}
+
+	if !me.canManage() {
+		forbidden()
+		return
+	}
+	email := strings.TrimSpace(req["email"])
+	role := req["role"]
+	members, err := op.OrganizationMembers(ctx, orgID)
+	if err != nil {
+		ga.internalError(w, err)
+		return
+	}
+	var member *Membership
+	for _, m := range members {
+		if strings.EqualFold(m.Email, email) {
+			member = m
+		}
+	}
+	// only owners can add or remove another owner
+	if (role == RoleOwner || (member != nil && member.Role == RoleOwner)) && me.Role != RoleOwner {
+		forbidden()
+		return
+	}
+	switch action {
+	case "orgInvite":
+		if err := RequiredEmail("email", map[string]interface{}{"email": email}); err != nil {
+			ga.validationError(w, "email", err.Error())
+			return
+		}
+		if !ga.validRole(role) {
+			ga.validationError(w, "role", "invalid")
+			return
+		}
+		if member != nil {
+			ga.validationError(w, "email", "already a member")
+			return
+		}
+		member = &Membership{
+			OrgID:   orgID,
+			OrgName: me.OrgName,
+			Email:   email,
+			Role:    role,
+			Status:  MemberInvited,
+		}
+		if err := op.OrganizationMemberSave(ctx, member); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		status := http.StatusOK
+		sent, err := ga.sendMail(ctx, actionOrgInvite, auth.UID, map[string]interface{}{
+			ga.EmailFieldID: email,
+			"org":           orgID,
+			"org_name":      me.OrgName,
+			"role":          role,
+		})
+		if err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		if sent {
+			status = http.StatusCreated
+		}
+		ga.writeJSON(status, w, member)
+	case "orgRole":
+		if member == nil {
+			ga.validationError(w, "email", "not found")
+			return
+		}
+		if !ga.validRole(role) {
+			ga.validationError(w, "role", "invalid")
+			return
+		}
+		if member.UID == auth.UID {
+			ga.validationError(w, "role", "can't change your own role")
+			return
+		}
+		member.Role = role
+		if err := op.OrganizationMemberSave(ctx, member); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusOK, w, member)
+	case "orgRemove":
+		if member == nil {
+			ga.validationError(w, "email", "not found")
+			return
+		}
+		if member.UID == auth.UID {
+			ga.validationError(w, "email", "can't remove yourself")
+			return
+		}
+		if err := op.OrganizationMemberDelete(ctx, orgID, member.Email); err != nil {
+			ga.internalError(w, err)
+			return
+		}
+		ga.writeJSON(http.StatusOK, w, nil)
+	default:
+		ga.writeJSON(http.StatusBadRequest, w, errorResponse{Error: "unknown action"})
+	}
+}
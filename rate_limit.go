@@ -0,0 +1,138 @@
+package gauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/altlimit/gauth/cache"
+)
+
+const (
+	FlowLogin        = "login"
+	FlowRegister     = "register"
+	FlowResetLink    = "resetlink"
+	FlowConfirmEmail = "confirmemail"
+	// FlowClient is the client credentials grant counted by client id
+	FlowClient = "client"
+
+	RateByIP         RateKey = "ip"
+	RateByIdentity   RateKey = "identity"
+	RateByIPIdentity RateKey = "ipidentity"
+	RateGlobal       RateKey = "global"
+)
+
+type (
+	// RateKey is the dimension a RateRule counts requests by
+	RateKey string
+
+	RateRule struct {
+		By   RateKey
+		Rate cache.Rate
+	}
+)
+
+// key returns the rate limiter key of this rule or empty if it doesn't apply
+func (rr RateRule) key(flow, ip, identity string) string {
+	switch rr.By {
+	case RateByIP:
+		if ip != "" {
+			return flow + ":ip:" + ip
+		}
+	case RateByIdentity:
+		// same key as the single rate per flow before rules were added
+		if identity != "" {
+			return flow + ":" + identity
+		}
+	case RateByIPIdentity:
+		if ip != "" && identity != "" {
+			return flow + ":ipid:" + ip + "|" + identity
+		}
+	case RateGlobal:
+		return flow + ":global"
+	}
+	return ""
+}
+
+// rateRules returns the configured rate of a flow plus the additional rules
+func (ga *GAuth) rateRules(flow string) []RateRule {
+	var rules []RateRule
+	switch flow {
+	case FlowLogin:
+		rules = append(rules, RateRule{By: RateByIdentity, Rate: ga.RateLimit.Login})
+	case FlowRegister:
+		rules = append(rules, RateRule{By: RateByIP, Rate: ga.RateLimit.Register})
+	case FlowResetLink:
+		rules = append(rules, RateRule{By: RateByIdentity, Rate: ga.RateLimit.ResetLink})
+	case FlowConfirmEmail:
+		rules = append(rules, RateRule{By: RateByIdentity, Rate: ga.RateLimit.ConfirmEmail})
+	case FlowClient:
+		rules = append(rules, RateRule{By: RateByIdentity, Rate: ga.RateLimit.Login})
+	}
+	return append(rules, ga.RateLimit.Rules[flow]...)
+}
+
+// tenantKey prefixes a rate limiter key with the tenant so tenants don't share the limits of an identity
+func (ga *GAuth) tenantKey(key string) string {
+	if tid := ga.tenantID(); tid != "" {
+		return "t:" + tid + ":" + key
+	}
+	return key
+}
+
+// ipSubnet groups IPv6 addresses by RateLimit.IPv6Prefix since a single client usually owns a whole /64
+func (ga *GAuth) ipSubnet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	mask := net.CIDRMask(ga.RateLimit.IPv6Prefix, 128)
+	return parsed.Mask(mask).String() + "/" + strconv.Itoa(ga.RateLimit.IPv6Prefix)
+}
+
+// rateLimitFlow evaluates the rules of a flow in order and returns false after writing a 429 or 500
+// response for the first one over the rate, later rules aren't charged for a denied request.
+func (ga *GAuth) rateLimitFlow(ctx context.Context, w http.ResponseWriter, r *http.Request, flow, identity string) bool {
+	ip := ga.ipSubnet(ga.clientIP(r))
+	identity = strings.ToLower(identity)
+	for _, rule := range ga.rateRules(flow) {
+		key := rule.key(flow, ip, identity)
+		if key == "" {
+			continue
+		}
+		err := ga.rateLimiter.RateLimit(ctx, ga.tenantKey(key), rule.Rate.Rate, rule.Rate.Duration)
+		if err == nil {
+			continue
+		}
+		if rle, ok := err.(cache.RateLimitError); ok {
+			ga.tooManyRequests(w, rle)
+		} else {
+			ga.internalError(w, err)
+		}
+		return false
+	}
+	return true
+}
+
+func (ga *GAuth) tooManyRequests(w http.ResponseWriter, rle cache.RateLimitError) {
+	ga.writeJSON(http.StatusTooManyRequests, w, errorResponse{Error: "Try again later", RetryAfter: ga.rateLimitHeaders(w, rle)})
+}
+
+// rateLimitHeaders sets Retry-After and RateLimit-* headers returning the seconds to wait
+func (ga *GAuth) rateLimitHeaders(w http.ResponseWriter, rle cache.RateLimitError) int {
+	if rle.RetryAfter <= 0 {
+		// custom limiters may not provide it so we assume the whole window
+		rle.RetryAfter = rle.Rate.Duration
+	}
+	secs := rle.RetryAfterSeconds()
+	h := w.Header()
+	h.Set("Retry-After", strconv.Itoa(secs))
+	h.Set("RateLimit-Limit", strconv.Itoa(rle.Rate.Rate))
+	h.Set("RateLimit-Remaining", "0")
+	h.Set("RateLimit-Reset", strconv.Itoa(secs))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rle.Rate.Rate, int(rle.Rate.Duration.Seconds())))
+	return secs
+}
@@ -14,8 +14,8 @@ func (ga *GAuth) registerHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
-		fc := ga.formConfig()
-		fc.Recaptcha = ga.RecaptchaSiteKey
+		fc := ga.formConfig(w, r)
+		fc.Captcha = ga.captchaWidget(FlowRegister)
 		fc.Title = "Register"
 		fc.Submit = "Register"
 		fc.Links = append(fc.Links, &form.Link{
@@ -23,7 +23,7 @@ func (ga *GAuth) registerHandler(w http.ResponseWriter, r *http.Request) {
 			Label: "Login",
 		})
 		fc.Fields = ga.registerFields()
-		if err := form.Render(w, fc); err != nil {
+		if err := ga.renderForm(w, fc); err != nil {
 			ga.internalError(w, err)
 		}
 		return
@@ -48,13 +48,13 @@ func (ga *GAuth) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if ga.RecaptchaSecret != "" && ga.RecaptchaSiteKey != "" {
-		if recaptcha, ok := req["recaptcha"].(string); ok {
-			if err := validRecaptcha(ga.RecaptchaSecret, recaptcha, realIP(r)); err != nil {
-				ga.validationError(w, "recaptcha", "verification failed")
-				return
-			}
-		}
+	response := toString(req[FieldCaptchaID])
+	if response == "" {
+		// sent by clients before captcha providers were pluggable
+		response = toString(req["recaptcha"])
+	}
+	if !ga.validCaptcha(w, r, FlowRegister, response) {
+		return
 	}
 	ctx := context.WithValue(r.Context(), RequestKey, r)
 	// check if identityField is unique
@@ -72,12 +72,11 @@ func (ga *GAuth) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := ga.rateLimiter.RateLimit(ctx, realIP(r), ga.RateLimit.Register.Rate, ga.RateLimit.Register.Duration); err != nil {
-		ga.writeJSON(http.StatusTooManyRequests, w, errorResponse{Error: "Try again later"})
+	if !ga.rateLimitFlow(ctx, w, r, FlowRegister, id) {
 		return
 	}
 
-	identity, err := ga.IdentityProvider.IdentityLoad(ctx, "")
+	identity, err := ga.identityLoad(ctx, "")
 	if err != ErrIdentityNotFound {
 		ga.internalError(w, errors.New("IdentityLoad with empty uid got a record: "+err.Error()))
 	}
@@ -99,6 +98,8 @@ func (ga *GAuth) registerHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// the first login from the browser that registered isn't a new device
+	ga.rememberDevice(w, uid)
 	sent, err := ga.sendMail(ctx, actionVerify, uid, req)
 	if err != nil {
 		ga.internalError(w, err)
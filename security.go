@@ -0,0 +1,104 @@
+package gauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/altlimit/gauth/form"
+)
+
+type (
+	// SecurityHeaders are set on gauth responses, rendered pages get a Content-Security-Policy that
+	// only runs their own scripts with a nonce per request.
+	SecurityHeaders struct {
+		// Disabled stops setting the Content-Security-Policy, framing and referrer headers,
+		// e.g. when a proxy sets them. Responses still have Cache-Control: no-store.
+		Disabled bool
+		// FrameAncestors can embed the pages e.g. https://app.example.com, defaults to none
+		FrameAncestors []string
+		// ScriptSrc, StyleSrc, ImgSrc, ConnectSrc and FrameSrc add sources to their directive
+		// for customized pages, the origins of Captcha and Brand.LogoURL are already allowed.
+		ScriptSrc  []string
+		StyleSrc   []string
+		ImgSrc     []string
+		ConnectSrc []string
+		FrameSrc   []string
+	}
+)
+
+// newNonce returns a random url safe value, e.g. for the nonce attributes of a page
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// securityHeaders sets the headers of every gauth response, pages with a token in their url
+// don't send it to other sites in a Referer.
+func (ga *GAuth) securityHeaders(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Content-Type-Options", "nosniff")
+	if ga.SecurityHeaders.Disabled {
+		return
+	}
+	if len(ga.SecurityHeaders.FrameAncestors) == 0 {
+		h.Set("X-Frame-Options", "DENY")
+	}
+	if r.URL.Query().Get("t") != "" {
+		h.Set("Referrer-Policy", "no-referrer")
+	} else {
+		h.Set("Referrer-Policy", "same-origin")
+	}
+}
+
+// contentSecurityPolicy returns the policy of the page rendered with fc
+func (ga *GAuth) contentSecurityPolicy(fc *form.Config) string {
+	sh := ga.SecurityHeaders
+	nonce := "'nonce-" + fc.Nonce + "'"
+	var origins []string
+	if fc.Captcha != nil {
+		origins = fc.Captcha.Origins
+	}
+	img := []string{"'self'", "data:"}
+	if u, err := url.Parse(fc.Brand.LogoURL); err == nil && u.Scheme != "" && u.Host != "" {
+		img = append(img, u.Scheme+"://"+u.Host)
+	}
+	ancestors := sh.FrameAncestors
+	if len(ancestors) == 0 {
+		ancestors = []string{"'none'"}
+	}
+	frames := append(append([]string{}, origins...), sh.FrameSrc...)
+	if len(frames) == 0 {
+		frames = []string{"'none'"}
+	}
+	directives := [][]string{
+		{"default-src", "'self'"},
+		// the alpine.js build evaluates its directives, strict-dynamic lets captcha scripts load theirs
+		append(append([]string{"script-src", nonce, "'strict-dynamic'", "'unsafe-eval'", "'self'"}, origins...), sh.ScriptSrc...),
+		append(append([]string{"style-src", "'self'", nonce}, origins...), sh.StyleSrc...),
+		append(append(append([]string{"img-src"}, img...), origins...), sh.ImgSrc...),
+		append(append([]string{"connect-src", "'self'"}, origins...), sh.ConnectSrc...),
+		append([]string{"frame-src"}, frames...),
+		append([]string{"frame-ancestors"}, ancestors...),
+		{"object-src", "'none'"},
+		{"base-uri", "'none'"},
+		{"form-action", "'self'"},
+	}
+	policy := make([]string, len(directives))
+	for i, d := range directives {
+		policy[i] = strings.Join(d, " ")
+	}
+	return strings.Join(policy, "; ")
+}
+
+// renderForm writes the page of fc with its Content-Security-Policy
+func (ga *GAuth) renderForm(w http.ResponseWriter, fc *form.Config) error {
+	if !ga.SecurityHeaders.Disabled {
+		w.Header().Set("Content-Security-Policy", ga.contentSecurityPolicy(fc))
+	}
+	return form.Render(w, fc)
+}
@@ -0,0 +1,153 @@
+package gauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/altlimit/gauth/email"
+	"github.com/altlimit/gauth/form"
+)
+
+const (
+	// TenantKey used to store value of *Tenant in context, your IdentityProvider should use
+	// TenantFromContext to scope your identities per tenant.
+	TenantKey ctxKey = "tenantKey"
+)
+
+type (
+	// Tenant overrides GAuth settings for a single organization, nil/empty values
+	// uses the GAuth defaults.
+	Tenant struct {
+		ID string
+		// Brand replaces GAuth.Brand, AppURL should be the tenant url for email links
+		Brand *form.Brand
+		// Fields replaces GAuth.Fields and must include the identity, email and password fields
+		Fields []*form.Field
+		// EmailTemplate replaces email.Template for this tenant
+		EmailTemplate string
+		// EmailTemplates replaces GAuth.EmailTemplates
+		EmailTemplates *email.Templates
+		// JwtKey signs all tokens of this tenant, tokens also carries a "tid" claim
+		JwtKey []byte
+	}
+
+	// TenantProvider loads a tenant resolved from a request
+	TenantProvider interface {
+		// TenantLoad should return ErrTenantNotFound if the tenant does not exists
+		TenantLoad(ctx context.Context, id string) (*Tenant, error)
+	}
+
+	// TenantResolver returns the tenant id of a request and the request path without any tenant prefix,
+	// an empty id will use the GAuth defaults.
+	TenantResolver func(r *http.Request) (id string, path string)
+)
+
+var (
+	ErrTenantNotFound = errors.New("tenant not found")
+)
+
+// TenantFromSubdomain resolves the tenant from the first label of the host under domain,
+// e.g. acme.example.com with domain example.com.
+func TenantFromSubdomain(domain string) TenantResolver {
+	suffix := "." + strings.TrimPrefix(domain, ".")
+	return func(r *http.Request) (string, string) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if !strings.HasSuffix(host, suffix) {
+			return "", r.URL.Path
+		}
+		sub := strings.TrimSuffix(host, suffix)
+		if strings.Contains(sub, ".") {
+			return "", r.URL.Path
+		}
+		return sub, r.URL.Path
+	}
+}
+
+// TenantFromHeader resolves the tenant from a request header such as X-Tenant-ID set by your proxy.
+func TenantFromHeader(name string) TenantResolver {
+	return func(r *http.Request) (string, string) {
+		return r.Header.Get(name), r.URL.Path
+	}
+}
+
+// TenantFromPathPrefix resolves the tenant from the first path segment e.g. /acme/auth/login,
+// the prefix is also added to the page links and cookie paths.
+func TenantFromPathPrefix(r *http.Request) (string, string) {
+	p := strings.TrimPrefix(r.URL.Path, "/")
+	i := strings.Index(p, "/")
+	if i < 1 {
+		return "", r.URL.Path
+	}
+	return p[:i], p[i:]
+}
+
+// TenantFromContext returns the tenant of the current request or nil
+func TenantFromContext(ctx context.Context) *Tenant {
+	if t, ok := ctx.Value(TenantKey).(*Tenant); ok {
+		return t
+	}
+	return nil
+}
+
+func (ga *GAuth) tenantID() string {
+	if ga.tenant != nil {
+		return ga.tenant.ID
+	}
+	return ""
+}
+
+// tenantRequest resolves the tenant of a request returning a copy of GAuth with the tenant
+// settings applied, the request path without prefix and the request with tenant in context.
+func (ga *GAuth) tenantRequest(r *http.Request) (*GAuth, string, *http.Request, error) {
+	if ga.TenantProvider == nil || ga.tenant != nil {
+		return ga, r.URL.Path, r, nil
+	}
+	id, path := ga.TenantResolver(r)
+	if id == "" {
+		return ga, r.URL.Path, r, nil
+	}
+	t, err := ga.TenantProvider.TenantLoad(r.Context(), id)
+	if err != nil {
+		return nil, "", r, err
+	}
+	tga := *ga
+	tga.tenant = t
+	if t.Brand != nil {
+		tga.Brand = *t.Brand
+	}
+	if t.Fields != nil {
+		tga.Fields = t.Fields
+		for _, fID := range []string{tga.IdentityFieldID, tga.EmailFieldID, tga.PasswordFieldID} {
+			if fID != "" && tga.fieldByID(fID) == nil {
+				return nil, "", r, fmt.Errorf("tenantRequest: tenant %s missing field %s", t.ID, fID)
+			}
+		}
+	}
+	if len(t.JwtKey) > 0 {
+		tga.JwtKey = t.JwtKey
+	}
+	if prefix := strings.TrimSuffix(r.URL.Path, path); prefix != "" {
+		tga.Path.Base = prefix + ga.Path.Base
+	}
+	r = r.WithContext(context.WithValue(r.Context(), TenantKey, t))
+	return &tga, path, r, nil
+}
+
+func (ga *GAuth) tenantError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrTenantNotFound {
+		if ga.isJson(r) {
+			ga.writeJSON(http.StatusNotFound, w, errorResponse{Error: err.Error()})
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	ga.internalError(w, err)
+}
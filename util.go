@@ -4,16 +4,11 @@ import (
 	"context"
 	"crypto/sha1"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
-	"net"
 	"net/http"
 	"net/mail"
-	"net/url"
-	"strings"
 	"time"
 	"unicode"
 
@@ -122,47 +117,6 @@ func randomJWTKey() ([]byte, error) {
 	return key, nil
 }
 
-func validRecaptcha(secret string, response string, ip string) error {
-	type verify struct {
-		Success bool `json:"success"`
-	}
-	hc := &http.Client{}
-	resp, err := hc.PostForm("https://www.google.com/recaptcha/api/siteverify", url.Values{
-		"secret":   {secret},
-		"response": {response},
-		"remoteip": {ip},
-	})
-
-	if err != nil {
-		return fmt.Errorf("validRecaptcha: PostForm error %v", err)
-	}
-
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	var v verify
-	if err := json.Unmarshal(body, &v); err != nil {
-		return err
-	}
-	if !v.Success {
-		return errors.New("failed recaptcha")
-	}
-	return nil
-}
-
-func realIP(r *http.Request) string {
-	if ip := r.Header.Get("X-Appengine-User-Ip"); ip != "" {
-		return ip
-	}
-	if ip := r.Header.Get("X-Forwarded-For"); ip != "" {
-		return strings.Split(ip, ", ")[0]
-	}
-	if ip := r.Header.Get("X-Real-IP"); ip != "" {
-		return ip
-	}
-	ra, _, _ := net.SplitHostPort(r.RemoteAddr)
-	return ra
-}
-
 func unverifiedClaims(t string) (jwt.MapClaims, error) {
 	token, _, err := new(jwt.Parser).ParseUnverified(t, jwt.MapClaims{})
 	if err != nil {
@@ -184,11 +138,11 @@ func randSeq(n int) string {
 }
 
 // sha1(ip+userAgent+key+$salt) + $salt
-func clientFromRequest(r *http.Request, key, salt string) string {
+func clientFromRequest(ip string, r *http.Request, key, salt string) string {
 	if salt == "" {
 		salt = fmt.Sprintf("$%d", time.Now().Unix())
 	}
-	cid := realIP(r) + r.Header.Get("User-Agent") + key + salt
+	cid := ip + r.Header.Get("User-Agent") + key + salt
 	h := sha1.New()
 	h.Write([]byte(cid))
 	return hex.EncodeToString(h.Sum(nil)) + salt